@@ -2,43 +2,36 @@ package activity_history
 
 import (
 	"context"
-	"encoding/json"
 	"raidhub/packages/async"
-
-	amqp "github.com/rabbitmq/amqp091-go"
+	"raidhub/packages/bungie/health"
+	"raidhub/packages/messages"
 )
 
 type ActivityHistoryRequest struct {
 	MembershipId int64 `json:"membershipId,string"`
 }
 
-const queueName = "activity_history"
+const (
+	queueName      = "activity_history"
+	messageType    = "activity_history_request"
+	messageVersion = 1
+)
+
+func init() {
+	messages.Register(messageType, 0, messages.JSON[ActivityHistoryRequest]())
+	messages.Register(messageType, 1, messages.JSON[ActivityHistoryRequest]())
+}
 
 func Create() async.QueueWorker {
-	create_outbound_channel()
 	return async.QueueWorker{
 		QueueName: queueName,
 		Processer: process_request,
+		Systems:   []string{health.Destiny2},
 	}
 }
 
-func SendMessage(ch *amqp.Channel, membershipId int64) error {
-	body, err := json.Marshal(ActivityHistoryRequest{
+func SendMessage(ctx context.Context, membershipId int64) error {
+	return async.Publish(ctx, queueName, true, messageType, messageVersion, ActivityHistoryRequest{
 		MembershipId: membershipId,
 	})
-	if err != nil {
-		return err
-	}
-
-	return ch.PublishWithContext(
-		context.Background(),
-		"",        // exchange
-		queueName, // routing key (queue name)
-		true,      // mandatory
-		false,     // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
 }
@@ -1,50 +1,28 @@
 package activity_history
 
 import (
-	"encoding/json"
+	"context"
 	"log"
 	"raidhub/packages/async"
 	"raidhub/packages/async/bonus_pgcr"
 	"raidhub/packages/bungie"
-	"raidhub/packages/rabbit"
+	"raidhub/packages/messages"
 	"sync"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-var (
-	outgoing *amqp.Channel
-	once     sync.Once
-)
-
-func create_outbound_channel() {
-	once.Do(func() {
-		conn, err := rabbit.Init()
-		if err != nil {
-			log.Fatalf("Failed to create outbound channel: %s", err)
-		}
-		outgoing, _ = conn.Channel()
-	})
-}
-
-func process_request(qw *async.QueueWorker, msg amqp.Delivery) {
-	qw.Wg.Wait()
-	defer func() {
-		if err := msg.Ack(false); err != nil {
-			log.Printf("Failed to acknowledge message: %v", err)
-		}
-	}()
-
-	var request ActivityHistoryRequest
-	if err := json.Unmarshal(msg.Body, &request); err != nil {
-		log.Fatalf("Failed to unmarshal message: %s", err)
-		return
+func process_request(ctx context.Context, qw *async.QueueWorker, msg amqp.Delivery) async.Result {
+	request, _, err := messages.Decode[ActivityHistoryRequest](msg.Body, messageType)
+	if err != nil {
+		log.Printf("Failed to decode message: %s", err)
+		return async.DeadLetter
 	}
 
-	profiles, err := bungie.GetLinkedProfiles(-1, request.MembershipId, false)
+	profiles, err := bungie.Default().GetLinkedProfiles(ctx, -1, request.MembershipId, false)
 	if err != nil {
 		log.Printf("Failed to get linked profiles: %s", err)
-		return
+		return async.RetryIfTransient(err)
 	}
 
 	var membershipType int
@@ -57,13 +35,13 @@ func process_request(qw *async.QueueWorker, msg amqp.Delivery) {
 
 	if membershipType == 0 {
 		log.Printf("Failed to find membership type for %d", request.MembershipId)
-		return
+		return async.Ack
 	}
 
-	stats, err := bungie.GetHistoricalStats(membershipType, request.MembershipId)
+	stats, err := bungie.Default().GetHistoricalStats(ctx, membershipType, request.MembershipId)
 	if err != nil {
 		log.Printf("Failed to get stats: %s", err)
-		return
+		return async.RetryIfTransient(err)
 	}
 
 	out := make(chan int64, 2000)
@@ -73,28 +51,36 @@ func process_request(qw *async.QueueWorker, msg amqp.Delivery) {
 	go func() {
 		defer wg.Done()
 		for instanceId := range out {
-			bonus_pgcr.SendFetchMessage(outgoing, instanceId)
+			if err := bonus_pgcr.SendFetchMessage(ctx, instanceId); err != nil {
+				log.Printf("Failed to send fetch request for %d: %s", instanceId, err)
+			}
 		}
 	}()
 
 	var success = false
+	var historyErr error
 	for _, character := range stats.Characters {
-		err := bungie.GetActivityHistory(membershipType, request.MembershipId, character.CharacterId, 3, out)
-		if err != nil {
-			log.Println(err)
+		historyErr = bungie.Default().GetActivityHistory(ctx, membershipType, request.MembershipId, character.CharacterId, 3, out)
+		if historyErr != nil {
+			log.Println(historyErr)
 			break
 		}
 		success = true
 	}
 
+	close(out)
+	wg.Wait()
+
 	if success {
 		log.Printf("Updating player %d history_last_crawled", request.MembershipId)
 		_, err := qw.Db.Exec(`UPDATE player SET history_last_crawled = NOW() WHERE membership_id = $1`, request.MembershipId)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Failed to update history_last_crawled for %d: %s", request.MembershipId, err)
+			return async.Retry
 		}
+	} else if historyErr != nil {
+		return async.RetryIfTransient(historyErr)
 	}
 
-	close(out)
-	wg.Wait()
+	return async.Ack
 }
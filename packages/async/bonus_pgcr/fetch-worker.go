@@ -1,75 +1,78 @@
 package bonus_pgcr
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"log"
-	"net/http"
 	"raidhub/packages/async"
+	"raidhub/packages/bungie"
+	"raidhub/packages/messages"
 	"raidhub/packages/pgcr"
-	"strconv"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type PGCRFetchRequest struct {
-	InstanceId string `json:"instanceId"`
+	InstanceId int64 `json:"instanceId,string"`
 }
 
-func process_fetch_request(qw *async.QueueWorker, msg amqp.Delivery, client *http.Client, apiKey string) {
-	qw.Wg.Wait()
-
-	defer func() {
-		if err := msg.Ack(false); err != nil {
-			log.Printf("Failed to acknowledge message: %v", err)
-		}
-	}()
-
-	var request PGCRFetchRequest
-	if err := json.Unmarshal(msg.Body, &request); err != nil {
-		log.Fatalf("Failed to unmarshal message: %s", err)
-		return
+func process_fetch_request(ctx context.Context, qw *async.QueueWorker, msg amqp.Delivery, client *bungie.Client) async.Result {
+	request, _, err := messages.Decode[PGCRFetchRequest](msg.Body, fetchMessageType)
+	if err != nil {
+		log.Printf("Failed to decode message: %s", err)
+		return async.DeadLetter
 	}
 
-	log.Printf("Checking bonus pgcr %s", request.InstanceId)
+	log.Printf("Checking bonus pgcr %d", request.InstanceId)
 	exists, err := check_if_pgcr_exists(request.InstanceId, qw.Db)
 	if err != nil {
-		log.Printf("Error reading database for pgcr request %s: %s", request.InstanceId, err)
+		log.Printf("Error reading database for pgcr request %d: %s", request.InstanceId, err)
+		return async.Retry
 	} else if exists {
-		log.Printf("%s already exists", request.InstanceId)
-		return
+		log.Printf("%d already exists", request.InstanceId)
+		return async.Ack
 	} else {
-		instanceIdInt, err := strconv.ParseInt(request.InstanceId, 10, 64)
-		if err != nil {
-			log.Printf("Error parsing instance_id %s: %s", request.InstanceId, err)
-			return
-		}
-
-		result, activity, raw, err := pgcr.FetchAndProcessPGCR(client, instanceIdInt, apiKey)
+		result, activity, raw, err := pgcr.FetchAndProcessPGCR(ctx, client, request.InstanceId)
 
 		if err != nil {
-			log.Printf("Error fetching instanceId %d: %s", instanceIdInt, err)
-			pgcr.WriteMissedLog(instanceIdInt)
-			return
+			log.Printf("Error fetching instanceId %d: %s", request.InstanceId, err)
+			write_missed(qw.Db, request.InstanceId, result)
+			return async.Ack
 		}
 
 		if result == pgcr.Success {
-			sendStoreMessage(outgoing, activity, raw)
+			if err := sendStoreMessage(ctx, activity, raw); err != nil {
+				log.Printf("Error sending instance_id %d to the store queue: %s", request.InstanceId, err)
+				return async.Retry
+			}
 		} else if result == pgcr.NonRaid {
-			log.Printf("%s is not a raid", request.InstanceId)
+			log.Printf("%d is not a raid", request.InstanceId)
+			if err := pgcr.StoreNonRaid(request.InstanceId, qw.Db); err != nil {
+				log.Printf("Error recording non-raid instance_id %d: %s", request.InstanceId, err)
+			}
+			if err := pgcr.ResolveMissed(qw.Db, request.InstanceId); err != nil {
+				log.Printf("Error resolving missed instance_id %d: %s", request.InstanceId, err)
+			}
 		} else {
-			log.Printf("%s returned a nil error result: %d", request.InstanceId, result)
-			pgcr.WriteMissedLog(instanceIdInt)
+			log.Printf("%d returned a nil error result: %d", request.InstanceId, result)
+			write_missed(qw.Db, request.InstanceId, result)
 		}
 	}
+	return async.Ack
 }
 
-func check_if_pgcr_exists(instanceid string, db *sql.DB) (bool, error) {
+func check_if_pgcr_exists(instanceId int64, db *sql.DB) (bool, error) {
 	var result bool
-	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM activity a INNER JOIN pgcr ON a.instance_id = pgcr.instance_id WHERE a.instance_id = $1 LIMIT 1)`, instanceid).Scan(&result)
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM instance a INNER JOIN pgcr ON a.instance_id = pgcr.instance_id WHERE a.instance_id = $1 LIMIT 1)`, instanceId).Scan(&result)
 	if err != nil {
 		return false, err
 	} else {
 		return result, nil
 	}
 }
+
+func write_missed(db *sql.DB, instanceId int64, result pgcr.PGCRResult) {
+	if err := pgcr.WriteMissed(db, instanceId, result); err != nil {
+		log.Printf("Error recording missed instance_id %d: %s", instanceId, err)
+	}
+}
@@ -2,94 +2,67 @@ package bonus_pgcr
 
 import (
 	"context"
-	"encoding/json"
-	"net/http"
-	"os"
 	"raidhub/packages/async"
 	"raidhub/packages/bungie"
+	"raidhub/packages/bungie/health"
+	"raidhub/packages/messages"
 	"raidhub/packages/pgcr_types"
-	"strconv"
-	"sync"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-var (
-	outgoing *amqp.Channel
-	once     sync.Once
+const (
+	fetchQueueName      = "pgcr_fetch"
+	fetchMessageType    = "pgcr_fetch_request"
+	fetchMessageVersion = 1
 )
 
-func CreateOutboundChannel(conn *amqp.Connection) {
-	once.Do(func() {
-		outgoing, _ = conn.Channel()
-	})
+func init() {
+	messages.Register(fetchMessageType, 0, messages.JSON[PGCRFetchRequest]())
+	messages.Register(fetchMessageType, 1, messages.JSON[PGCRFetchRequest]())
+	messages.Register(storeMessageType, 0, messages.JSON[PGCRStoreRequest]())
+	messages.Register(storeMessageType, 1, messages.JSON[PGCRStoreRequest]())
 }
 
-const fetchQueueName = "pgcr_fetch"
-
 func CreateFetchWorker() async.QueueWorker {
-	client := &http.Client{}
-	apiKey := os.Getenv("BUNGIE_API_KEY")
-
 	qw := async.QueueWorker{
 		QueueName: fetchQueueName,
-		Processer: func(qw *async.QueueWorker, msg amqp.Delivery) {
-			process_fetch_request(qw, msg, client, apiKey)
+		Systems:   []string{health.Destiny2},
+		Processer: func(ctx context.Context, qw *async.QueueWorker, msg amqp.Delivery) async.Result {
+			return process_fetch_request(ctx, qw, msg, bungie.Default())
 		},
 	}
 
 	return qw
 }
 
-func SendFetchMessage(ch *amqp.Channel, instanceId int64) error {
-	body, err := json.Marshal(PGCRFetchRequest{
-		InstanceId: strconv.FormatInt(instanceId, 10),
+func SendFetchMessage(ctx context.Context, instanceId int64) error {
+	return async.Publish(ctx, fetchQueueName, false, fetchMessageType, fetchMessageVersion, PGCRFetchRequest{
+		InstanceId: instanceId,
 	})
-	if err != nil {
-		return err
-	}
-
-	return ch.PublishWithContext(
-		context.Background(),
-		"",             // exchange
-		fetchQueueName, // routing key (queue name)
-		false,          // mandatory
-		false,          // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
 }
 
-const storeQueueName = "pgcr_store"
+const (
+	storeQueueName      = "pgcr_store"
+	storeMessageType    = "pgcr_store_request"
+	storeMessageVersion = 1
+)
 
 func CreateStoreWorker() async.QueueWorker {
 	qw := async.QueueWorker{
 		QueueName: storeQueueName,
 		Processer: process_store_queue,
+		// Stores write often related records, which deadlock when they run concurrently
+		Config: async.QueueConfig{
+			MaxConsumers: 1,
+		},
 	}
 	return qw
 }
 
-func sendStoreMessage(ch *amqp.Channel, activity *pgcr_types.ProcessedActivity, raw *bungie.DestinyPostGameCarnageReport) error {
-	body, err := json.Marshal(PGCRStoreRequest{
+func sendStoreMessage(ctx context.Context, activity *pgcr_types.ProcessedActivity, raw *bungie.DestinyPostGameCarnageReport) error {
+	return async.Publish(ctx, storeQueueName, false, storeMessageType, storeMessageVersion, PGCRStoreRequest{
 		Activity: activity,
 		Raw:      raw,
 	})
-	if err != nil {
-		return err
-	}
-
-	return ch.PublishWithContext(
-		context.Background(),
-		"",             // exchange
-		storeQueueName, // routing key (queue name)
-		false,          // mandatory
-		false,          // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
 }
@@ -1,13 +1,14 @@
 package bonus_pgcr
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
-	"os"
 	"raidhub/packages/async"
 	"raidhub/packages/bungie"
+	"raidhub/packages/config"
 	"raidhub/packages/discord"
+	"raidhub/packages/messages"
 	"raidhub/packages/pgcr"
 	"raidhub/packages/pgcr_types"
 
@@ -19,43 +20,47 @@ type PGCRStoreRequest struct {
 	Activity *pgcr_types.ProcessedActivity        `json:"activity"`
 }
 
-func process_store_queue(qw *async.QueueWorker, msg amqp.Delivery) {
-	defer func() {
-		if err := msg.Ack(false); err != nil {
-			log.Printf("Failed to acknowledge message: %v", err)
-		}
-	}()
-
-	var request PGCRStoreRequest
-	if err := json.Unmarshal(msg.Body, &request); err != nil {
-		log.Println(string(msg.Body[:]))
-		log.Fatalf("Failed to unmarshal pgcr store request: %s", err)
-		return
+func process_store_queue(ctx context.Context, qw *async.QueueWorker, msg amqp.Delivery) async.Result {
+	request, _, err := messages.Decode[PGCRStoreRequest](msg.Body, storeMessageType)
+	if err != nil {
+		log.Printf("Failed to decode message: %s", err)
+		return async.DeadLetter
 	}
 
 	if request.Activity.PlayerCount > 20 {
 		// For now, don't bother with checkpoint instances and log for later
 		log.Printf("Skipping PGCR %d with %d players", request.Activity.InstanceId, request.Activity.PlayerCount)
-		pgcr.WriteMissedLog(request.Activity.InstanceId)
-		return
+		write_missed(qw.Db, request.Activity.InstanceId, pgcr.StoreFailed)
+		return async.Ack
 	}
 
-	_, committed, err := pgcr.StorePGCR(request.Activity, request.Raw, qw.Db, outgoing)
+	_, committed, err := pgcr.StorePGCR(ctx, request.Activity, request.Raw, qw.Db)
 	if err != nil {
 		log.Printf("Error storing instanceId %d: %s", request.Activity.InstanceId, err)
-		pgcr.WriteMissedLog(request.Activity.InstanceId)
+		write_missed(qw.Db, request.Activity.InstanceId, pgcr.StoreFailed)
 	} else if committed {
 		msg := fmt.Sprintf("Found missing PGCR: %d", request.Activity.InstanceId)
 		webhook := discord.Webhook{
 			Content: &msg,
 		}
 		log.Printf("%d added to data set", request.Activity.InstanceId)
-		discord.SendWebhook(os.Getenv("PAN_WEBHOOK_URL"), &webhook)
+		discord.SendWebhook(config.Load().Discord.PanWebhookURL, &webhook)
 
-		for i := request.Activity.InstanceId - 100_000; i < request.Activity.InstanceId+100_000; i++ {
-			pgcr.WriteMissedLog(i)
+		if err := pgcr.ResolveMissed(qw.Db, request.Activity.InstanceId); err != nil {
+			log.Printf("Error resolving missed instance_id %d: %s", request.Activity.InstanceId, err)
+		}
+
+		// A missing PGCR is likely to have missing neighbours
+		err = pgcr.WriteMissedRange(qw.Db, request.Activity.InstanceId-100_000, request.Activity.InstanceId+99_999,
+			fmt.Sprintf("neighbours of missing PGCR %d", request.Activity.InstanceId))
+		if err != nil {
+			log.Printf("Error recording missed range around instance_id %d: %s", request.Activity.InstanceId, err)
 		}
 	} else {
 		log.Printf("%d is already added", request.Activity.InstanceId)
+		if err := pgcr.ResolveMissed(qw.Db, request.Activity.InstanceId); err != nil {
+			log.Printf("Error resolving missed instance_id %d: %s", request.Activity.InstanceId, err)
+		}
 	}
+	return async.Ack
 }
@@ -2,10 +2,10 @@ package character_fill
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
 	"raidhub/packages/async"
-
-	amqp "github.com/rabbitmq/amqp091-go"
+	"raidhub/packages/bungie/health"
+	"raidhub/packages/messages"
 )
 
 type CharacterFillRequest struct {
@@ -14,30 +14,30 @@ type CharacterFillRequest struct {
 	InstanceId   int64 `json:"instanceId,string"`
 }
 
-const queueName = "character_fill"
+const (
+	queueName      = "character_fill"
+	messageType    = "character_fill_request"
+	messageVersion = 1
+)
+
+func init() {
+	messages.Register(messageType, 0, messages.JSON[CharacterFillRequest]())
+	messages.Register(messageType, 1, messages.JSON[CharacterFillRequest]())
+}
 
 func Create() async.QueueWorker {
 	return async.QueueWorker{
 		QueueName: queueName,
 		Processer: process_request,
+		Systems:   []string{health.Destiny2},
 	}
 }
 
-func SendMessage(ch *amqp.Channel, data *CharacterFillRequest) error {
-	body, err := json.Marshal(data)
-	if err != nil {
-		return err
-	}
+func SendMessage(ctx context.Context, data *CharacterFillRequest) error {
+	return async.Publish(ctx, queueName, false, messageType, messageVersion, data)
+}
 
-	return ch.PublishWithContext(
-		context.Background(),
-		"",        // exchange
-		queueName, // routing key (queue name)
-		false,     // mandatory
-		false,     // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
+// Records a fill request to be published once tx commits
+func WriteOutbox(ctx context.Context, tx *sql.Tx, data *CharacterFillRequest) error {
+	return async.WriteOutbox(ctx, tx, queueName, messageType, messageVersion, data)
 }
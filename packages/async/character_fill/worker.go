@@ -1,64 +1,61 @@
 package character_fill
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
 	"raidhub/packages/async"
 	"raidhub/packages/bungie"
+	"raidhub/packages/messages"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func process_request(qw *async.QueueWorker, msg amqp.Delivery) {
-	qw.Wg.Wait()
-	defer func() {
-		if err := msg.Ack(false); err != nil {
-			log.Printf("Failed to acknowledge message: %v", err)
-		}
-	}()
-
-	var request CharacterFillRequest
-	if err := json.Unmarshal(msg.Body, &request); err != nil {
-		log.Fatalf("Failed to unmarshal message: %s", err)
-		return
+func process_request(ctx context.Context, qw *async.QueueWorker, msg amqp.Delivery) async.Result {
+	request, _, err := messages.Decode[CharacterFillRequest](msg.Body, messageType)
+	if err != nil {
+		log.Printf("Failed to decode message: %s", err)
+		return async.DeadLetter
 	}
 
 	var currentClassHash sql.NullInt64
-	err := qw.Db.QueryRow("SELECT class_hash FROM instance_character WHERE membership_id = $1 AND character_id = $2 AND instance_id = $3 LIMIT 1", request.MembershipId, request.CharacterId, request.InstanceId).Scan(&currentClassHash)
+	err = qw.Db.QueryRow("SELECT class_hash FROM instance_character WHERE membership_id = $1 AND character_id = $2 AND instance_id = $3 LIMIT 1", request.MembershipId, request.CharacterId, request.InstanceId).Scan(&currentClassHash)
 	if err != nil && err != sql.ErrNoRows {
-		log.Fatal(err)
+		log.Printf("Failed to select current class hash: %s", err)
+		return async.Retry
 	}
 
 	if currentClassHash.Valid {
-		return
+		return async.Ack
 	}
 
 	var classHash uint32 = 0
 	err = qw.Db.QueryRow("SELECT class_hash FROM instance_character WHERE membership_id = $1 AND character_id = $2 AND class_hash IS NOT NULL LIMIT 1", request.MembershipId, request.CharacterId).Scan(&classHash)
 	if err != nil && err != sql.ErrNoRows {
-		log.Fatal("Failed to select class hash", err)
+		log.Printf("Failed to select class hash: %s", err)
+		return async.Retry
 	} else if classHash == 0 {
 		var membershipTypeValue sql.NullInt32
 		err = qw.Db.QueryRow("SELECT membership_type FROM player WHERE membership_id = $1", request.MembershipId).Scan(&membershipTypeValue)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Failed to select membership type: %s", err)
+			return async.Retry
 		}
 
 		var membershipType int32
 		if membershipTypeValue.Valid && membershipTypeValue.Int32 > 0 {
 			log.Printf("character %d, membership type identified: %d", request.CharacterId, membershipTypeValue.Int32)
 			if membershipTypeValue.Int32 == 4 {
-				return
+				return async.Ack
 			}
 			membershipType = membershipTypeValue.Int32
 		} else {
 			log.Println("character membership type not found")
-			profiles, err := bungie.GetLinkedProfiles(-1, request.MembershipId, false)
+			profiles, err := bungie.Default().GetLinkedProfiles(ctx, -1, request.MembershipId, false)
 			if err != nil {
 				log.Printf("Failed to get linked profile: %s", err)
-				return
+				return async.RetryIfTransient(err)
 			}
 			for _, p := range profiles {
 				if p.MembershipId == request.MembershipId {
@@ -67,15 +64,15 @@ func process_request(qw *async.QueueWorker, msg amqp.Delivery) {
 				}
 			}
 		}
-		char, err := bungie.GetCharacter(membershipType, request.MembershipId, request.CharacterId)
+		char, err := bungie.Default().GetCharacter(ctx, membershipType, request.MembershipId, request.CharacterId)
 		if err != nil {
 			log.Printf("Failed to get character: %s", err)
-			return
+			return async.RetryIfTransient(err)
 		}
 
 		if char.Character == nil {
 			log.Printf("Failed to get character: %s", fmt.Errorf("no character component in the response"))
-			return
+			return async.Ack
 		}
 
 		classHash = char.Character.Data.ClassHash
@@ -86,8 +83,10 @@ func process_request(qw *async.QueueWorker, msg amqp.Delivery) {
 		WHERE membership_id = $2 AND character_id = $3 AND instance_id = $4`,
 		classHash, request.MembershipId, request.CharacterId, request.InstanceId)
 	if err != nil {
-		log.Fatal("Failed to update instance_character", err)
+		log.Printf("Failed to update instance_character: %s", err)
+		return async.Retry
 	}
 
 	log.Printf("Updated instance,character: %d,%d", request.InstanceId, request.CharacterId)
+	return async.Ack
 }
@@ -2,42 +2,36 @@ package clan_crawl
 
 import (
 	"context"
-	"encoding/json"
 	"raidhub/packages/async"
-
-	amqp "github.com/rabbitmq/amqp091-go"
+	"raidhub/packages/bungie/health"
+	"raidhub/packages/messages"
 )
 
 type ClanRequest struct {
 	GroupId int64 `json:"groupId,string"`
 }
 
-const queueName = "clan"
+const (
+	queueName      = "clan"
+	messageType    = "clan_request"
+	messageVersion = 1
+)
+
+func init() {
+	messages.Register(messageType, 0, messages.JSON[ClanRequest]())
+	messages.Register(messageType, 1, messages.JSON[ClanRequest]())
+}
 
 func Create() async.QueueWorker {
 	return async.QueueWorker{
 		QueueName: queueName,
 		Processer: process_request,
+		Systems:   []string{health.Groups},
 	}
 }
 
-func SendMessage(ch *amqp.Channel, groupId int64) error {
-	body, err := json.Marshal(ClanRequest{
+func SendMessage(ctx context.Context, groupId int64) error {
+	return async.Publish(ctx, queueName, true, messageType, messageVersion, ClanRequest{
 		GroupId: groupId,
 	})
-	if err != nil {
-		return err
-	}
-
-	return ch.PublishWithContext(
-		context.Background(),
-		"",        // exchange
-		queueName, // routing key (queue name)
-		true,      // mandatory
-		false,     // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
 }
@@ -1,54 +1,50 @@
 package clan_crawl
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"log"
 	"raidhub/packages/async"
 	"raidhub/packages/bungie"
 	clan_util "raidhub/packages/clan"
+	"raidhub/packages/messages"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func process_request(qw *async.QueueWorker, msg amqp.Delivery) {
-	qw.Wg.Wait()
-	defer func() {
-		if err := msg.Ack(false); err != nil {
-			log.Printf("Failed to acknowledge message: %v", err)
-		}
-	}()
-
-	var request ClanRequest
-	if err := json.Unmarshal(msg.Body, &request); err != nil {
-		log.Printf("Failed to unmarshal message: %s", err)
-		return
+func process_request(ctx context.Context, qw *async.QueueWorker, msg amqp.Delivery) async.Result {
+	request, _, err := messages.Decode[ClanRequest](msg.Body, messageType)
+	if err != nil {
+		log.Printf("Failed to decode message: %s", err)
+		return async.DeadLetter
 	}
 
 	var lastCrawled sql.NullTime
 	row := qw.Db.QueryRow(`SELECT updated_at FROM clan WHERE group_id = $1`, request.GroupId)
 
-	err := row.Scan(&lastCrawled)
+	err = row.Scan(&lastCrawled)
 	if err != nil && err != sql.ErrNoRows {
-		log.Fatalf("Error getting last crawled time for clan %d: %s", request.GroupId, err)
+		log.Printf("Error getting last crawled time for clan %d: %s", request.GroupId, err)
+		return async.Retry
 	}
 
 	if err != nil || !lastCrawled.Valid || time.Since(lastCrawled.Time) > 3*time.Hour {
-		res, err := bungie.GetGroup(request.GroupId)
+		res, err := bungie.Default().GetGroup(ctx, request.GroupId)
 		if err != nil {
 			log.Printf("Error getting group %d: %s", request.GroupId, err)
-			return
+			return async.RetryIfTransient(err)
 		}
 
 		if res.Detail.GroupType != 1 {
 			log.Printf("Group %d is not a clan, skipping", request.GroupId)
-			return
+			return async.Ack
 		}
 
 		clanBannerData, name, callSign, motto, err := clan_util.ParseClanDetails(&res.Detail)
 		if err != nil {
-			log.Fatalf("Error parsing clan details: %s", err)
+			log.Printf("Error parsing clan details: %s", err)
+			return async.DeadLetter
 		}
 
 		_, err = qw.Db.Exec(`INSERT INTO clan (group_id, name, motto, call_sign, clan_banner_data, updated_at) VALUES ($1, $2, $3, $4, $5, $6)
@@ -56,7 +52,8 @@ func process_request(qw *async.QueueWorker, msg amqp.Delivery) {
 			DO UPDATE SET name = $2, motto = $3, call_sign = $4, clan_banner_data = $5, updated_at = $6`,
 			res.Detail.GroupId, name, motto, callSign, clanBannerData, time.Now().UTC())
 		if err != nil {
-			log.Fatalf("Error upserting clan %d: %s", res.Detail.GroupId, err)
+			log.Printf("Error upserting clan %d: %s", res.Detail.GroupId, err)
+			return async.Retry
 		}
 
 		log.Printf("Upserted clan %d: %s", res.Detail.GroupId, name)
@@ -64,4 +61,5 @@ func process_request(qw *async.QueueWorker, msg amqp.Delivery) {
 		log.Printf("Skipping crawl for clan %d", request.GroupId)
 	}
 
+	return async.Ack
 }
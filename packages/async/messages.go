@@ -0,0 +1,31 @@
+package async
+
+import (
+	"context"
+	"database/sql"
+	"raidhub/packages/messages"
+	"raidhub/packages/outbox"
+	"raidhub/packages/rabbit"
+)
+
+// Wraps payload in an envelope and publishes it to queueName, returning once the broker confirms it
+func Publish(ctx context.Context, queueName string, mandatory bool, msgType string, version int, payload any) error {
+	env, err := messages.New(ctx, msgType, version, payload)
+	if err != nil {
+		return err
+	}
+	msg, err := env.Publishing()
+	if err != nil {
+		return err
+	}
+	return rabbit.Publish(ctx, queueName, mandatory, msg)
+}
+
+// Wraps payload in an envelope and records it to be published to queueName once tx commits
+func WriteOutbox(ctx context.Context, tx *sql.Tx, queueName string, msgType string, version int, payload any) error {
+	env, err := messages.New(ctx, msgType, version, payload)
+	if err != nil {
+		return err
+	}
+	return outbox.Write(tx, queueName, env)
+}
@@ -2,16 +2,26 @@ package pgcr_clickhouse
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
 	"log"
 	"raidhub/packages/async"
 	"raidhub/packages/clickhouse"
+	"raidhub/packages/messages"
 	"raidhub/packages/pgcr_types"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-const queueName = "pgcr_clickhouse"
+const (
+	queueName      = "pgcr_clickhouse"
+	messageType    = "processed_activity"
+	messageVersion = 1
+)
+
+func init() {
+	messages.Register(messageType, 0, messages.JSON[pgcr_types.ProcessedActivity]())
+	messages.Register(messageType, 1, messages.JSON[pgcr_types.ProcessedActivity]())
+}
 
 func CreateClickhouseQueue() async.QueueWorker {
 	client, err := clickhouse.Connect(false)
@@ -19,33 +29,34 @@ func CreateClickhouseQueue() async.QueueWorker {
 		log.Fatal("Error connecting to clickhouse", err)
 	}
 
-	ch := make(chan amqp.Delivery)
+	ch := make(chan delivery)
+	flushes := make(chan chan struct{})
 	qw := async.QueueWorker{
 		QueueName: queueName,
-		Processer: func(qw *async.QueueWorker, msg amqp.Delivery) {
-			ch <- msg
+		// Messages stay unacknowledged until their batch is sent
+		Config: async.QueueConfig{
+			Prefetch: maxBatchSize,
+		},
+		Processer: func(ctx context.Context, qw *async.QueueWorker, msg amqp.Delivery) async.Result {
+			ch <- delivery{qw, msg}
+			return async.Deferred
+		},
+		Flush: func() {
+			done := make(chan struct{})
+			flushes <- done
+			<-done
 		},
 	}
-	go process_queue(&client, ch)
+	go process_queue(&client, ch, flushes)
 
 	return qw
 }
 
-func SendToClickhouse(ch *amqp.Channel, activity *pgcr_types.ProcessedActivity) error {
-	body, err := json.Marshal(activity)
-	if err != nil {
-		return err
-	}
+// Records an activity to be published to clickhouse once tx commits
+func WriteOutbox(ctx context.Context, tx *sql.Tx, activity *pgcr_types.ProcessedActivity) error {
+	return async.WriteOutbox(ctx, tx, queueName, messageType, messageVersion, activity)
+}
 
-	return ch.PublishWithContext(
-		context.Background(),
-		"",        // exchange
-		queueName, // routing key (queue name)
-		false,     // mandatory
-		false,     // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
+func SendToClickhouse(ctx context.Context, activity *pgcr_types.ProcessedActivity) error {
+	return async.Publish(ctx, queueName, false, messageType, messageVersion, activity)
 }
@@ -2,9 +2,10 @@ package pgcr_clickhouse
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
+	"raidhub/packages/async"
+	"raidhub/packages/messages"
 	"raidhub/packages/pgcr_types"
 	"time"
 
@@ -17,9 +18,16 @@ const (
 	batchTime    = 30 * time.Second
 )
 
-func process_queue(clickhouse *driver.Conn, msgs <-chan amqp.Delivery) {
+// A message with the worker which will settle it once its batch is sent
+type delivery struct {
+	qw  *async.QueueWorker
+	msg amqp.Delivery
+}
+
+// Sends batches to clickhouse as they fill up or time out, and sends everything held when a flush is requested
+func process_queue(clickhouse *driver.Conn, msgs <-chan delivery, flushes <-chan chan struct{}) {
 
-	batch := make([]amqp.Delivery, 0, maxBatchSize)
+	batch := make([]delivery, 0, maxBatchSize)
 	timer := time.NewTimer(batchTime)
 
 	for {
@@ -44,6 +52,13 @@ func process_queue(clickhouse *driver.Conn, msgs <-chan amqp.Delivery) {
 				}
 				timer.Reset(batchTime)
 			}
+		case done := <-flushes:
+			for len(batch) > 0 {
+				n := min(len(batch), maxBatchSize)
+				process(batch[:n], clickhouse)
+				batch = batch[n:]
+			}
+			close(done)
 		case <-timer.C:
 			if len(batch) > 0 {
 				// Process 2^n messages at a time
@@ -57,10 +72,9 @@ func process_queue(clickhouse *driver.Conn, msgs <-chan amqp.Delivery) {
 			}
 
 			if len(batch) > 0 {
-				var request pgcr_types.ProcessedActivity
-				msg := batch[0]
-				if err := json.Unmarshal(msg.Body, &request); err != nil {
-					log.Fatal("Failed to unmarshal activity:", err)
+				msg := batch[0].msg
+				if request, _, err := messages.Decode[pgcr_types.ProcessedActivity](msg.Body, messageType); err != nil {
+					log.Printf("Left %d messages in the queue. Peeking ahead: %s", len(batch), err)
 				} else {
 					log.Printf("Left %d messages in the queue. Peeking ahead: %d", len(batch), request.InstanceId)
 				}
@@ -73,43 +87,34 @@ func process_queue(clickhouse *driver.Conn, msgs <-chan amqp.Delivery) {
 
 type ClickhouseInstance = map[string]interface{}
 
-func process(msgs []amqp.Delivery, c *driver.Conn) {
-	var success bool
-	defer func() {
-		if !success {
-			log.Printf("failed to send %d instances to Clickhouse, rejecting all", len(msgs))
-		} else {
-			log.Printf("Sent %d instances to Clickhouse", len(msgs))
-		}
-		for _, msg := range msgs {
-			if success {
-				if err := msg.Ack(false); err != nil {
-					log.Printf("Failed to acknowledge messages: %v", err)
-				}
-			} else {
-				if err := msg.Reject(true); err != nil {
-					log.Printf("Failed to acknowledge messages: %v", err)
-				}
-			}
-		}
-
-	}()
+func process(msgs []delivery, c *driver.Conn) {
 	var instances []ClickhouseInstance
-	for _, msg := range msgs {
-		var request pgcr_types.ProcessedActivity
-		if err := json.Unmarshal(msg.Body, &request); err != nil {
-			log.Println("Failed to unmarshal activity:", err)
-			return
+	var parsed []delivery
+	for _, d := range msgs {
+		request, _, err := messages.Decode[pgcr_types.ProcessedActivity](d.msg.Body, messageType)
+		if err != nil {
+			log.Println("Failed to decode activity:", err)
+			d.qw.Settle(d.msg, async.DeadLetter)
+			continue
 		}
-		instances = append(instances, *parse(request))
+		instances = append(instances, *parse(*request))
+		parsed = append(parsed, d)
+	}
+	if len(parsed) == 0 {
+		return
 	}
 
-	err := insertProcessedInstances(*c, instances)
-	if err != nil {
-		log.Fatalf("Failed to insert instances: %s", err)
+	result := async.Ack
+	if err := insertProcessedInstances(*c, instances); err != nil {
+		log.Printf("Failed to send %d instances to Clickhouse, retrying all: %s", len(parsed), err)
+		result = async.Retry
+	} else {
+		log.Printf("Sent %d instances to Clickhouse", len(parsed))
 	}
 
-	success = true
+	for _, d := range parsed {
+		d.qw.Settle(d.msg, result)
+	}
 }
 
 func parse(request pgcr_types.ProcessedActivity) *ClickhouseInstance {
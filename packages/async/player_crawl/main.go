@@ -2,42 +2,44 @@ package player_crawl
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
 	"raidhub/packages/async"
-
-	amqp "github.com/rabbitmq/amqp091-go"
+	"raidhub/packages/bungie/health"
+	"raidhub/packages/messages"
 )
 
 type PlayerRequest struct {
 	MembershipId int64 `json:"membershipId,string"`
 }
 
-const queueName = "player_requests"
+const (
+	queueName      = "player_requests"
+	messageType    = "player_request"
+	messageVersion = 1
+)
+
+func init() {
+	messages.Register(messageType, 0, messages.JSON[PlayerRequest]())
+	messages.Register(messageType, 1, messages.JSON[PlayerRequest]())
+}
 
 func Create() async.QueueWorker {
 	return async.QueueWorker{
 		QueueName: queueName,
 		Processer: process_player_request,
+		Systems:   []string{health.Destiny2},
 	}
 }
 
-func SendMessage(ch *amqp.Channel, membershipId int64) error {
-	body, err := json.Marshal(PlayerRequest{
+func SendMessage(ctx context.Context, membershipId int64) error {
+	return async.Publish(ctx, queueName, true, messageType, messageVersion, PlayerRequest{
 		MembershipId: membershipId,
 	})
-	if err != nil {
-		return err
-	}
+}
 
-	return ch.PublishWithContext(
-		context.Background(),
-		"",        // exchange
-		queueName, // routing key (queue name)
-		true,      // mandatory
-		false,     // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
-	)
+// Records a crawl request to be published once tx commits
+func WriteOutbox(ctx context.Context, tx *sql.Tx, membershipId int64) error {
+	return async.WriteOutbox(ctx, tx, queueName, messageType, messageVersion, PlayerRequest{
+		MembershipId: membershipId,
+	})
 }
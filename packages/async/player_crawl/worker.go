@@ -1,11 +1,13 @@
 package player_crawl
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"fmt"
 	"log"
 	"raidhub/packages/async"
 	"raidhub/packages/bungie"
+	"raidhub/packages/messages"
 	"raidhub/packages/pgcr_types"
 	"raidhub/packages/postgres"
 	"sync"
@@ -14,31 +16,30 @@ import (
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func process_player_request(qw *async.QueueWorker, msg amqp.Delivery) {
-	qw.Wg.Wait()
-	defer func() {
-		if err := msg.Ack(false); err != nil {
-			log.Printf("Failed to acknowledge message: %v", err)
-		}
-	}()
-
-	var request PlayerRequest
-	if err := json.Unmarshal(msg.Body, &request); err != nil {
-		log.Printf("Failed to unmarshal message: %s", err)
-		return
+func process_player_request(ctx context.Context, qw *async.QueueWorker, msg amqp.Delivery) async.Result {
+	request, _, err := messages.Decode[PlayerRequest](msg.Body, messageType)
+	if err != nil {
+		log.Printf("Failed to decode message: %s", err)
+		return async.DeadLetter
 	}
 
 	membershipType, lastCrawled, err := get_player(request.MembershipId, qw.Db)
 	if err != nil {
 		log.Printf("Failed to get player: %s", err)
-		return
+		return async.Retry
 	} else if membershipType == -1 || membershipType == 0 {
 		log.Printf("Crawling missing player %d", request.MembershipId)
-		crawl_player_profiles(request.MembershipId, qw.Db)
+		err = crawl_player_profiles(ctx, request.MembershipId, qw.Db)
 	} else if lastCrawled == nil || time.Since(*lastCrawled) > 24*time.Hour {
 		log.Printf("Crawling potentially stale player %d/%d", membershipType, request.MembershipId)
-		crawl_membership(membershipType, request.MembershipId, qw.Db)
+		err = crawl_membership(ctx, membershipType, request.MembershipId, qw.Db)
 	}
+
+	if err != nil {
+		log.Printf("Failed to crawl player %d: %s", request.MembershipId, err)
+		return async.RetryIfTransient(err)
+	}
+	return async.Ack
 }
 
 func get_player(membershipId int64, db *sql.DB) (int, *time.Time, error) {
@@ -58,42 +59,49 @@ func get_player(membershipId int64, db *sql.DB) (int, *time.Time, error) {
 	}
 }
 
-func crawl_player_profiles(destinyMembershipId int64, db *sql.DB) {
-	profiles, err := bungie.GetLinkedProfiles(-1, destinyMembershipId, true)
+// Crawls every membership linked to the player, returning the first error
+func crawl_player_profiles(ctx context.Context, destinyMembershipId int64, db *sql.DB) error {
+	profiles, err := bungie.Default().GetLinkedProfiles(ctx, -1, destinyMembershipId, true)
 	if err != nil {
-		log.Printf("Failed to get linked profiles: %s", err)
+		return fmt.Errorf("failed to get linked profiles: %w", err)
 	} else if len(profiles) == 0 {
 		log.Println("No profiles found")
-		return
+		return nil
 	}
 
 	var wg sync.WaitGroup
-	for _, profile := range profiles {
+	errs := make([]error, len(profiles))
+	for i, profile := range profiles {
 		wg.Add(1)
-		go func(membershipId int64, membershipType int) {
+		go func(i int, membershipId int64, membershipType int) {
 			defer wg.Done()
-			crawl_membership(membershipType, membershipId, db)
-		}(profile.MembershipId, profile.MembershipType)
+			errs[i] = crawl_membership(ctx, membershipType, membershipId, db)
+		}(i, profile.MembershipId, profile.MembershipType)
 	}
 
 	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func crawl_membership(membershipType int, membershipId int64, db *sql.DB) {
-	profile, err := bungie.GetProfile(membershipType, membershipId)
+func crawl_membership(ctx context.Context, membershipType int, membershipId int64, db *sql.DB) error {
+	profile, err := bungie.Default().GetProfile(ctx, membershipType, membershipId)
 	if err != nil {
-		log.Printf("Failed to get profile %d/%d: %s", membershipType, membershipId, err)
-		return
+		return fmt.Errorf("failed to get profile %d/%d: %w", membershipType, membershipId, err)
 	}
 
 	if profile.Profile.Data == nil {
 		log.Printf("Profile component is nil")
-		return
+		return nil
 	}
 
 	if profile.Characters.Data == nil {
 		log.Printf("Characters component is nil")
-		return
+		return nil
 	}
 
 	var characterId int64
@@ -102,16 +110,16 @@ func crawl_membership(membershipType int, membershipId int64, db *sql.DB) {
 		break
 	}
 
-	_, activityHistoryErrorCode, activityHistoryErr := bungie.GetActivityHistoryPage(membershipType, membershipId, characterId, 0)
-	if activityHistoryErr != nil && activityHistoryErrorCode != 1665 {
-		log.Printf("Activity history error: %s", activityHistoryErr)
-		return
+	_, activityHistoryErr := bungie.Default().GetActivityHistoryPage(ctx, membershipType, membershipId, characterId, 0)
+	// DestinyPrivacyRestriction
+	isPrivate := bungie.ErrorCode(activityHistoryErr) == 1665
+	if activityHistoryErr != nil && !isPrivate {
+		return fmt.Errorf("activity history error: %w", activityHistoryErr)
 	}
 
 	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Failed to initiate transaction: %s", err)
-		return
+		return fmt.Errorf("failed to initiate transaction: %w", err)
 	}
 	defer tx.Rollback()
 
@@ -146,18 +154,16 @@ func crawl_membership(membershipType int, membershipId int64, db *sql.DB) {
 		LastSeen:                    mostRecentDate,
 	})
 	if err != nil {
-		log.Printf("Failed to upsert full player: %s", err)
-		return
+		return fmt.Errorf("failed to upsert full player: %w", err)
 	}
 
-	_, err = tx.Exec(`UPDATE player SET last_crawled = NOW(), is_private = $1 WHERE membership_id = $2`, activityHistoryErrorCode == 1665, membershipId)
+	_, err = tx.Exec(`UPDATE player SET last_crawled = NOW(), is_private = $1 WHERE membership_id = $2`, isPrivate, membershipId)
 	if err != nil {
-		log.Printf("Failed to update last crawled: %s", err)
-		return
+		return fmt.Errorf("failed to update last crawled: %w", err)
 	}
 	if err = tx.Commit(); err != nil {
-		log.Printf("Failed to commit transaction: %s", err)
-	} else {
-		log.Printf("Upserted membership_id %d", membershipId)
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
+	log.Printf("Upserted membership_id %d", membershipId)
+	return nil
 }
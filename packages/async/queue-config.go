@@ -0,0 +1,49 @@
+package async
+
+import (
+	"time"
+
+	"raidhub/packages/config"
+)
+
+// How a queue is consumed
+type QueueConfig struct {
+	// Number of consumers, each with its own channel
+	Consumers int
+	// The most consumers the queue may be scaled to, 0 for no limit
+	MaxConsumers int
+	// Maximum number of unacknowledged messages per consumer
+	Prefetch int
+	// How long a processor may spend on one message before its context is cancelled
+	Timeout time.Duration
+}
+
+// Overrides defaults with <QUEUE>_CONSUMERS, <QUEUE>_PREFETCH and <QUEUE>_TIMEOUT from the environment,
+// e.g. PLAYER_REQUESTS_CONSUMERS=10
+func QueueConfigFromEnv(queueName string, defaults QueueConfig) QueueConfig {
+	q := config.Queue{
+		Consumers: defaults.Consumers,
+		Prefetch:  defaults.Prefetch,
+		Timeout:   defaults.Timeout,
+	}
+	config.LoadQueue(queueName, &q)
+
+	cfg := defaults
+	cfg.Consumers = q.Consumers
+	cfg.Prefetch = q.Prefetch
+	cfg.Timeout = q.Timeout
+	return cfg.withDefaults()
+}
+
+func (cfg QueueConfig) withDefaults() QueueConfig {
+	if cfg.Consumers < 0 {
+		cfg.Consumers = 0
+	}
+	if cfg.Prefetch <= 0 {
+		cfg.Prefetch = 1
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Minute
+	}
+	return cfg
+}
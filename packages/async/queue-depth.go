@@ -0,0 +1,44 @@
+package async
+
+import (
+	"context"
+	"log"
+	"raidhub/packages/monitoring"
+	"time"
+)
+
+const depthInterval = 15 * time.Second
+
+// Reports how many messages are waiting in the queue and its retry and dead letter queues until ctx is cancelled
+func (qw *QueueWorker) monitorDepth(ctx context.Context) {
+	queues := []string{qw.QueueName, RetryQueue(qw.QueueName), DeadLetterQueue(qw.QueueName)}
+	for {
+		if err := qw.readDepth(queues); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to read the depth of queue %s: %s", qw.QueueName, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(depthInterval):
+		}
+	}
+}
+
+func (qw *QueueWorker) readDepth(queues []string) error {
+	ch, err := qw.Conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, name := range queues {
+		// A passive declare fails instead of creating the queue, and reports its message count
+		q, err := ch.QueueDeclarePassive(name, true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+		monitoring.QueueDepth.WithLabelValues(name).Set(float64(q.Messages))
+	}
+	return nil
+}
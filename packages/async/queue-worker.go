@@ -1,29 +1,201 @@
 package async
 
 import (
+	"context"
 	"database/sql"
 	"log"
-	"raidhub/packages/util"
+	"raidhub/packages/bungie"
+	"raidhub/packages/bungie/health"
+	"raidhub/packages/messages"
+	"raidhub/packages/monitoring"
+	"raidhub/packages/rabbit"
+	"strconv"
+	"sync"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// What to do with a message once it has been processed
+type Result int
+
+const (
+	// Done with the message, successfully or not
+	Ack Result = iota
+	// Try the message again after RetryDelay, dead-lettering it after MaxRetries attempts
+	Retry
+	// The message can never succeed, move it to the dead letter queue
+	DeadLetter
+	// The processor has taken the message and will settle it itself
+	Deferred
+)
+
+const (
+	// The number of times a message has been retried
+	retriesHeader = "x-retries"
+	// The queue a dead letter came from
+	deadQueueHeader = "x-dead-queue"
+)
+
 type QueueWorker struct {
 	QueueName string
-	Conn      *amqp.Connection
+	Conn      *rabbit.Client
 	Db        *sql.DB
-	Processer func(qw *QueueWorker, msg amqp.Delivery)
-	Wg        *util.ReadOnlyWaitGroup
+	// Called with a context which expires after Config.Timeout
+	Processer func(ctx context.Context, qw *QueueWorker, msg amqp.Delivery) Result
+	// Bungie API systems the processor needs, messages are held while any of them is disabled
+	Systems    []string
+	Config     QueueConfig
+	MaxRetries int
+	RetryDelay time.Duration
+	// Settles the messages a processor has deferred, called when a consumer stops
+	Flush func()
+
+	consumers *consumerSet
+}
+
+// The running consumers of a queue, which can be scaled while messages keep flowing
+type consumerSet struct {
+	mu    sync.Mutex
+	ctx   context.Context
+	wg    sync.WaitGroup
+	stops []context.CancelFunc
+}
+
+// Retries failed Bungie requests which may succeed later and acks the rest
+func RetryIfTransient(err error) Result {
+	if bungie.IsTransient(err) {
+		return Retry
+	}
+	return Ack
+}
+
+// Retried messages wait in this queue until their expiration moves them back to the work queue
+func RetryQueue(queueName string) string {
+	return queueName + ".retry"
+}
+
+// Messages which failed for good are kept in this queue for inspection
+func DeadLetterQueue(queueName string) string {
+	return queueName + ".dead"
+}
+
+// Consumes the queue, blocking until ctx is cancelled and the in-flight messages are settled
+func (qw *QueueWorker) Register(ctx context.Context) {
+	qw.Start(ctx)
+	qw.Wait()
+}
+
+// Declares the retry and dead letter queues and starts Config.Consumers consumers, which run until ctx is cancelled.
+// The consumers are registered again after the connection is lost.
+func (qw *QueueWorker) Start(ctx context.Context) {
+	qw.Config = qw.Config.withDefaults()
+	if qw.MaxRetries == 0 {
+		qw.MaxRetries = 5
+	}
+	if qw.RetryDelay == 0 {
+		qw.RetryDelay = time.Minute
+	}
+
+	if err := qw.declare(); err != nil {
+		log.Fatalf("Failed to declare the retry and dead letter queues for %s: %s", qw.QueueName, err)
+	}
+
+	qw.consumers = &consumerSet{ctx: ctx}
+	qw.SetConsumers(qw.Config.Consumers)
+	go qw.monitorDepth(ctx)
+	log.Printf("Waiting for messages on queue %s...", qw.QueueName)
+}
+
+// Blocks until the context passed to Start is cancelled and every consumer has settled its in-flight messages
+func (qw *QueueWorker) Wait() {
+	<-qw.consumers.ctx.Done()
+	qw.consumers.wg.Wait()
+	log.Printf("Stopped consuming queue %s", qw.QueueName)
+}
+
+// Starts or stops consumers until there are n, or Config.MaxConsumers if n is more, once the queue is started.
+// A stopped consumer finishes its current message first.
+func (qw *QueueWorker) SetConsumers(n int) {
+	set := qw.consumers
+	if set == nil {
+		return
+	}
+	if max := qw.Config.MaxConsumers; max > 0 && n > max {
+		log.Printf("Queue %s allows at most %d consumers, not %d", qw.QueueName, max, n)
+		n = max
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	for len(set.stops) < n && set.ctx.Err() == nil {
+		ctx, stop := context.WithCancel(set.ctx)
+		set.stops = append(set.stops, stop)
+		set.wg.Add(1)
+		go func() {
+			defer set.wg.Done()
+			err := qw.Conn.Consume(ctx, qw.QueueName, qw.Config.Prefetch, qw.handle, qw.Flush)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Consumer on queue %s stopped: %s", qw.QueueName, err)
+			}
+		}()
+	}
+
+	for len(set.stops) > n {
+		last := len(set.stops) - 1
+		set.stops[last]()
+		set.stops = set.stops[:last]
+	}
+	monitoring.QueueConsumers.WithLabelValues(qw.QueueName).Set(float64(len(set.stops)))
+}
+
+// The number of consumers the queue is scaled to
+func (qw *QueueWorker) Consumers() int {
+	set := qw.consumers
+	if set == nil {
+		return 0
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return len(set.stops)
+}
+
+func (qw *QueueWorker) handle(msg amqp.Delivery) {
+	for _, system := range qw.Systems {
+		if err := health.Default().Wait(qw.consumers.ctx, system); err != nil {
+			// Shutting down while the system is disabled
+			if err := msg.Nack(false, true); err != nil {
+				log.Printf("Failed to requeue message: %v", err)
+			}
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), qw.Config.Timeout)
+	defer cancel()
+	// Messages published while processing carry on the trace of this one
+	if correlationId := messages.DeliveryCorrelationId(msg); correlationId != "" {
+		ctx = messages.WithCorrelationId(ctx, correlationId)
+	}
+
+	inFlight := monitoring.QueueInFlight.WithLabelValues(qw.QueueName)
+	inFlight.Inc()
+	start := time.Now()
+	result := qw.Processer(ctx, qw, msg)
+	monitoring.QueueProcessingDuration.WithLabelValues(qw.QueueName).Observe(time.Since(start).Seconds())
+	inFlight.Dec()
+
+	qw.Settle(msg, result)
 }
 
-func (qw *QueueWorker) Register(numWorkers int) {
+func (qw *QueueWorker) declare() error {
 	ch, err := qw.Conn.Channel()
 	if err != nil {
-		log.Fatalf("Failed to create channel: %s", err)
+		return err
 	}
 	defer ch.Close()
 
-	q, err := ch.QueueDeclare(
+	_, err = ch.QueueDeclare(
 		qw.QueueName,
 		true,
 		false,
@@ -32,30 +204,122 @@ func (qw *QueueWorker) Register(numWorkers int) {
 		nil,
 	)
 	if err != nil {
-		log.Fatalf("Failed to create queue: %s", err)
-	}
-
-	for i := 0; i < numWorkers; i++ {
-		msgs, err := ch.Consume(
-			q.Name,
-			"",
-			false,
-			false,
-			false,
-			false,
-			nil,
-		)
-		if err != nil {
-			log.Fatalf("Failed to register a consumer: %s", err)
+		return err
+	}
+
+	_, err = ch.QueueDeclare(
+		RetryQueue(qw.QueueName),
+		true,
+		false,
+		false,
+		false,
+		amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": qw.QueueName,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = ch.QueueDeclare(
+		DeadLetterQueue(qw.QueueName),
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	return err
+}
+
+// Acks, retries or dead-letters msg. The message is requeued as-is if it cannot be moved to another queue.
+func (qw *QueueWorker) Settle(msg amqp.Delivery, result Result) {
+	var err error
+	outcome := "ack"
+	switch result {
+	case Deferred:
+		return
+	case Retry:
+		retries := Retries(msg)
+		if retries >= qw.MaxRetries {
+			log.Printf("Dead-lettering message %s on %s after %d retries", messages.DeliveryCorrelationId(msg), qw.QueueName, retries)
+			outcome = "dead_letter"
+			err = qw.deadLetter(msg)
+		} else {
+			outcome = "retry"
+			err = qw.retry(msg, retries+1)
 		}
-		go func() {
-			for msg := range msgs {
-				qw.Processer(qw, msg)
-			}
-		}()
+	case DeadLetter:
+		log.Printf("Dead-lettering message %s on %s", messages.DeliveryCorrelationId(msg), qw.QueueName)
+		outcome = "dead_letter"
+		err = qw.deadLetter(msg)
 	}
 
-	log.Printf("Waiting for messages on queue %s...", qw.QueueName)
-	forever := make(chan bool)
-	<-forever
+	if err != nil {
+		log.Printf("Failed to move message %s on %s, requeueing it: %s", messages.DeliveryCorrelationId(msg), qw.QueueName, err)
+		monitoring.QueueMessages.WithLabelValues(qw.QueueName, "requeued").Inc()
+		if err := msg.Nack(false, true); err != nil {
+			log.Printf("Failed to requeue message: %v", err)
+		}
+		return
+	}
+	monitoring.QueueMessages.WithLabelValues(qw.QueueName, outcome).Inc()
+
+	if err := msg.Ack(false); err != nil {
+		log.Printf("Failed to acknowledge message: %v", err)
+	}
+}
+
+func (qw *QueueWorker) retry(msg amqp.Delivery, retries int) error {
+	publishing := republish(msg)
+	publishing.Headers[retriesHeader] = int32(retries)
+	publishing.Expiration = strconv.FormatInt(qw.RetryDelay.Milliseconds(), 10)
+	return rabbit.Publish(context.Background(), RetryQueue(qw.QueueName), true, publishing)
+}
+
+func (qw *QueueWorker) deadLetter(msg amqp.Delivery) error {
+	publishing := republish(msg)
+	publishing.Headers[deadQueueHeader] = qw.QueueName
+	return rabbit.Publish(context.Background(), DeadLetterQueue(qw.QueueName), true, publishing)
+}
+
+// Publishes a dead letter back onto its work queue with a clean retry count
+func Requeue(ctx context.Context, queueName string, msg amqp.Delivery) error {
+	publishing := republish(msg)
+	delete(publishing.Headers, retriesHeader)
+	delete(publishing.Headers, deadQueueHeader)
+	delete(publishing.Headers, "x-death")
+	return rabbit.Publish(ctx, queueName, true, publishing)
+}
+
+// The number of times msg has been retried so far
+func Retries(msg amqp.Delivery) int {
+	switch n := msg.Headers[retriesHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+// Copies a delivery into a new persistent message
+func republish(msg amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:       headers,
+		ContentType:   msg.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: msg.CorrelationId,
+		MessageId:     msg.MessageId,
+		Timestamp:     msg.Timestamp,
+		Type:          msg.Type,
+		Body:          msg.Body,
+	}
 }
@@ -0,0 +1,247 @@
+package bungie
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"raidhub/packages/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	defaultClient *Client
+	once          sync.Once
+)
+
+// Error codes which are safe to retry
+var transientErrorCodes = map[int]bool{
+	35:   true, // ThrottleLimitExceeded
+	36:   true, // ThrottleLimitExceededMinutes
+	37:   true, // ThrottleLimitExceededMomentarily
+	38:   true, // ThrottleLimitExceededSeconds
+	51:   true, // PerEndpointRequestThrottleExceeded
+	1618: true, // DestinyUnexpectedError
+}
+
+// A Client makes requests to the Bungie API. Each endpoint can be given its own rate limiter,
+// and transient failures are retried with exponential backoff.
+type Client struct {
+	HTTPClient *http.Client
+	BaseURL    string
+	StatsURL   string
+	APIKey     string
+	// Sent as X-Zeus-Token if set, so Zeus can prioritize and account for the caller
+	ZeusToken  string
+	MaxRetries int
+	RetryDelay time.Duration
+
+	mu       sync.RWMutex
+	limiters map[string]*rate.Limiter
+}
+
+func NewClient(apiKey string) *Client {
+	return &Client{
+		HTTPClient: &http.Client{},
+		BaseURL:    "https://www.bungie.net",
+		StatsURL:   "https://stats.bungie.net",
+		APIKey:     apiKey,
+		MaxRetries: 2,
+		RetryDelay: 500 * time.Millisecond,
+		limiters:   make(map[string]*rate.Limiter),
+	}
+}
+
+// Returns a shared client configured from config.Bungie, exiting if BUNGIE_API_KEY is not set
+func Default() *Client {
+	once.Do(func() {
+		cfg := config.Load().Bungie
+		if err := cfg.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		defaultClient = NewClient(cfg.APIKey)
+		defaultClient.BaseURL = cfg.URLBase
+		defaultClient.StatsURL = cfg.PGCRURLBase
+		defaultClient.ZeusToken = cfg.ZeusToken
+		if err := defaultClient.setRateLimits(cfg.RateLimits); err != nil {
+			log.Fatalf("Invalid BUNGIE_RATE_LIMITS: %s", err)
+		}
+	})
+	return defaultClient
+}
+
+// Limits the requests made to an endpoint, such as "GetProfile"
+func (c *Client) SetRateLimit(endpoint string, limit rate.Limit, burst int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limiters == nil {
+		c.limiters = make(map[string]*rate.Limiter)
+	}
+	c.limiters[endpoint] = rate.NewLimiter(limit, burst)
+}
+
+// Applies limits such as "GetPGCR=40:90", the burst defaults to one second of requests
+func (c *Client) setRateLimits(limits []string) error {
+	for _, limit := range limits {
+		endpoint, value, ok := strings.Cut(limit, "=")
+		if !ok || endpoint == "" {
+			return fmt.Errorf("%q is not Endpoint=rate[:burst]", limit)
+		}
+		perSecond, burstStr, hasBurst := strings.Cut(value, ":")
+		r, err := strconv.ParseFloat(perSecond, 64)
+		if err != nil || r <= 0 {
+			return fmt.Errorf("%s has an invalid rate %q", endpoint, perSecond)
+		}
+		burst := max(1, int(math.Ceil(r)))
+		if hasBurst {
+			if burst, err = strconv.Atoi(burstStr); err != nil || burst < 1 {
+				return fmt.Errorf("%s has an invalid burst %q", endpoint, burstStr)
+			}
+		}
+		c.SetRateLimit(endpoint, rate.Limit(r), burst)
+	}
+	return nil
+}
+
+func (c *Client) limiter(endpoint string) *rate.Limiter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.limiters[endpoint]
+}
+
+// An APIError is a non-success response from the Bungie API. ErrorCode and ErrorStatus are
+// empty if the response body could not be decoded.
+type APIError struct {
+	StatusCode      int
+	ErrorCode       int
+	ErrorStatus     string
+	Message         string
+	ThrottleSeconds int
+}
+
+func (e *APIError) Error() string {
+	if e.ErrorStatus == "" {
+		return fmt.Sprintf("error response: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("error response: %s (%d)", e.Message, e.ErrorCode)
+}
+
+func (e *APIError) transient() bool {
+	if e.ErrorStatus == "" {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	return transientErrorCodes[e.ErrorCode]
+}
+
+// Returns the Bungie error code of err, or 0 if err is not an *APIError
+func ErrorCode(err error) int {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode
+	}
+	return 0
+}
+
+// Reports whether the request which failed with err is worth trying again later.
+// Errors which are not from the API, such as network failures, count as transient unless the response was malformed.
+func IsTransient(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.transient()
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return err != nil && !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr)
+}
+
+// Performs a GET request against url and decodes the response envelope into out
+func (c *Client) get(ctx context.Context, endpoint string, url string, out any) error {
+	var err error
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.RetryDelay*time.Duration(1<<(attempt-1))); err != nil {
+				return err
+			}
+		}
+
+		err = c.do(ctx, endpoint, url, out)
+		if err == nil {
+			return nil
+		}
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ThrottleSeconds > 0 {
+				if err := sleep(ctx, time.Duration(apiErr.ThrottleSeconds)*time.Second); err != nil {
+					return err
+				}
+			}
+			if !apiErr.transient() {
+				return err
+			}
+		} else if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) do(ctx context.Context, endpoint string, url string, out any) error {
+	if limiter := c.limiter(endpoint); limiter != nil {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", c.APIKey)
+	if c.ZeusToken != "" {
+		req.Header.Set("X-Zeus-Token", c.ZeusToken)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		var data BungieError
+		if err := decoder.Decode(&data); err != nil {
+			return &APIError{StatusCode: resp.StatusCode}
+		}
+		return &APIError{
+			StatusCode:      resp.StatusCode,
+			ErrorCode:       data.ErrorCode,
+			ErrorStatus:     data.ErrorStatus,
+			Message:         data.Message,
+			ThrottleSeconds: data.ThrottleSeconds,
+		}
+	}
+
+	return decoder.Decode(out)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
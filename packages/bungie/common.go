@@ -1,16 +1,9 @@
 package bungie
 
 import (
-	"os"
-	"sync"
 	"time"
 )
 
-var (
-	bungieUrlBase string
-	once          sync.Once
-)
-
 type BungieError struct {
 	ErrorCode       int    `json:"ErrorCode"`
 	Message         string `json:"Message"`
@@ -42,13 +35,3 @@ type DestinyCharacterComponent struct {
 	ClassHash      uint32    `json:"classHash"`
 	DateLastPlayed time.Time `json:"dateLastPlayed,string"`
 }
-
-func getBungieURL() string {
-	once.Do(func() {
-		bungieUrlBase = os.Getenv("BUNGIE_URL_BASE")
-		if bungieUrlBase == "" {
-			bungieUrlBase = "https://www.bungie.net/"
-		}
-	})
-	return bungieUrlBase
-}
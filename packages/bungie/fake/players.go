@@ -0,0 +1,174 @@
+package fake
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"raidhub/packages/bungie"
+)
+
+const (
+	activityHistoryPageSize = 250
+	groupMembersPageSize    = 100
+	// Generated clans have ids from groupIdBase up to groupIdBase + groupCount
+	groupIdBase = 1_000_000
+	groupCount  = 10_000
+)
+
+func (sc Scenario) userInfo(membershipType int, membershipId int64) bungie.DestinyUserInfo {
+	displayName := fmt.Sprintf("Guardian%d", membershipId%10_000)
+	nameCode := int(membershipId % 10_000)
+	return bungie.DestinyUserInfo{
+		MembershipType:              membershipType,
+		MembershipId:                membershipId,
+		DisplayName:                 &displayName,
+		BungieGlobalDisplayName:     &displayName,
+		BungieGlobalDisplayNameCode: &nameCode,
+	}
+}
+
+// The same character ids are generated for a player by every endpoint
+func (sc Scenario) characters(membershipId int64) []bungie.DestinyCharacterComponent {
+	n := sc.CharactersPerPlayer
+	if n == 0 {
+		n = 3
+	}
+	rng := rand.New(rand.NewSource(membershipId))
+	characters := make([]bungie.DestinyCharacterComponent, n)
+	for i := range characters {
+		characters[i] = bungie.DestinyCharacterComponent{
+			CharacterId:    2305843009200000000 + rng.Int63n(100_000_000),
+			EmblemPath:     "/common/destiny2_content/icons/fake.jpg",
+			EmblemHash:     uint32(rng.Int31()),
+			ClassHash:      classHashes[i%len(classHashes)],
+			DateLastPlayed: time.Now().UTC().Add(-time.Duration(rng.Intn(30*24)) * time.Hour).Truncate(time.Second),
+		}
+	}
+	return characters
+}
+
+func (sc Scenario) profile(membershipType int, membershipId int64) *bungie.DestinyProfileResponse {
+	characters := make(map[int64]bungie.DestinyCharacterComponent)
+	for _, c := range sc.characters(membershipId) {
+		characters[c.CharacterId] = c
+	}
+	return &bungie.DestinyProfileResponse{
+		Profile: bungie.SingleComponentResponseOfDestinyProfileComponent{
+			Data: &bungie.DestinyProfileComponent{
+				UserInfo: sc.userInfo(membershipType, membershipId),
+			},
+		},
+		Characters: bungie.DictionaryComponentResponseOfint64AndDestinyCharacterComponent{
+			Data: &characters,
+		},
+	}
+}
+
+// Returns nil if the player has no such character
+func (sc Scenario) character(membershipId int64, characterId int64) *bungie.DestinyCharacterResponse {
+	for _, c := range sc.characters(membershipId) {
+		if c.CharacterId == characterId {
+			return &bungie.DestinyCharacterResponse{
+				Character: &bungie.SingleComponentResponseOfDestinyCharacterComponent{Data: &c},
+			}
+		}
+	}
+	return nil
+}
+
+func (sc Scenario) linkedProfiles(membershipType int, membershipId int64) *bungie.LinkedProfiles {
+	return &bungie.LinkedProfiles{
+		Profiles: []bungie.DestinyUserInfo{sc.userInfo(membershipType, membershipId)},
+	}
+}
+
+func (sc Scenario) historicalStats(membershipId int64) *bungie.DestinyHistoricalStatsAccountResult {
+	result := &bungie.DestinyHistoricalStatsAccountResult{}
+	for _, c := range sc.characters(membershipId) {
+		result.Characters = append(result.Characters, bungie.DestinyHistoricalStatsPerCharacter{CharacterId: c.CharacterId})
+	}
+	return result
+}
+
+// A page of the character's raids, newest first. The instance ids are available PGCRs.
+func (sc Scenario) activityHistory(membershipType int, characterId int64, page int, latestInstanceId int64) *bungie.DestinyActivityHistoryResults {
+	results := &bungie.DestinyActivityHistoryResults{
+		Activities: []bungie.DestinyHistoricalStatsPeriodGroup{},
+	}
+	rng := rand.New(rand.NewSource(characterId))
+	instanceId := latestInstanceId
+	for i := 0; i < sc.ActivitiesPerCharacter && instanceId > 1; i++ {
+		instanceId -= 1 + rng.Int63n(min(1_000_000, instanceId-1))
+		if i/activityHistoryPageSize != page {
+			continue
+		}
+		results.Activities = append(results.Activities, bungie.DestinyHistoricalStatsPeriodGroup{
+			ActivityDetails: bungie.DestinyHistoricalStatsActivity{
+				InstanceId:           instanceId,
+				Mode:                 4,
+				Modes:                []int{4, 7},
+				MembershipType:       membershipType,
+				DirectorActivityHash: raidHash,
+			},
+		})
+	}
+	return results
+}
+
+func (sc Scenario) group(groupId int64) bungie.GroupV2 {
+	n := sc.MembersPerGroup
+	if n == 0 {
+		n = groupMembersPageSize
+	}
+	return bungie.GroupV2{
+		GroupId:     groupId,
+		Name:        fmt.Sprintf("Clan %d", groupId),
+		Motto:       "Eyes up",
+		MemberCount: n,
+		GroupType:   1,
+		ClanInfo: bungie.GroupV2ClanInfoAndInvestment{
+			ClanCallsign: fmt.Sprintf("C%d", groupId%10_000),
+		},
+	}
+}
+
+// Members are generated from the group id, 1-based pages as Bungie's currentpage is
+func (sc Scenario) groupMembers(groupId int64, page int) *bungie.SearchResultOfGroupMember {
+	n := sc.group(groupId).MemberCount
+	rng := rand.New(rand.NewSource(groupId))
+	results := &bungie.SearchResultOfGroupMember{
+		Results: []bungie.GroupMember{},
+		HasMore: page*groupMembersPageSize < n,
+	}
+	for i := 0; i < n; i++ {
+		membershipId := 4611686018400000000 + rng.Int63n(100_000_000)
+		if i/groupMembersPageSize != page-1 {
+			continue
+		}
+		results.Results = append(results.Results, bungie.GroupMember{
+			DestinyUserInfo: sc.userInfo(3, membershipId),
+		})
+	}
+	return results
+}
+
+// Every player who isn't clanless is in one generated clan
+func (sc Scenario) groupsForMember(membershipType int, membershipId int64) *bungie.GetGroupsForMemberResponse {
+	response := &bungie.GetGroupsForMemberResponse{
+		AreAllMembershipsInactive: map[int64]bool{},
+		Results:                   []bungie.GroupMembership{},
+	}
+	if sc.Clanless[membershipId] {
+		return response
+	}
+	groupId := groupIdBase + membershipId%groupCount
+	if sc.MissingGroups[groupId] {
+		return response
+	}
+	response.Results = append(response.Results, bungie.GroupMembership{
+		Member: bungie.GroupMember{DestinyUserInfo: sc.userInfo(membershipType, membershipId)},
+		Group:  sc.group(groupId),
+	})
+	return response
+}
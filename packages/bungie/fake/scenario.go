@@ -0,0 +1,153 @@
+package fake
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"raidhub/packages/bungie"
+	"raidhub/packages/bungie/health"
+)
+
+const (
+	activityDuration = 30 * time.Minute
+	playerCount      = 6
+	raidHash         = 1441982566 // Vow of the Disciple
+	strikeHash       = 2724706103
+)
+
+var classHashes = []uint32{3655393761, 671679327, 2271682572}
+
+// A Scenario describes how the server behaves when no response or fixture matches a request
+type Scenario struct {
+	// Instance ids above the latest id return PGCRNotFound. Zero makes every id available.
+	LatestInstanceId int64
+	// The latest instance id advances by this many ids every second
+	IdsPerSecond float64
+	// Fraction of generated PGCRs which are raids
+	RaidFraction float64
+	// Every endpoint except Settings returns SystemDisabled
+	SystemDisabled bool
+	// ThrottleSeconds sent with every error response
+	ThrottleSeconds int
+	// Every Nth request is rejected with a 403 rate limit page
+	RateLimitEvery int64
+	// Instance ids which return InsufficientPrivileges
+	Redacted map[int64]bool
+	// Membership ids whose activity history is private
+	Private map[int64]bool
+
+	// Membership ids which return DestinyAccountNotFound, every other player is generated
+	MissingPlayers map[int64]bool
+	// Characters of each generated player, 3 if zero
+	CharactersPerPlayer int
+	// Raids in the activity history of each generated character
+	ActivitiesPerCharacter int
+	// Group ids which return GroupNotFound, every other clan is generated
+	MissingGroups map[int64]bool
+	// Members of each generated clan, 100 if zero
+	MembersPerGroup int
+	// Membership ids which are not in a clan
+	Clanless map[int64]bool
+}
+
+// Generates a deterministic PGCR for an instance id. Whether it is a raid is decided by RaidFraction.
+func (sc Scenario) GeneratePGCR(instanceId int64, period time.Time) *bungie.DestinyPostGameCarnageReport {
+	rng := rand.New(rand.NewSource(instanceId))
+
+	report := &bungie.DestinyPostGameCarnageReport{
+		ActivityDetails: bungie.DestinyHistoricalStatsActivity{
+			InstanceId:           instanceId,
+			Mode:                 4,
+			Modes:                []int{4, 7},
+			MembershipType:       3,
+			DirectorActivityHash: raidHash,
+		},
+		Period:                          period.UTC().Format(time.RFC3339),
+		StartingPhaseIndex:              0,
+		ActivityWasStartedFromBeginning: true,
+	}
+	if rng.Float64() >= sc.RaidFraction {
+		report.ActivityDetails.Mode = 3
+		report.ActivityDetails.Modes = []int{3, 7, 18}
+		report.ActivityDetails.DirectorActivityHash = strikeHash
+	}
+
+	duration := int(activityDuration.Seconds())
+	for i := 0; i < playerCount; i++ {
+		membershipId := 4611686018400000000 + rng.Int63n(100_000_000)
+		displayName := fmt.Sprintf("Guardian%d", membershipId%10_000)
+		nameCode := int(membershipId % 10_000)
+		kills := rng.Intn(500)
+		deaths := rng.Intn(10)
+
+		report.Entries = append(report.Entries, bungie.DestinyPostGameCarnageReportEntry{
+			Player: bungie.DestinyPostGameCarnageReportPlayer{
+				DestinyUserInfo: bungie.DestinyUserInfo{
+					MembershipType:              3,
+					MembershipId:                membershipId,
+					DisplayName:                 &displayName,
+					BungieGlobalDisplayName:     &displayName,
+					BungieGlobalDisplayNameCode: &nameCode,
+				},
+				ClassHash:  classHashes[rng.Intn(len(classHashes))],
+				EmblemHash: uint32(rng.Int31()),
+			},
+			CharacterId: 2305843009200000000 + rng.Int63n(100_000_000),
+			Values: map[string]bungie.DestinyHistoricalStatsValue{
+				"assists":                 value(rng.Intn(100)),
+				"completed":               value(1),
+				"deaths":                  value(deaths),
+				"kills":                   value(kills),
+				"score":                   value(0),
+				"activityDurationSeconds": value(duration),
+				"completionReason":        value(0),
+				"startSeconds":            value(0),
+				"timePlayedSeconds":       value(duration),
+				"playerCount":             value(playerCount),
+				"teamScore":               value(0),
+			},
+			Extended: &bungie.DestinyPostGameCarnageReportExtendedData{
+				Values: map[string]bungie.DestinyHistoricalStatsValue{
+					"precisionKills":     value(kills / 2),
+					"weaponKillsSuper":   value(kills / 10),
+					"weaponKillsGrenade": value(kills / 20),
+					"weaponKillsMelee":   value(kills / 20),
+				},
+			},
+		})
+	}
+
+	return report
+}
+
+func value(v int) bungie.DestinyHistoricalStatsValue {
+	return bungie.DestinyHistoricalStatsValue{
+		Basic: bungie.DestinyHistoricalStatsValuePair{
+			Value:        float32(v),
+			DisplayValue: fmt.Sprintf("%d", v),
+		},
+	}
+}
+
+func (sc Scenario) settings() *bungie.CoreSettingsConfiguration {
+	return &bungie.CoreSettingsConfiguration{
+		Systems: map[string]bungie.CoreSystem{
+			health.Destiny2: {Enabled: !sc.SystemDisabled},
+			health.Groups:   {Enabled: !sc.SystemDisabled},
+		},
+	}
+}
+
+func (sc Scenario) manifest() *bungie.DestinyManifest {
+	return &bungie.DestinyManifest{
+		Version: "fake",
+		MobileWorldContentPaths: map[string]string{
+			"en": "/common/destiny2_content/sqlite/en/world_sql_content_fake.content",
+		},
+		JsonWorldContentPaths: map[string]string{
+			"en": "/common/destiny2_content/json/en/aggregate-fake.json",
+		},
+		JsonWorldComponentContentPaths: map[string]map[string]string{},
+	}
+}
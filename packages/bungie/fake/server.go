@@ -0,0 +1,272 @@
+// Package fake serves a local imitation of the Bungie API so the crawlers and workers can be run
+// end-to-end offline by pointing PGCR_URL_BASE and BUNGIE_URL_BASE at it.
+//
+// Responses are resolved in order from responses set with SetResponse, then from fixture files,
+// then from the Scenario. A fixture file holds the Response body of an endpoint and lives at its
+// request path without the trailing slash, e.g. <dir>/Platform/Destiny2/3/Profile/4611686018488107374.json
+package fake
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Server struct {
+	Scenario Scenario
+
+	fixtures  string
+	start     time.Time
+	requests  int64
+	mu        sync.RWMutex
+	responses map[string]any
+}
+
+type envelope struct {
+	Response        any    `json:"Response,omitempty"`
+	ErrorCode       int    `json:"ErrorCode"`
+	ThrottleSeconds int    `json:"ThrottleSeconds"`
+	ErrorStatus     string `json:"ErrorStatus"`
+	Message         string `json:"Message"`
+}
+
+// Creates a server which reads fixtures from dir. An empty dir disables fixtures.
+func NewServer(dir string, scenario Scenario) *Server {
+	return &Server{
+		Scenario:  scenario,
+		fixtures:  dir,
+		start:     time.Now(),
+		responses: make(map[string]any),
+	}
+}
+
+// Serves response as the Response body of path, e.g. /Platform/GroupV2/3148408
+func (s *Server) SetResponse(path string, response any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[normalize(path)] = response
+}
+
+// Returns the number of requests served so far
+func (s *Server) Requests() int64 {
+	return atomic.LoadInt64(&s.requests)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt64(&s.requests, 1)
+	path := normalize(r.URL.Path)
+
+	if s.Scenario.RateLimitEvery > 0 && n%s.Scenario.RateLimitEvery == 0 {
+		// Bungie's edge responds to rate limited requests with an html page
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "<html><body>403 Forbidden</body></html>")
+		return
+	}
+
+	if r.Header.Get("X-API-Key") == "" {
+		s.writeError(w, http.StatusUnauthorized, 2101, "ApiInvalidOrExpiredKey", "Please use a valid API key.")
+		return
+	}
+
+	if s.Scenario.SystemDisabled && path != "/Platform/Settings" {
+		s.writeError(w, http.StatusServiceUnavailable, 5, "SystemDisabled", "This system is temporarily disabled for maintenance.")
+		return
+	}
+
+	if response, ok := s.response(path); ok {
+		s.write(w, response)
+		return
+	}
+
+	if raw, ok := s.fixture(path); ok {
+		s.write(w, raw)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/Platform/"), "/")
+	switch {
+	case path == "/Platform/Settings":
+		s.write(w, s.Scenario.settings())
+	case path == "/Platform/Destiny2/Manifest":
+		s.write(w, s.Scenario.manifest())
+	case len(parts) == 4 && parts[1] == "Stats" && parts[2] == "PostGameCarnageReport":
+		instanceId, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, 7, "ParameterParseFailure", "Unable to parse your parameters.")
+			return
+		}
+		s.servePGCR(w, instanceId)
+	case parts[0] == "Destiny2" && len(parts) >= 4 && (parts[2] == "Profile" || parts[2] == "Account"):
+		s.servePlayer(w, r, parts)
+	case parts[0] == "GroupV2":
+		s.serveGroup(w, r, parts)
+	default:
+		s.notFound(w)
+	}
+}
+
+// Serves Destiny2/{membershipType}/Profile/{membershipId}/... and Destiny2/{membershipType}/Account/{membershipId}/...
+func (s *Server) servePlayer(w http.ResponseWriter, r *http.Request, parts []string) {
+	membershipType, err1 := strconv.Atoi(parts[1])
+	membershipId, err2 := strconv.ParseInt(parts[3], 10, 64)
+	if err1 != nil || err2 != nil {
+		s.writeError(w, http.StatusBadRequest, 7, "ParameterParseFailure", "Unable to parse your parameters.")
+		return
+	}
+	if s.Scenario.MissingPlayers[membershipId] {
+		s.writeError(w, http.StatusNotFound, 1601, "DestinyAccountNotFound", "We were unable to find your Destiny account information.")
+		return
+	}
+
+	switch {
+	case len(parts) == 4 && parts[2] == "Profile":
+		s.write(w, s.Scenario.profile(membershipType, membershipId))
+	case len(parts) == 5 && parts[2] == "Profile" && parts[4] == "LinkedProfiles":
+		s.write(w, s.Scenario.linkedProfiles(membershipType, membershipId))
+	case len(parts) == 6 && parts[2] == "Profile" && parts[4] == "Character":
+		characterId, _ := strconv.ParseInt(parts[5], 10, 64)
+		character := s.Scenario.character(membershipId, characterId)
+		if character == nil {
+			s.writeError(w, http.StatusNotFound, 1620, "DestinyCharacterNotFound", "The character was not found.")
+			return
+		}
+		s.write(w, character)
+	case len(parts) == 5 && parts[2] == "Account" && parts[4] == "Stats":
+		s.write(w, s.Scenario.historicalStats(membershipId))
+	case len(parts) == 8 && parts[2] == "Account" && parts[6] == "Stats" && parts[7] == "Activities":
+		if s.Scenario.Private[membershipId] {
+			s.writeError(w, http.StatusUnauthorized, 1665, "DestinyPrivacyRestriction", "This user has chosen to make their activity history private.")
+			return
+		}
+		characterId, _ := strconv.ParseInt(parts[5], 10, 64)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		s.write(w, s.Scenario.activityHistory(membershipType, characterId, page, s.historyLatestInstanceId()))
+	default:
+		s.notFound(w)
+	}
+}
+
+// Serves GroupV2/{groupId}, GroupV2/{groupId}/Members and GroupV2/User/{membershipType}/{membershipId}/...
+func (s *Server) serveGroup(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) >= 4 && parts[1] == "User" {
+		membershipType, _ := strconv.Atoi(parts[2])
+		membershipId, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, 7, "ParameterParseFailure", "Unable to parse your parameters.")
+			return
+		}
+		s.write(w, s.Scenario.groupsForMember(membershipType, membershipId))
+		return
+	}
+
+	groupId, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if len(parts) == 3 && parts[2] == "Members" {
+		groupId, err = strconv.ParseInt(parts[1], 10, 64)
+	}
+	if err != nil || len(parts) > 3 || s.Scenario.MissingGroups[groupId] {
+		s.writeError(w, http.StatusNotFound, 622, "GroupNotFound", "The group was not found.")
+		return
+	}
+
+	if len(parts) == 3 {
+		page, _ := strconv.Atoi(r.URL.Query().Get("currentpage"))
+		s.write(w, s.Scenario.groupMembers(groupId, max(page, 1)))
+		return
+	}
+	s.write(w, map[string]any{"detail": s.Scenario.group(groupId)})
+}
+
+func (s *Server) notFound(w http.ResponseWriter) {
+	s.writeError(w, http.StatusNotFound, 1601, "DestinyAccountNotFound", "We were unable to find your Destiny account information.")
+}
+
+func (s *Server) servePGCR(w http.ResponseWriter, instanceId int64) {
+	if instanceId > s.latestInstanceId() {
+		s.writeError(w, http.StatusNotFound, 1653, "DestinyPGCRNotFound", "The activity you are looking for does not exist.")
+		return
+	}
+
+	if s.Scenario.Redacted[instanceId] {
+		s.writeError(w, http.StatusUnauthorized, 12, "InsufficientPrivileges", "You don't have permission to access this.")
+		return
+	}
+
+	s.write(w, s.Scenario.GeneratePGCR(instanceId, s.period(instanceId)))
+}
+
+// Returns the latest instance id which is currently available, advancing with time
+func (s *Server) latestInstanceId() int64 {
+	if s.Scenario.LatestInstanceId == 0 {
+		return 1<<63 - 1
+	}
+	return s.Scenario.LatestInstanceId + int64(time.Since(s.start).Seconds()*s.Scenario.IdsPerSecond)
+}
+
+// Activity histories hold ids below the latest one, or below a recent id if every id is available
+func (s *Server) historyLatestInstanceId() int64 {
+	if s.Scenario.LatestInstanceId == 0 {
+		return 15_000_000_000
+	}
+	return s.latestInstanceId()
+}
+
+// Returns the start time of an instance such that it completes when it becomes available
+func (s *Server) period(instanceId int64) time.Time {
+	completed := time.Now()
+	if s.Scenario.IdsPerSecond > 0 {
+		seconds := float64(instanceId-s.Scenario.LatestInstanceId) / s.Scenario.IdsPerSecond
+		completed = s.start.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	return completed.Add(-activityDuration)
+}
+
+func (s *Server) response(path string) (any, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	response, ok := s.responses[path]
+	return response, ok
+}
+
+func (s *Server) fixture(path string) (json.RawMessage, bool) {
+	if s.fixtures == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(s.fixtures, filepath.FromSlash(path)+".json"))
+	if err != nil {
+		return nil, false
+	}
+	return json.RawMessage(data), true
+}
+
+func (s *Server) write(w http.ResponseWriter, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(envelope{
+		Response:    response,
+		ErrorCode:   1,
+		ErrorStatus: "Success",
+		Message:     "Ok",
+	})
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, errorCode int, errorStatus string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(envelope{
+		ErrorCode:       errorCode,
+		ErrorStatus:     errorStatus,
+		Message:         message,
+		ThrottleSeconds: s.Scenario.ThrottleSeconds,
+	})
+}
+
+func normalize(path string) string {
+	return strings.TrimSuffix(path, "/")
+}
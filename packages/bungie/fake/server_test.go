@@ -0,0 +1,267 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"raidhub/packages/bungie"
+	"raidhub/packages/bungie/health"
+	"raidhub/packages/pgcr"
+)
+
+func newClient(t *testing.T, scenario Scenario) *bungie.Client {
+	server := httptest.NewServer(NewServer("", scenario))
+	t.Cleanup(server.Close)
+
+	client := bungie.NewClient("key")
+	client.BaseURL = server.URL
+	client.StatsURL = server.URL
+	client.MaxRetries = 0
+	return client
+}
+
+func errorCode(t *testing.T, err error) int {
+	t.Helper()
+	var apiErr *bungie.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an *APIError, got %v", err)
+	}
+	return apiErr.ErrorCode
+}
+
+func TestPlayer(t *testing.T) {
+	ctx := context.Background()
+	client := newClient(t, Scenario{
+		CharactersPerPlayer:    2,
+		ActivitiesPerCharacter: 300,
+		MissingPlayers:         map[int64]bool{2: true},
+		Private:                map[int64]bool{3: true},
+	})
+	const membershipId = 4611686018488107374
+
+	profile, err := client.GetProfile(ctx, 3, membershipId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Profile.Data.UserInfo.MembershipId != membershipId || len(*profile.Characters.Data) != 2 {
+		t.Errorf("unexpected profile %+v", profile)
+	}
+
+	linked, err := client.GetLinkedProfiles(ctx, 3, membershipId, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(linked) != 1 || linked[0].MembershipId != membershipId {
+		t.Errorf("unexpected linked profiles %+v", linked)
+	}
+
+	stats, err := client.GetHistoricalStats(ctx, 3, membershipId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range stats.Characters {
+		if _, ok := (*profile.Characters.Data)[c.CharacterId]; !ok {
+			t.Errorf("historical stats character %d is not in the profile", c.CharacterId)
+		}
+		character, err := client.GetCharacter(ctx, 3, membershipId, c.CharacterId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if character.Character.Data.CharacterId != c.CharacterId {
+			t.Errorf("got character %d, want %d", character.Character.Data.CharacterId, c.CharacterId)
+		}
+	}
+
+	characterId := stats.Characters[0].CharacterId
+	first, err := client.GetActivityHistoryPage(ctx, 3, membershipId, characterId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.GetActivityHistoryPage(ctx, 3, membershipId, characterId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := client.GetActivityHistoryPage(ctx, 3, membershipId, characterId, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 250 || len(second) != 50 || len(third) != 0 {
+		t.Errorf("got pages of %d, %d and %d activities, want 250, 50 and 0", len(first), len(second), len(third))
+	}
+	if first[0].ActivityDetails.InstanceId <= second[0].ActivityDetails.InstanceId {
+		t.Error("activity history is not newest first")
+	}
+
+	if _, err := client.GetProfile(ctx, 3, 2); errorCode(t, err) != 1601 {
+		t.Errorf("missing player returned %v", err)
+	}
+	if _, err := client.GetActivityHistoryPage(ctx, 3, 3, characterId, 0); errorCode(t, err) != 1665 {
+		t.Errorf("private player returned %v", err)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	ctx := context.Background()
+	client := newClient(t, Scenario{
+		MembersPerGroup: 150,
+		MissingGroups:   map[int64]bool{1: true},
+		Clanless:        map[int64]bool{5: true},
+	})
+
+	groups, err := client.GetGroupsForMember(ctx, 3, 4611686018488107374)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups.Results) != 1 {
+		t.Fatalf("got %d groups, want 1", len(groups.Results))
+	}
+	groupId := groups.Results[0].Group.GroupId
+
+	group, err := client.GetGroup(ctx, groupId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Detail.GroupId != groupId || group.Detail.MemberCount != 150 {
+		t.Errorf("unexpected group %+v", group.Detail)
+	}
+
+	first, err := client.GetMembersOfGroup(ctx, groupId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.GetMembersOfGroup(ctx, groupId, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Results) != 100 || !first.HasMore || len(second.Results) != 50 || second.HasMore {
+		t.Errorf("got pages of %d and %d members", len(first.Results), len(second.Results))
+	}
+
+	if _, err := client.GetGroup(ctx, 1); errorCode(t, err) != 622 {
+		t.Errorf("missing group returned %v", err)
+	}
+	clanless, err := client.GetGroupsForMember(ctx, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clanless.Results) != 0 {
+		t.Errorf("clanless player is in %d groups", len(clanless.Results))
+	}
+}
+
+func TestPGCR(t *testing.T) {
+	tests := []struct {
+		name       string
+		scenario   Scenario
+		instanceId int64
+		// The ErrorCode of the API error, 0 for a successful response
+		errorCode int
+		result    pgcr.PGCRResult
+		// The least time the client waits before returning
+		wait time.Duration
+	}{
+		{"raid", Scenario{RaidFraction: 1}, 12_000_000_000, 0, pgcr.Success, 0},
+		{"non-raid", Scenario{RaidFraction: 0}, 12_000_000_000, 0, pgcr.NonRaid, 0},
+		{"available", Scenario{LatestInstanceId: 12_000_000_000, RaidFraction: 1}, 12_000_000_000, 0, pgcr.Success, 0},
+		{"not yet available", Scenario{LatestInstanceId: 12_000_000_000}, 12_000_000_001, 1653, pgcr.NotFound, 0},
+		{"system disabled", Scenario{SystemDisabled: true, RaidFraction: 1}, 12_000_000_000, 5, pgcr.SystemDisabled, 0},
+		{"redacted", Scenario{Redacted: map[int64]bool{12_000_000_000: true}}, 12_000_000_000, 12, pgcr.InsufficientPrivileges, 0},
+		{"throttled", Scenario{LatestInstanceId: 12_000_000_000, ThrottleSeconds: 1}, 12_000_000_001, 1653, pgcr.NotFound, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := newClient(t, tt.scenario)
+
+			start := time.Now()
+			report, err := client.GetPGCR(ctx, tt.instanceId)
+			if tt.errorCode == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if report.ActivityDetails.InstanceId != tt.instanceId {
+					t.Errorf("got instance %d", report.ActivityDetails.InstanceId)
+				}
+			} else {
+				var apiErr *bungie.APIError
+				if !errors.As(err, &apiErr) || apiErr.ErrorCode != tt.errorCode {
+					t.Fatalf("got %v, want ErrorCode %d", err, tt.errorCode)
+				}
+				if apiErr.ThrottleSeconds != tt.scenario.ThrottleSeconds {
+					t.Errorf("got ThrottleSeconds %d, want %d", apiErr.ThrottleSeconds, tt.scenario.ThrottleSeconds)
+				}
+			}
+			if waited := time.Since(start); waited < tt.wait {
+				t.Errorf("the client returned after %s, want at least %s", waited, tt.wait)
+			}
+
+			result, activity, _, _ := pgcr.FetchAndProcessPGCR(ctx, client, tt.instanceId)
+			if result != tt.result {
+				t.Errorf("got result %d, want %d", result, tt.result)
+			}
+			if result == pgcr.Success && (activity == nil || activity.PlayerCount != playerCount || !activity.Completed) {
+				t.Errorf("unexpected activity %+v", activity)
+			}
+		})
+	}
+}
+
+func TestPGCRsAreDeterministic(t *testing.T) {
+	client := newClient(t, Scenario{RaidFraction: 0.5})
+	first, err := client.GetPGCR(context.Background(), 12_000_000_123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.GetPGCR(context.Background(), 12_000_000_123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Entries[0].Player.DestinyUserInfo.MembershipId != second.Entries[0].Player.DestinyUserInfo.MembershipId ||
+		first.ActivityDetails.Mode != second.ActivityDetails.Mode {
+		t.Error("the same instance id generated different PGCRs")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	client := newClient(t, Scenario{RateLimitEvery: 2})
+
+	if _, err := client.GetPGCR(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	// An html page, so there is no ErrorCode or ErrorStatus
+	_, err := client.GetPGCR(ctx, 2)
+	var apiErr *bungie.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || apiErr.ErrorStatus != "" {
+		t.Fatalf("got %v, want a 403 without an error status", err)
+	}
+	if _, err := client.GetPGCR(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSystemDisabled(t *testing.T) {
+	ctx := context.Background()
+	client := newClient(t, Scenario{SystemDisabled: true})
+
+	settings, err := client.GetCommonSettings(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, system := range []string{health.Destiny2, health.Groups} {
+		if s, ok := settings.Systems[system]; !ok || s.Enabled {
+			t.Errorf("%s is not reported as disabled", system)
+		}
+	}
+
+	if _, err := client.GetGroup(ctx, 1); errorCode(t, err) != 5 {
+		t.Errorf("GroupV2 returned %v", err)
+	}
+	if _, err := client.GetProfile(ctx, 3, 4611686018488107374); errorCode(t, err) != 5 {
+		t.Errorf("Profile returned %v", err)
+	}
+}
@@ -1,13 +1,10 @@
 package bungie
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
-	"net/http"
-	"os"
 	"sync"
-	"time"
 )
 
 type ActivityHistoryResponse struct {
@@ -25,10 +22,10 @@ type DestinyHistoricalStatsPeriodGroup struct {
 	ActivityDetails DestinyHistoricalStatsActivity `json:"activityDetails"`
 }
 
-func GetActivityHistory(membershipType int, membershipId int64, characterId int64, concurrentPages int, out chan int64) error {
+func (c *Client) GetActivityHistory(ctx context.Context, membershipType int, membershipId int64, characterId int64, concurrentPages int, out chan int64) error {
 	ch := make(chan int)
 
-	results, _, err := GetActivityHistoryPage(membershipType, membershipId, characterId, 0)
+	results, err := c.GetActivityHistoryPage(ctx, membershipType, membershipId, characterId, 0)
 	if err != nil {
 		return err
 	}
@@ -53,7 +50,7 @@ func GetActivityHistory(membershipType int, membershipId int64, characterId int6
 			defer wg.Done()
 
 			for page := range ch {
-				results, _, err := GetActivityHistoryPage(membershipType, membershipId, characterId, page)
+				results, err := c.GetActivityHistoryPage(ctx, membershipType, membershipId, characterId, page)
 				if err != nil {
 					log.Printf("Error fetching activity history page: %s", err)
 				}
@@ -74,45 +71,14 @@ func GetActivityHistory(membershipType int, membershipId int64, characterId int6
 	return nil
 }
 
-func GetActivityHistoryPage(membershipType int, membershipId int64, characterId int64, page int) ([]DestinyHistoricalStatsPeriodGroup, int, error) {
+func (c *Client) GetActivityHistoryPage(ctx context.Context, membershipType int, membershipId int64, characterId int64, page int) ([]DestinyHistoricalStatsPeriodGroup, error) {
 	log.Printf("Getting /Destiny2/%d/Account/%d/Character/%d/ page=%d", membershipType, membershipId, characterId, page)
-	url := fmt.Sprintf("%s/Platform/Destiny2/%d/Account/%d/Character/%d/Stats/Activities/?mode=4&count=250&page=%d", getBungieURL(), membershipType, membershipId, characterId, page)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return []DestinyHistoricalStatsPeriodGroup{}, 0, err
-	}
-
-	apiKey := os.Getenv("BUNGIE_API_KEY")
-	req.Header.Set("X-API-Key", apiKey)
-
-	resp, err := http.DefaultClient.Do(req)
-
-	if err != nil {
-		return []DestinyHistoricalStatsPeriodGroup{}, 0, err
-	}
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		var data BungieError
-		if err := decoder.Decode(&data); err != nil {
-			return []DestinyHistoricalStatsPeriodGroup{}, 0, err
-		}
-
-		defer func() {
-			if data.ThrottleSeconds > 0 {
-				time.Sleep(time.Duration(data.ThrottleSeconds) * time.Second)
-			}
-		}()
-
-		return []DestinyHistoricalStatsPeriodGroup{}, data.ErrorCode, fmt.Errorf("error response: %s (%d)", data.Message, data.ErrorCode)
-	}
+	url := fmt.Sprintf("%s/Platform/Destiny2/%d/Account/%d/Character/%d/Stats/Activities/?mode=4&count=250&page=%d", c.BaseURL, membershipType, membershipId, characterId, page)
 
 	var data ActivityHistoryResponse
-	if err := decoder.Decode(&data); err != nil {
-		return []DestinyHistoricalStatsPeriodGroup{}, 0, err
+	if err := c.get(ctx, "GetActivityHistoryPage", url, &data); err != nil {
+		return []DestinyHistoricalStatsPeriodGroup{}, err
 	}
 
-	return data.Response.Activities, data.ErrorCode, nil
+	return data.Response.Activities, nil
 }
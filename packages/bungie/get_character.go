@@ -1,11 +1,8 @@
 package bungie
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"os"
-	"time"
 )
 
 type GetCharacterResponse struct {
@@ -23,41 +20,11 @@ type SingleComponentResponseOfDestinyCharacterComponent struct {
 	Data *DestinyCharacterComponent `json:"data"`
 }
 
-func GetCharacter(membershipType int32, membershipId int64, characterId int64) (*DestinyCharacterResponse, error) {
-	url := fmt.Sprintf("%s/Platform/Destiny2/%d/Profile/%d/Character/%d/?components=200", getBungieURL(), membershipType, membershipId, characterId)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	apiKey := os.Getenv("BUNGIE_API_KEY") // Read the API key from the BUNGIE_API_KEY environment variable
-	req.Header.Set("X-API-Key", apiKey)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		var data BungieError
-		if err := decoder.Decode(&data); err != nil {
-			return nil, err
-		}
-
-		defer func() {
-			if data.ThrottleSeconds > 0 {
-				time.Sleep(time.Duration(data.ThrottleSeconds) * time.Second)
-			}
-		}()
-
-		return nil, fmt.Errorf("error response: %s (%d)", data.Message, data.ErrorCode)
-	}
+func (c *Client) GetCharacter(ctx context.Context, membershipType int32, membershipId int64, characterId int64) (*DestinyCharacterResponse, error) {
+	url := fmt.Sprintf("%s/Platform/Destiny2/%d/Profile/%d/Character/%d/?components=200", c.BaseURL, membershipType, membershipId, characterId)
 
 	var data GetCharacterResponse
-	if err := decoder.Decode(&data); err != nil {
+	if err := c.get(ctx, "GetCharacter", url, &data); err != nil {
 		return nil, err
 	}
 
@@ -1,11 +1,8 @@
 package bungie
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"os"
-	"time"
 )
 
 type GetGroupsResponse struct {
@@ -53,41 +50,11 @@ type ClanBanner struct {
 	GonfalonDetailColorId  uint32 `json:"gonfalonDetailColorId"`
 }
 
-func GetGroupsForMember(membershipType int, membershipId int64) (*GetGroupsForMemberResponse, error) {
-	url := fmt.Sprintf("%s/Platform/GroupV2/User/%d/%d/0/1/", getBungieURL(), membershipType, membershipId)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	apiKey := os.Getenv("BUNGIE_API_KEY") // Read the API key from the BUNGIE_API_KEY environment variable
-	req.Header.Set("X-API-Key", apiKey)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		var data BungieError
-		if err := decoder.Decode(&data); err != nil {
-			return nil, err
-		}
-
-		defer func() {
-			if data.ThrottleSeconds > 0 {
-				time.Sleep(time.Duration(data.ThrottleSeconds) * time.Second)
-			}
-		}()
-
-		return nil, fmt.Errorf("error response: %s (%d)", data.Message, data.ErrorCode)
-	}
+func (c *Client) GetGroupsForMember(ctx context.Context, membershipType int, membershipId int64) (*GetGroupsForMemberResponse, error) {
+	url := fmt.Sprintf("%s/Platform/GroupV2/User/%d/%d/0/1/", c.BaseURL, membershipType, membershipId)
 
 	var data GetGroupsResponse
-	if err := decoder.Decode(&data); err != nil {
+	if err := c.get(ctx, "GetGroupsForMember", url, &data); err != nil {
 		return nil, err
 	}
 
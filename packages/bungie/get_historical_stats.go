@@ -1,11 +1,8 @@
 package bungie
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"os"
-	"time"
 )
 
 type HistoricalStatsResponse struct {
@@ -23,41 +20,11 @@ type DestinyHistoricalStatsPerCharacter struct {
 	CharacterId int64 `json:"characterId,string"`
 }
 
-func GetHistoricalStats(membershipType int, membershipId int64) (*DestinyHistoricalStatsAccountResult, error) {
-	url := fmt.Sprintf("%s/Platform/Destiny2/%d/Account/%d/Stats/", getBungieURL(), membershipType, membershipId)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	apiKey := os.Getenv("BUNGIE_API_KEY") // Read the API key from the BUNGIE_API_KEY environment variable
-	req.Header.Set("X-API-Key", apiKey)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		var data BungieError
-		if err := decoder.Decode(&data); err != nil {
-			return nil, err
-		}
-
-		defer func() {
-			if data.ThrottleSeconds > 0 {
-				time.Sleep(time.Duration(data.ThrottleSeconds) * time.Second)
-			}
-		}()
-
-		return nil, fmt.Errorf("error response: %s (%d)", data.Message, data.ErrorCode)
-	}
+func (c *Client) GetHistoricalStats(ctx context.Context, membershipType int, membershipId int64) (*DestinyHistoricalStatsAccountResult, error) {
+	url := fmt.Sprintf("%s/Platform/Destiny2/%d/Account/%d/Stats/", c.BaseURL, membershipType, membershipId)
 
 	var data HistoricalStatsResponse
-	if err := decoder.Decode(&data); err != nil {
+	if err := c.get(ctx, "GetHistoricalStats", url, &data); err != nil {
 		return nil, err
 	}
 
@@ -1,11 +1,8 @@
 package bungie
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"os"
-	"time"
 )
 
 type LinkedProfilesResponse struct {
@@ -19,42 +16,12 @@ type LinkedProfiles struct {
 	Profiles []DestinyUserInfo `json:"profiles"`
 }
 
-func GetLinkedProfiles(membershipType int, membershipId int64, getAllMemberships bool) ([]DestinyUserInfo, error) {
-	url := fmt.Sprintf("%s/Platform/Destiny2/%d/Profile/%d/LinkedProfiles/?getAllMemberships=%t", getBungieURL(), membershipType, membershipId, getAllMemberships)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return []DestinyUserInfo{}, err
-	}
-
-	apiKey := os.Getenv("BUNGIE_API_KEY") // Read the API key from the BUNGIE_API_KEY environment variable
-	req.Header.Set("X-API-Key", apiKey)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return []DestinyUserInfo{}, err
-	}
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		var data BungieError
-		if err := decoder.Decode(&data); err != nil {
-			return []DestinyUserInfo{}, err
-		}
-
-		defer func() {
-			if data.ThrottleSeconds > 0 {
-				time.Sleep(time.Duration(data.ThrottleSeconds) * time.Second)
-			}
-		}()
-
-		return []DestinyUserInfo{}, fmt.Errorf("error response: %s (%d)", data.Message, data.ErrorCode)
-	}
+func (c *Client) GetLinkedProfiles(ctx context.Context, membershipType int, membershipId int64, getAllMemberships bool) ([]DestinyUserInfo, error) {
+	url := fmt.Sprintf("%s/Platform/Destiny2/%d/Profile/%d/LinkedProfiles/?getAllMemberships=%t", c.BaseURL, membershipType, membershipId, getAllMemberships)
 
 	var data LinkedProfilesResponse
-	if err := decoder.Decode(&data); err != nil {
-		return []DestinyUserInfo{}, err
+	if err := c.get(ctx, "GetLinkedProfiles", url, &data); err != nil {
+		return nil, err
 	}
 
 	return data.Response.Profiles, nil
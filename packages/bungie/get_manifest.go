@@ -1,11 +1,8 @@
 package bungie
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"os"
-
 	"math/rand"
 )
 
@@ -23,35 +20,11 @@ type DestinyManifest struct {
 	Version                        string                       `json:"version"`
 }
 
-func GetDestinyManifest() (*DestinyManifest, error) {
-	url := fmt.Sprintf("https://www.bungie.net/Platform/Destiny2/Manifest/?c=%d", rand.Int())
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	apiKey := os.Getenv("BUNGIE_API_KEY")
-	req.Header.Set("X-API-Key", apiKey)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		var data BungieError
-		if err := decoder.Decode(&data); err != nil {
-			return nil, err
-		}
-
-		return nil, fmt.Errorf("error response: %s (%d)", data.Message, data.ErrorCode)
-	}
+func (c *Client) GetDestinyManifest(ctx context.Context) (*DestinyManifest, error) {
+	url := fmt.Sprintf("%s/Platform/Destiny2/Manifest/?c=%d", c.BaseURL, rand.Int())
 
 	var data DestinyManifestResponse
-	if err := decoder.Decode(&data); err != nil {
+	if err := c.get(ctx, "GetDestinyManifest", url, &data); err != nil {
 		return nil, err
 	}
 
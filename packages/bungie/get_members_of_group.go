@@ -1,11 +1,8 @@
 package bungie
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"os"
-	"time"
 )
 
 type GetMembersOfGroupResponse struct {
@@ -20,41 +17,11 @@ type SearchResultOfGroupMember struct {
 	Results []GroupMember `json:"results"`
 }
 
-func GetMembersOfGroup(groupId int64, page int) (*SearchResultOfGroupMember, error) {
-	url := fmt.Sprintf("%s/Platform/GroupV2/%d/Members/?currentpage=%d&memberType=0", getBungieURL(), groupId, page)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	apiKey := os.Getenv("BUNGIE_API_KEY") // Read the API key from the BUNGIE_API_KEY environment variable
-	req.Header.Set("X-API-Key", apiKey)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		var data BungieError
-		if err := decoder.Decode(&data); err != nil {
-			return nil, err
-		}
-
-		defer func() {
-			if data.ThrottleSeconds > 0 {
-				time.Sleep(time.Duration(data.ThrottleSeconds) * time.Second)
-			}
-		}()
-
-		return nil, fmt.Errorf("error response: %s (%d)", data.Message, data.ErrorCode)
-	}
+func (c *Client) GetMembersOfGroup(ctx context.Context, groupId int64, page int) (*SearchResultOfGroupMember, error) {
+	url := fmt.Sprintf("%s/Platform/GroupV2/%d/Members/?currentpage=%d&memberType=0", c.BaseURL, groupId, page)
 
 	var data GetMembersOfGroupResponse
-	if err := decoder.Decode(&data); err != nil {
+	if err := c.get(ctx, "GetMembersOfGroup", url, &data); err != nil {
 		return nil, err
 	}
 
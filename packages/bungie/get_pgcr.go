@@ -1,30 +1,19 @@
 package bungie
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
 )
 
-const (
-	bungieURL = "/Platform/Destiny2/Stats/PostGameCarnageReport"
-)
-
-func GetPGCR(client *http.Client, baseURL string, instanceId int64, apiKey string) (*json.Decoder, int, func(), error) {
-	instanceUrl := fmt.Sprintf("%s%s/%d/", baseURL, bungieURL, instanceId)
-	req, _ := http.NewRequest("GET", instanceUrl, nil)
-	req.Header.Set("X-API-KEY", apiKey)
+func (c *Client) GetPGCR(ctx context.Context, instanceId int64) (*DestinyPostGameCarnageReport, error) {
+	url := fmt.Sprintf("%s/Platform/Destiny2/Stats/PostGameCarnageReport/%d/", c.StatsURL, instanceId)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, -1, nil, err
+	var data DestinyPostGameCarnageReportResponse
+	if err := c.get(ctx, "GetPGCR", url, &data); err != nil {
+		return nil, err
 	}
 
-	decoder := json.NewDecoder(resp.Body)
-	return decoder, resp.StatusCode, func() {
-		resp.Body.Close()
-	}, nil
-
+	return &data.Response, nil
 }
 
 // There are more fields here than recorded in this file, but these are the only ones we care about
@@ -0,0 +1,216 @@
+// Package health tracks which Bungie API systems are enabled, so workers can pause while a system they
+// depend on is down for maintenance instead of failing every request.
+package health
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"raidhub/packages/bungie"
+	"raidhub/packages/config"
+	"raidhub/packages/discord"
+	"raidhub/packages/monitoring"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keys of CoreSettingsConfiguration.Systems. Any other key reported by Bungie can be used too.
+const (
+	Destiny2 = "Destiny2"
+	Groups   = "Groups"
+)
+
+var (
+	defaultMonitor *Monitor
+	once           sync.Once
+)
+
+// A Monitor polls the Bungie settings endpoint and reports transitions of each system to its subscribers.
+// Systems it has not heard of yet are considered enabled.
+type Monitor struct {
+	Client   *bungie.Client
+	Interval time.Duration
+	// Discord webhook for alerts on transitions, none are sent if empty
+	WebhookURL string
+
+	mu          sync.Mutex
+	systems     map[string]*system
+	subscribers []func(system string, enabled bool)
+	failures    int
+}
+
+type system struct {
+	enabled bool
+	// Closed when the system is enabled again
+	resumed chan struct{}
+}
+
+func New(client *bungie.Client) *Monitor {
+	return &Monitor{
+		Client:     client,
+		Interval:   time.Minute,
+		WebhookURL: config.Load().Discord.HealthWebhookURL,
+		systems:    make(map[string]*system),
+	}
+}
+
+// Returns the monitor shared by the whole process, which polls bungie.Default() from its first use
+func Default() *Monitor {
+	once.Do(func() {
+		defaultMonitor = New(bungie.Default())
+		go defaultMonitor.Run(context.Background())
+	})
+	return defaultMonitor
+}
+
+// Polls every Interval until ctx is cancelled. The last known state is kept while the endpoint is failing.
+func (m *Monitor) Run(ctx context.Context) {
+	for {
+		if err := m.Check(ctx); err != nil && ctx.Err() == nil {
+			m.mu.Lock()
+			m.failures++
+			failures := m.failures
+			m.mu.Unlock()
+			log.Printf("Failed to check Bungie API status (%d in a row): %s", failures, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.Interval):
+		}
+	}
+}
+
+// Reads the state of every system once
+func (m *Monitor) Check(ctx context.Context) error {
+	res, err := m.Client.GetCommonSettings(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.failures = 0
+	m.mu.Unlock()
+
+	names := make([]string, 0, len(res.Systems))
+	for name := range res.Systems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m.set(name, res.Systems[name].Enabled)
+	}
+	return nil
+}
+
+// Marks a system as disabled until the next check, e.g. after a request was refused with SystemDisabled
+func (m *Monitor) ReportDisabled(name string) {
+	m.set(name, false)
+}
+
+func (m *Monitor) Enabled(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.systems[name]
+	return !ok || s.enabled
+}
+
+// Blocks while the system is disabled. Returns ctx.Err() if ctx is cancelled first.
+func (m *Monitor) Wait(ctx context.Context, name string) error {
+	m.mu.Lock()
+	s, ok := m.systems[name]
+	if !ok || s.enabled {
+		m.mu.Unlock()
+		return nil
+	}
+	resumed := s.resumed
+	m.mu.Unlock()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Calls fn whenever a system is disabled or enabled again
+func (m *Monitor) Subscribe(fn func(system string, enabled bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscribers = append(m.subscribers, fn)
+}
+
+func (m *Monitor) set(name string, enabled bool) {
+	m.mu.Lock()
+	s, known := m.systems[name]
+	if !known {
+		s = &system{enabled: true, resumed: make(chan struct{})}
+		close(s.resumed)
+		m.systems[name] = s
+	}
+	if s.enabled == enabled {
+		m.mu.Unlock()
+		if !known {
+			monitoring.BungieSystemEnabled.WithLabelValues(name).Set(1)
+		}
+		return
+	}
+
+	s.enabled = enabled
+	if enabled {
+		close(s.resumed)
+	} else {
+		s.resumed = make(chan struct{})
+	}
+	subscribers := append([]func(string, bool){}, m.subscribers...)
+	m.mu.Unlock()
+
+	if enabled {
+		log.Printf("Bungie system %s is enabled", name)
+		monitoring.BungieSystemEnabled.WithLabelValues(name).Set(1)
+	} else {
+		log.Printf("Bungie system %s is disabled", name)
+		monitoring.BungieSystemEnabled.WithLabelValues(name).Set(0)
+	}
+	monitoring.BungieSystemTransitions.WithLabelValues(name).Inc()
+
+	m.alert(name, enabled)
+	for _, fn := range subscribers {
+		fn(name, enabled)
+	}
+}
+
+func (m *Monitor) alert(name string, enabled bool) {
+	if m.WebhookURL == "" {
+		return
+	}
+
+	title := fmt.Sprintf("Bungie system %s is disabled", name)
+	color := 15105570 // Orange
+	if enabled {
+		title = fmt.Sprintf("Bungie system %s is enabled", name)
+		color = 5763719 // Green
+	}
+	webhook := discord.Webhook{
+		Embeds: []discord.Embed{{
+			Title: title,
+			Color: color,
+			Fields: []discord.Field{{
+				Name:  "Service",
+				Value: filepath.Base(os.Args[0]),
+			}},
+			Timestamp: time.Now().Format(time.RFC3339),
+			Footer:    discord.CommonFooter,
+		}},
+	}
+	go func() {
+		if _, err := discord.SendWebhook(m.WebhookURL, &webhook); err != nil {
+			log.Printf("Failed to send Bungie health alert: %s", err)
+		}
+	}()
+}
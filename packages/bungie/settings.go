@@ -1,11 +1,8 @@
 package bungie
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"os"
-	"time"
 )
 
 type GetCommonSettingsResponse struct {
@@ -23,41 +20,11 @@ type CoreSystem struct {
 	Enabled bool `json:"enabled"`
 }
 
-func GetCommonSettings() (*CoreSettingsConfiguration, error) {
-	url := fmt.Sprintf("%s/Platform/Settings", getBungieURL())
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	apiKey := os.Getenv("BUNGIE_API_KEY") // Read the API key from the BUNGIE_API_KEY environment variable
-	req.Header.Set("X-API-Key", apiKey)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		var data BungieError
-		if err := decoder.Decode(&data); err != nil {
-			return nil, err
-		}
-
-		defer func() {
-			if data.ThrottleSeconds > 0 {
-				time.Sleep(time.Duration(data.ThrottleSeconds) * time.Second)
-			}
-		}()
-
-		return nil, fmt.Errorf("error response: %s (%d)", data.Message, data.ErrorCode)
-	}
+func (c *Client) GetCommonSettings(ctx context.Context) (*CoreSettingsConfiguration, error) {
+	url := fmt.Sprintf("%s/Platform/Settings", c.BaseURL)
 
 	var data GetCommonSettingsResponse
-	if err := decoder.Decode(&data); err != nil {
+	if err := c.get(ctx, "GetCommonSettings", url, &data); err != nil {
 		return nil, err
 	}
 
@@ -1,36 +1,37 @@
 package clickhouse
 
 import (
-	"log"
-	"os"
+	"raidhub/packages/config"
 
 	ch "github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
-	"github.com/joho/godotenv"
 )
 
 func Connect(debug bool) (driver.Conn, error) {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
-	}
+	cfg := config.Load().ClickHouse
 
-	user := os.Getenv("CLICKHOUSE_USER")
-	if user == "" {
-		user = "default"
+	opts := &ch.Options{
+		Addr: []string{cfg.Addr},
+		Auth: ch.Auth{
+			Database: cfg.Database,
+			Username: cfg.User,
+			Password: cfg.Password,
+		},
+	}
+	if cfg.URL != "" {
+		var err error
+		if opts, err = ch.ParseDSN(cfg.URL); err != nil {
+			return nil, err
+		}
 	}
 
-	password := os.Getenv("CLICKHOUSE_PASSWORD")
+	if opts.Settings == nil {
+		opts.Settings = ch.Settings{}
+	}
+	opts.Settings["flatten_nested"] = 0
+	opts.MaxOpenConns = 50
+	opts.MaxIdleConns = 40
+	opts.Debug = debug
 
-	return ch.Open(&ch.Options{
-		Settings: ch.Settings{
-			"flatten_nested": 0,
-		},
-		MaxOpenConns: 50,
-		MaxIdleConns: 40,
-		Debug:        debug,
-		Auth: ch.Auth{
-			Username: user,
-			Password: password,
-		},
-	})
+	return ch.Open(opts)
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"raidhub/packages/async/bonus_pgcr"
+	"raidhub/packages/pgcr"
+	"raidhub/packages/postgres"
+	"raidhub/packages/rabbit"
+	"time"
+)
+
+var (
+	startId     = flag.Int64("start", -1, "first instance id to audit (default: 10,000,000 ids behind the end)")
+	endId       = flag.Int64("end", -1, "last instance id to audit (default: latest instance id)")
+	window      = flag.Int("window", 200, "number of preceding raids used to estimate raid density")
+	minMissing  = flag.Float64("min", 5, "minimum estimated missing raids for a gap to be reported")
+	enqueue     = flag.Bool("enqueue", false, "enqueue the unresolved ids of each gap to the pgcr_fetch queue")
+	maxEnqueue  = flag.Int64("max_enqueue", 100_000, "maximum number of ids to enqueue per gap")
+	reportPath  = flag.String("out", "", "write the report as JSON to this file (optional)")
+	missingRaws = flag.Bool("raw", true, "report and enqueue instances which are missing their raw PGCR")
+)
+
+// A Gap is a range of instance ids between two stored instances which, given the raid
+// density around it, should have contained raids. During peak hours the density is high,
+// so even short ranges with no raids are reported.
+type Gap struct {
+	After           int64     `json:"after"`
+	Before          int64     `json:"before"`
+	Size            int64     `json:"size"`
+	KnownNonRaid    int64     `json:"knownNonRaid"`
+	ExpectedMissing float64   `json:"expectedMissing"`
+	DateAfter       time.Time `json:"dateAfter"`
+	DateBefore      time.Time `json:"dateBefore"`
+	Enqueued        int64     `json:"enqueued"`
+}
+
+type Report struct {
+	Start              int64   `json:"start"`
+	End                int64   `json:"end"`
+	InstancesScanned   int64   `json:"instancesScanned"`
+	Gaps               []Gap   `json:"gaps"`
+	EstimatedMissing   float64 `json:"estimatedMissing"`
+	MissingRawPGCRs    []int64 `json:"missingRawPgcrs"`
+	MissingRawEnqueued int64   `json:"missingRawEnqueued"`
+}
+
+func main() {
+	flag.Parse()
+
+	db, err := postgres.Connect()
+	if err != nil {
+		log.Fatalf("Error connecting to the database: %s", err)
+	}
+	defer db.Close()
+
+	end := *endId
+	if end == -1 {
+		end, err = postgres.GetLatestInstanceId(db, 0)
+		if err != nil {
+			log.Fatalf("Error getting latest instance id: %s", err)
+		}
+	}
+	start := *startId
+	if start == -1 {
+		start = end - 10_000_000
+	}
+	if start >= end || *window < 2 {
+		log.Fatalln("Invalid flags")
+	}
+
+	if *enqueue {
+		_, err := rabbit.Init()
+		if err != nil {
+			log.Fatalf("Error connecting to rabbit: %s", err)
+		}
+		defer rabbit.Cleanup()
+	}
+
+	log.Printf("Auditing instance ids %d to %d", start, end)
+	report, err := audit(db, start, end)
+	if err != nil {
+		log.Fatalf("Error auditing instances: %s", err)
+	}
+
+	for _, gap := range report.Gaps {
+		log.Printf("Gap %d..%d (%d ids, %d known non-raid) from %s to %s: ~%.0f missing, %d enqueued",
+			gap.After, gap.Before, gap.Size, gap.KnownNonRaid,
+			gap.DateAfter.Format(time.RFC3339), gap.DateBefore.Format(time.RFC3339),
+			gap.ExpectedMissing, gap.Enqueued)
+	}
+	log.Printf("Scanned %d instances, found %d gaps with ~%.0f missing raids and %d instances missing their raw PGCR",
+		report.InstancesScanned, len(report.Gaps), report.EstimatedMissing, len(report.MissingRawPGCRs))
+
+	if *reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(*reportPath, data, 0644); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Wrote report to %s", *reportPath)
+	}
+}
+
+func audit(db *sql.DB, start int64, end int64) (*Report, error) {
+	rows, err := db.Query(`SELECT instance_id, date_started, pgcr.instance_id IS NOT NULL
+		FROM instance
+		LEFT JOIN pgcr USING (instance_id)
+		WHERE instance_id BETWEEN $1 AND $2
+		ORDER BY instance_id ASC`, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := Report{
+		Start:           start,
+		End:             end,
+		Gaps:            []Gap{},
+		MissingRawPGCRs: []int64{},
+	}
+
+	// ring buffer of the most recent instance ids to estimate the raid density
+	recent := make([]int64, *window)
+	count := 0
+	var prevId int64
+	var prevDate time.Time
+
+	for rows.Next() {
+		var instanceId int64
+		var dateStarted time.Time
+		var hasRaw bool
+		if err := rows.Scan(&instanceId, &dateStarted, &hasRaw); err != nil {
+			return nil, err
+		}
+		report.InstancesScanned++
+
+		if !hasRaw && *missingRaws {
+			report.MissingRawPGCRs = append(report.MissingRawPGCRs, instanceId)
+		}
+
+		if count >= *window {
+			oldest := recent[count%*window]
+			density := float64(*window) / float64(prevId-oldest)
+			size := instanceId - prevId - 1
+			if float64(size)*density >= *minMissing {
+				gap, err := inspectGap(db, prevId, instanceId, density)
+				if err != nil {
+					return nil, err
+				}
+				gap.DateAfter = prevDate
+				gap.DateBefore = dateStarted
+				if gap.ExpectedMissing >= *minMissing {
+					report.Gaps = append(report.Gaps, *gap)
+					report.EstimatedMissing += gap.ExpectedMissing
+				}
+			}
+		}
+
+		recent[count%*window] = instanceId
+		count++
+		prevId = instanceId
+		prevDate = dateStarted
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if *enqueue {
+		for _, instanceId := range report.MissingRawPGCRs {
+			if err := bonus_pgcr.SendFetchMessage(context.Background(), instanceId); err != nil {
+				return nil, err
+			}
+			report.MissingRawEnqueued++
+		}
+	}
+
+	return &report, nil
+}
+
+// Counts the ids in the gap already known to be non-raids, and enqueues the rest if requested
+func inspectGap(db *sql.DB, after int64, before int64, density float64) (*Gap, error) {
+	gap := Gap{
+		After:  after,
+		Before: before,
+		Size:   before - after - 1,
+	}
+
+	knownNonRaid, err := pgcr.GetNonRaidRanges(db, after, before)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range knownNonRaid {
+		gap.KnownNonRaid += r.End - r.Start + 1
+	}
+	gap.ExpectedMissing = float64(gap.Size-gap.KnownNonRaid) * density
+
+	if *enqueue && gap.ExpectedMissing >= *minMissing {
+		for id := after + 1; id < before && gap.Enqueued < *maxEnqueue; id++ {
+			// The ranges are sorted, so the next one is the only one which can contain id
+			if len(knownNonRaid) > 0 && id >= knownNonRaid[0].Start {
+				id = knownNonRaid[0].End
+				knownNonRaid = knownNonRaid[1:]
+				continue
+			}
+			if err := bonus_pgcr.SendFetchMessage(context.Background(), id); err != nil {
+				return nil, fmt.Errorf("error enqueueing instance_id %d: %s", id, err)
+			}
+			gap.Enqueued++
+		}
+	}
+
+	return &gap, nil
+}
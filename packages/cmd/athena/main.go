@@ -13,10 +13,10 @@ import (
 	"os"
 	"path/filepath"
 	"raidhub/packages/bungie"
+	"raidhub/packages/config"
 	"raidhub/packages/postgres"
 	"time"
 
-	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -29,13 +29,11 @@ var (
 
 func main() {
 	flag.Parse()
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
-	}
+	config.Load()
 
 	var sqlitePath string
 	if !*fromDisk {
-		manifest, err := bungie.GetDestinyManifest()
+		manifest, err := bungie.Default().GetDestinyManifest(context.Background())
 		if err != nil {
 			log.Fatal("get manifest: ", err)
 		}
@@ -4,13 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
 	"sync"
 	"time"
 
+	"raidhub/packages/config"
 	"raidhub/packages/discord"
-	"raidhub/packages/monitoring"
-	"raidhub/packages/pgcr"
 
 	"golang.org/x/time/rate"
 )
@@ -23,13 +21,13 @@ var (
 
 func getAtlasWebhookURL() string {
 	once.Do(func() {
-		_atlasWebhookURL = os.Getenv("ATLAS_WEBHOOK_URL")
+		_atlasWebhookURL = config.Load().Discord.AtlasWebhookURL
 	})
 	return _atlasWebhookURL
 }
 
 func handlePanic(r interface{}) {
-	content := fmt.Sprintf("<@&%s>", os.Getenv("ALERTS_ROLE_ID"))
+	content := fmt.Sprintf("<@&%s>", config.Load().Discord.AlertsRoleId)
 	webhook := discord.Webhook{
 		Content: &content,
 		Embeds: []discord.Embed{{
@@ -84,9 +82,7 @@ func logIntervalState(medianLag float64, countWorkers int, percentNotFound float
 	log.Printf("Info: Head is behind by %1.f seconds with %.3f%% not found using %d workers ", medianLag, percentNotFound, countWorkers)
 }
 
-func logWorkersStarting(numWorkers int, period int, latestId int64) {
-	monitoring.ActiveWorkers.Set(float64(numWorkers))
-
+func logWorkersStarting(numWorkers int, latestId int64) {
 	webhook := discord.Webhook{
 		Embeds: []discord.Embed{{
 			Title: "Workers Starting",
@@ -94,9 +90,6 @@ func logWorkersStarting(numWorkers int, period int, latestId int64) {
 			Fields: []discord.Field{{
 				Name:  "Count",
 				Value: fmt.Sprintf("%d", numWorkers),
-			}, {
-				Name:  "Period",
-				Value: fmt.Sprintf("%d", period),
 			}, {
 				Name:  "Current Instance Id",
 				Value: fmt.Sprintf("`%d`", latestId),
@@ -110,8 +103,6 @@ func logWorkersStarting(numWorkers int, period int, latestId int64) {
 }
 
 func logMissedInstance(instanceId int64, startTime time.Time) {
-	pgcr.WriteMissedLog(instanceId)
-
 	elapsed := time.Since(startTime).Seconds()
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"raidhub/packages/postgres"
+)
+
+// Checkpoint tracks which instance ids are still in flight so that Atlas can resume
+// from a low water mark: every id at or below it has been resolved, logged as missed, or offloaded
+type Checkpoint struct {
+	mu         sync.Mutex
+	dispatched int64
+	pending    map[int64]bool
+	offloaded  map[int64]bool
+}
+
+func NewCheckpoint(lowWaterMark int64, offloaded []int64) *Checkpoint {
+	c := &Checkpoint{
+		dispatched: lowWaterMark,
+		pending:    make(map[int64]bool),
+		offloaded:  make(map[int64]bool),
+	}
+	for _, id := range offloaded {
+		c.offloaded[id] = true
+	}
+	return c
+}
+
+// Dispatch marks an instance id as handed to a worker
+func (c *Checkpoint) Dispatch(instanceId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[instanceId] = true
+	if instanceId > c.dispatched {
+		c.dispatched = instanceId
+	}
+}
+
+// Resolve marks an instance id as stored, non-raid, or logged as missed
+func (c *Checkpoint) Resolve(instanceId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, instanceId)
+}
+
+// Offload marks an instance id as handed from a worker to the offload worker
+func (c *Checkpoint) Offload(instanceId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, instanceId)
+	c.offloaded[instanceId] = true
+}
+
+// Release marks an offloaded instance id as finished by the offload worker
+func (c *Checkpoint) Release(instanceId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.offloaded, instanceId)
+}
+
+// Returns the low water mark along with the offloaded ids at or below it. Offloaded ids above
+// the mark are omitted because they will be crawled again when resuming.
+func (c *Checkpoint) Snapshot() (int64, []int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lowWaterMark := c.dispatched
+	for id := range c.pending {
+		if id-1 < lowWaterMark {
+			lowWaterMark = id - 1
+		}
+	}
+
+	offloaded := make([]int64, 0, len(c.offloaded))
+	for id := range c.offloaded {
+		if id <= lowWaterMark {
+			offloaded = append(offloaded, id)
+		}
+	}
+	sort.Slice(offloaded, func(i, j int) bool {
+		return offloaded[i] < offloaded[j]
+	})
+
+	return lowWaterMark, offloaded
+}
+
+func (c *Checkpoint) Save(db *sql.DB) error {
+	lowWaterMark, offloaded := c.Snapshot()
+	return postgres.SaveAtlasCheckpoint(db, lowWaterMark, offloaded)
+}
+
+func checkpointWorker(c *Checkpoint, db *sql.DB) {
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := c.Save(db); err != nil {
+			log.Printf("Failed to save checkpoint: %s", err)
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
+import "time"
+
 const (
 	minWorkers = 5
 	maxWorkers = 200
 
 	retryDelayTime = 5500
+
+	checkpointInterval = 15 * time.Second
+
+	nonRaidBatchSize     = 1000
+	nonRaidFlushInterval = 5 * time.Second
 )
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// A Controller picks the next worker count from the current worker count and signals.
+// Implementations must be pure functions of their inputs so they can be tuned offline.
+type Controller interface {
+	Next(workers int, signals Signals) int
+}
+
+func NewController(name string) (Controller, error) {
+	switch name {
+	case "default":
+		return DefaultController{
+			LagTarget:        20,
+			NotFoundTarget:   0.025,
+			DecreaseExponent: 0.88,
+			DecreaseScale:    retryDelayTime / 8,
+			MaxDecrease:      0.65,
+		}, nil
+	case "proportional":
+		return ProportionalController{
+			NotFoundTarget: 0.025,
+			Gain:           4,
+			MaxStep:        0.5,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown controller: %s", name)
+	}
+}
+
+// DefaultController spikes the workers up while there are no 404s to catch up to live,
+// then backs off with a power law once 404s appear
+type DefaultController struct {
+	LagTarget        float64
+	NotFoundTarget   float64
+	DecreaseExponent float64
+	DecreaseScale    float64
+	MaxDecrease      float64
+}
+
+func (c DefaultController) Next(workers int, signals Signals) int {
+	if signals.NotFoundFraction == 0 {
+		// If we aren't getting 404's, just spike the workers up to ensure we catch up to live ASAP
+		return int(math.Ceil(float64(workers) * (1 + (signals.Lag-c.LagTarget)/100)))
+	}
+
+	adjf := signals.NotFoundFraction - c.NotFoundTarget // do not let workers go below the target
+	if adjf == 0 {
+		return workers
+	}
+	decreaseFraction := math.Pow(c.DecreaseScale*math.Abs(adjf), c.DecreaseExponent) / 100
+	if decreaseFraction > c.MaxDecrease {
+		decreaseFraction = c.MaxDecrease
+	}
+	sign := adjf / math.Abs(adjf)
+	return int(math.Round(float64(workers) - sign*decreaseFraction*float64(workers)))
+}
+
+// ProportionalController moves the worker count in proportion to the distance of the
+// 404 fraction from its target, bounded by MaxStep in either direction
+type ProportionalController struct {
+	NotFoundTarget float64
+	Gain           float64
+	MaxStep        float64
+}
+
+func (c ProportionalController) Next(workers int, signals Signals) int {
+	step := c.Gain * (c.NotFoundTarget - signals.NotFoundFraction) / c.NotFoundTarget
+	if step > c.MaxStep {
+		step = c.MaxStep
+	} else if step < -c.MaxStep {
+		step = -c.MaxStep
+	}
+
+	newWorkers := int(math.Round(float64(workers) * (1 + step)))
+	if newWorkers == workers && step > 0 {
+		newWorkers++
+	} else if newWorkers == workers && step < 0 {
+		newWorkers--
+	}
+
+	return newWorkers
+}
+
+// Keeps a worker count picked by a controller within the bounds of the pool
+func clampWorkers(n int) int {
+	if n > maxWorkers {
+		return maxWorkers
+	} else if n < minWorkers {
+		return minWorkers
+	}
+	return n
+}
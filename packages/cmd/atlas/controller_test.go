@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestDefaultControllerNext(t *testing.T) {
+	controller, err := NewController("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		workers int
+		signals Signals
+		want    int
+	}{
+		{"no 404s at the lag target holds", 100, Signals{Lag: 20, NotFoundFraction: 0}, 100},
+		{"no 404s behind live spikes up", 100, Signals{Lag: 70, NotFoundFraction: 0}, 150},
+		{"no 404s ahead of the lag target backs off", 100, Signals{Lag: 0, NotFoundFraction: 0}, 80},
+		{"404s at the target holds", 100, Signals{Lag: 30, NotFoundFraction: 0.025}, 100},
+		{"404s just under the target grows slowly", 100, Signals{Lag: 30, NotFoundFraction: 0.02}, 103},
+		{"404s just over the target shrinks slowly", 100, Signals{Lag: 30, NotFoundFraction: 0.03}, 97},
+		{"mostly 404s shrinks by at most MaxDecrease", 100, Signals{Lag: 30, NotFoundFraction: 0.5}, 35},
+		{"only 404s shrinks by at most MaxDecrease", 100, Signals{Lag: 30, NotFoundFraction: 1}, 35},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := controller.Next(tt.workers, tt.signals); got != tt.want {
+				t.Errorf("Next(%d, %+v) = %d, want %d", tt.workers, tt.signals, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProportionalControllerNext(t *testing.T) {
+	controller, err := NewController("proportional")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		workers int
+		signals Signals
+		want    int
+	}{
+		{"at the target holds", 100, Signals{NotFoundFraction: 0.025}, 100},
+		{"no 404s grows by at most MaxStep", 100, Signals{NotFoundFraction: 0}, 150},
+		{"double the target shrinks by at most MaxStep", 100, Signals{NotFoundFraction: 0.05}, 50},
+		{"only 404s shrinks by at most MaxStep", 100, Signals{NotFoundFraction: 1}, 50},
+		{"slightly over the target shrinks proportionally", 100, Signals{NotFoundFraction: 0.0255}, 92},
+		{"slightly under the target grows proportionally", 100, Signals{NotFoundFraction: 0.0245}, 108},
+		{"a step too small to round still grows by one", 5, Signals{NotFoundFraction: 0.0249}, 6},
+		{"a step too small to round still shrinks by one", 5, Signals{NotFoundFraction: 0.0251}, 4},
+		{"lag is ignored", 100, Signals{Lag: 10000, NotFoundFraction: 0.025}, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := controller.Next(tt.workers, tt.signals); got != tt.want {
+				t.Errorf("Next(%d, %+v) = %d, want %d", tt.workers, tt.signals, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClampWorkers(t *testing.T) {
+	tests := []struct {
+		n    int
+		want int
+	}{
+		{-10, minWorkers},
+		{0, minWorkers},
+		{minWorkers, minWorkers},
+		{50, 50},
+		{maxWorkers, maxWorkers},
+		{maxWorkers + 1, maxWorkers},
+	}
+	for _, tt := range tests {
+		if got := clampWorkers(tt.n); got != tt.want {
+			t.Errorf("clampWorkers(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestNewControllerUnknown(t *testing.T) {
+	if _, err := NewController("unknown"); err == nil {
+		t.Error("expected an error for an unknown controller")
+	}
+}
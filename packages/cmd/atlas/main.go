@@ -1,37 +1,41 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"flag"
-	"fmt"
 	"log"
-	"math"
-	"net/http"
-	"net/url"
-	"strconv"
-	"sync"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/joho/godotenv"
-
+	"raidhub/packages/config"
 	"raidhub/packages/monitoring"
 	"raidhub/packages/postgres"
-	"raidhub/packages/rabbit"
 )
 
 var (
-	numWorkers       = flag.Int("workers", 50, "number of workers to spawn at the start")
-	buffer           = flag.Int64("buffer", 10_000, "number of ids to start behind last added")
-	targetInstanceId = flag.Int64("target", -1, "specific instance id to start at (optional)")
-	workers          = 0
-	periodLength     = 50_000
+	numWorkers         = flag.Int("workers", 50, "number of workers to spawn at the start")
+	buffer             = flag.Int64("buffer", 10_000, "number of ids to start behind last added")
+	targetInstanceId   = flag.Int64("target", -1, "specific instance id to start at (optional)")
+	controllerName     = flag.String("controller", "default", "worker controller to use (default, proportional)")
+	prometheusURL      = flag.String("prometheus", "", "prometheus base url to read signals from instead of in-process windows, defaults to PROMETHEUS_URL (optional)")
+	evaluationInterval = flag.Duration("interval", time.Minute, "how often to re-evaluate the number of workers")
+	drainTimeout       = flag.Duration("drain_timeout", 30*time.Second, "how long to let in-flight instances finish when shutting down")
+	workers            = 0
+	crawlStats         = NewCrawlStats(monitoring.PGCRCrawlLagBuckets)
 )
 
 func main() {
 	flag.Parse()
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	cfg := config.Load()
+	if err := cfg.Bungie.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if *prometheusURL == "" {
+		*prometheusURL = cfg.Prometheus.URL
 	}
 
 	workers = *numWorkers
@@ -39,6 +43,16 @@ func main() {
 		log.Fatalln("Invalid flags")
 	}
 
+	controller, err := NewController(*controllerName)
+	if err != nil {
+		log.Fatalf("Invalid flags: %s", err)
+	}
+
+	var signals SignalSource = windowSource{stats: crawlStats}
+	if *prometheusURL != "" {
+		signals = prometheusSource{baseURL: *prometheusURL, fallback: signals}
+	}
+
 	db, err := postgres.Connect()
 	if err != nil {
 		log.Fatalf("Error connecting to the database: %s", err)
@@ -46,8 +60,13 @@ func main() {
 	defer db.Close()
 
 	var instanceId int64
+	var offloaded []int64
 	if *targetInstanceId == -1 {
-		instanceId, err = postgres.GetLatestInstanceId(db, *buffer)
+		instanceId, offloaded, err = postgres.GetAtlasCheckpoint(db)
+		if err == sql.ErrNoRows {
+			log.Println("No checkpoint found, starting behind the latest instance id")
+			instanceId, err = postgres.GetLatestInstanceId(db, *buffer)
+		}
 		if err != nil {
 			log.Fatalf("Error getting latest instance id: %s", err)
 		}
@@ -55,171 +74,134 @@ func main() {
 		instanceId = *targetInstanceId
 	}
 
-	monitoring.RegisterPrometheus(8080)
+	monitoring.RegisterPrometheus(cfg.Prometheus.Port(8080))
 
-	run(instanceId, db)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	run(ctx, instanceId, offloaded, controller, signals, db)
 }
 
-func run(latestId int64, db *sql.DB) {
+// Crawls until ctx is cancelled
+func run(ctx context.Context, latestId int64, offloaded []int64, controller Controller, signals SignalSource, db *sql.DB) {
 	defer func() {
 		if r := recover(); r != nil {
 			handlePanic(r)
 		}
 	}()
 
-	conn, err := rabbit.Init()
-	if err != nil {
-		log.Fatalf("Failed to create connection: %s", err)
-	}
-	defer rabbit.Cleanup()
-
-	rabbitChannel, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("Failed to create channel: %s", err)
-	}
-	defer rabbitChannel.Close()
-
 	consumerConfig := ConsumerConfig{
 		LatestId:       latestId,
 		OffloadChannel: make(chan int64),
-		RabbitChannel:  rabbitChannel,
+		Checkpoint:     NewCheckpoint(latestId, offloaded),
 	}
+	consumerConfig.NonRaids = NewNonRaidWriter(consumerConfig.Checkpoint, db)
+	go consumerConfig.NonRaids.Run()
 
 	sendStartUpAlert()
 
 	// Start a goroutine to offload malformed or slowly resolving PGCRs
-	go offloadWorker(consumerConfig.OffloadChannel, consumerConfig.RabbitChannel, db)
+	go offloadWorker(consumerConfig.OffloadChannel, consumerConfig.Checkpoint, db)
 
-	for {
-		workers = spawnWorkers(workers, db, &consumerConfig)
+	// Resume the offloaded ids which were still in flight at the last checkpoint
+	if len(offloaded) > 0 {
+		log.Printf("Resuming %d offloaded instance ids", len(offloaded))
+		go func() {
+			for _, id := range offloaded {
+				consumerConfig.OffloadChannel <- id
+			}
+		}()
 	}
 
-}
+	// A run from -target is one-off and must not move the resume point of the regular crawl
+	saveCheckpoint := *targetInstanceId == -1
+	if saveCheckpoint {
+		go checkpointWorker(consumerConfig.Checkpoint, db)
+	}
 
-func spawnWorkers(countWorkers int, db *sql.DB, consumerConfig *ConsumerConfig) int {
-	var wg sync.WaitGroup
 	ids := make(chan int64, 5)
-
-	logWorkersStarting(countWorkers, periodLength, consumerConfig.LatestId)
-
-	for i := 0; i < countWorkers; i++ {
-		wg.Add(1)
-		go Worker(&wg, ids, consumerConfig.OffloadChannel, consumerConfig.RabbitChannel, db)
-	}
+	pool := NewWorkerPool(func(stop <-chan struct{}) {
+		Worker(ids, stop, consumerConfig.OffloadChannel, consumerConfig.Checkpoint, consumerConfig.NonRaids, db)
+	})
+	pool.Resize(workers)
+	logWorkersStarting(workers, consumerConfig.LatestId)
+
+	evaluating := make(chan struct{})
+	go func() {
+		defer close(evaluating)
+		evaluateWorkers(ctx, pool, controller, signals, &consumerConfig)
+	}()
 
 	// Pass IDs to workers
-	for i := 0; i < periodLength; i++ {
-		consumerConfig.LatestId++
-		ids <- consumerConfig.LatestId
-	}
-
-	close(ids)
-	wg.Wait()
-
-	medianLag, err := execQuery(`histogram_quantile(0.20, sum(rate(pgcr_crawl_summary_lag_bucket[2m])) by (le))`, 3)
-	if err != nil {
-		log.Fatal(err)
-	} else if medianLag == -1 {
-		medianLag = 900
-	}
-
-	fractionNotFound, err := get404Fraction(4)
-	if err != nil {
-		log.Fatal(err)
+	for {
+		id := atomic.AddInt64(&consumerConfig.LatestId, 1)
+		consumerConfig.Checkpoint.Dispatch(id)
+		select {
+		case ids <- id:
+		case <-ctx.Done():
+			<-evaluating
+			shutdown(pool, consumerConfig.Checkpoint, consumerConfig.NonRaids, saveCheckpoint, db)
+			return
+		}
 	}
+}
 
-	logIntervalState(medianLag, countWorkers, fractionNotFound*100)
+// Stops the workers, giving their in-flight instances until the drain timeout to finish, stores the batched non-raids, and saves a final checkpoint if save is set.
+// Whatever is still unfinished stays above the low water mark and is crawled again on the next start.
+func shutdown(pool *WorkerPool, checkpoint *Checkpoint, nonRaids *NonRaidWriter, save bool, db *sql.DB) {
+	log.Println("Shutting down, waiting for in-flight instances")
 
-	newWorkers := 0
-	if fractionNotFound == 0 {
-		// how much we expect to get catch up
-		periodLength = int(math.Round(math.Pow(float64(countWorkers)*(math.Ceil(medianLag)-20.0), 0.824)))
-		if periodLength < 10_000 {
-			periodLength = 10_000
-		}
-		// If we aren't getting 404's, just spike the workers up to ensure we catch up to live ASAP
-		newWorkers = int(math.Ceil(float64(countWorkers) * (1 + float64(medianLag-20)/100)))
+	stopped := make(chan struct{})
+	go func() {
+		pool.Stop()
+		close(stopped)
+	}()
 
-	} else {
-		adjf := fractionNotFound - 0.025 // do not let workers go below 2.5 %
-		decreaseFraction := math.Pow(retryDelayTime/8*math.Abs(adjf), 0.88) / 100
-		if decreaseFraction > 0.65 {
-			decreaseFraction = 0.65
-		}
-		sign := adjf / math.Abs(adjf)
-		// Adjust number of workers for the next period
-		newWorkers = int(math.Round(float64(countWorkers) - sign*decreaseFraction*float64(countWorkers)))
-		periodLength = 1000 * newWorkers
+	select {
+	case <-stopped:
+	case <-time.After(*drainTimeout):
+		log.Println("Timed out waiting for in-flight instances")
 	}
+	nonRaids.Close()
 
-	if newWorkers > maxWorkers {
-		newWorkers = maxWorkers
-	} else if newWorkers < minWorkers {
-		newWorkers = minWorkers
+	if !save {
+		return
 	}
-	return newWorkers
-}
-
-func get404Fraction(intervalMins int) (float64, error) {
-	f, err := execQuery(fmt.Sprintf(`sum(rate(pgcr_crawl_summary_status{status="3"}[%dm])) / sum(rate(pgcr_crawl_summary_status{}[%dm]))`, intervalMins, intervalMins), intervalMins)
-	if err != nil || f == -1 {
-		return 0, err
+	if err := checkpoint.Save(db); err != nil {
+		log.Printf("Failed to save checkpoint: %s", err)
 	} else {
-		return f, err
+		lowWaterMark, _ := checkpoint.Snapshot()
+		log.Printf("Saved checkpoint at %d", lowWaterMark)
 	}
 }
 
-func execQuery(query string, intervalMins int) (float64, error) {
-	params := url.Values{}
-	params.Add("query", query)
-	params.Add("start", time.Now().Add(time.Duration(-intervalMins)*time.Minute).Format(time.RFC3339))
-	params.Add("end", time.Now().Format(time.RFC3339))
-	params.Add("step", "1m")
-
-	client := http.Client{
-		Timeout: time.Second * 10,
-	}
+// Periodically re-evaluates the size of the worker pool while ids keep flowing, until ctx is cancelled
+func evaluateWorkers(ctx context.Context, pool *WorkerPool, controller Controller, signals SignalSource, consumerConfig *ConsumerConfig) {
+	ticker := time.NewTicker(*evaluationInterval)
+	defer ticker.Stop()
 
-	url := fmt.Sprintf("http://localhost:9090/api/v1/query_range?%s", params.Encode())
-
-	resp, err := client.Get(url)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
-
-	decoder := json.NewDecoder(resp.Body)
-
-	var res monitoring.QueryRangeResponse
-	err = decoder.Decode(&res)
-	if err != nil {
-		return 0, err
-	}
-
-	// Creates a weighted average over the interval
-	c := 0
-	s := 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
-	if len(res.Data.Result) == 0 {
-		return -1, nil
-	}
+		countWorkers := pool.Size()
 
-	for idx, y := range res.Data.Result[0].Values {
-		val, err := strconv.ParseFloat(y[1].(string), 64)
+		signal, err := signals.Read()
 		if err != nil {
-			log.Fatal(err)
-		}
-		if math.IsNaN(val) {
+			log.Printf("Failed to read signals: %s", err)
 			continue
 		}
-		c += (idx + 1)
-		s += float64(idx+1) * val
-	}
 
-	if c == 0 {
-		c = 1
-	}
+		logIntervalState(signal.Lag, countWorkers, signal.NotFoundFraction*100)
 
-	return s / float64(c), nil
+		newWorkers := clampWorkers(controller.Next(countWorkers, signal))
+
+		if newWorkers != countWorkers {
+			pool.Resize(newWorkers)
+			logWorkersStarting(newWorkers, atomic.LoadInt64(&consumerConfig.LatestId))
+		}
+	}
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"raidhub/packages/pgcr"
+)
+
+// NonRaidWriter batches the non-raids found by the workers so that the crawl doesn't wait on a write per id.
+// Ids stay pending in the checkpoint until their batch is stored, so a crash can't move the low water mark past them.
+type NonRaidWriter struct {
+	mu         sync.Mutex
+	ids        []int64
+	full       chan struct{}
+	stop       chan struct{}
+	done       chan struct{}
+	checkpoint *Checkpoint
+	store      func(ids []int64) error
+}
+
+func NewNonRaidWriter(checkpoint *Checkpoint, db *sql.DB) *NonRaidWriter {
+	return &NonRaidWriter{
+		full:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		checkpoint: checkpoint,
+		store: func(ids []int64) error {
+			return pgcr.StoreNonRaids(ids, db)
+		},
+	}
+}
+
+// Add queues a non-raid instance id, which the writer resolves in the checkpoint once it is stored
+func (w *NonRaidWriter) Add(instanceId int64) {
+	w.mu.Lock()
+	w.ids = append(w.ids, instanceId)
+	full := len(w.ids) >= nonRaidBatchSize
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run stores the queued ids every flush interval, or sooner once a batch fills, until Close
+func (w *NonRaidWriter) Run() {
+	defer close(w.done)
+	ticker := time.NewTicker(nonRaidFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.full:
+		case <-w.stop:
+			w.flush()
+			return
+		}
+		w.flush()
+	}
+}
+
+// Close stores whatever is still queued. Ids added afterwards are never stored and stay pending in the checkpoint.
+func (w *NonRaidWriter) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *NonRaidWriter) flush() {
+	w.mu.Lock()
+	ids := w.ids
+	w.ids = nil
+	w.mu.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+	if err := w.store(ids); err != nil {
+		log.Printf("Failed to record %d non-raids: %s", len(ids), err)
+		// Put them back to retry with the next batch
+		w.mu.Lock()
+		w.ids = append(ids, w.ids...)
+		w.mu.Unlock()
+		return
+	}
+	for _, id := range ids {
+		w.checkpoint.Resolve(id)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNonRaidWriter(t *testing.T) {
+	checkpoint := NewCheckpoint(0, nil)
+	for id := int64(1); id <= 4; id++ {
+		checkpoint.Dispatch(id)
+	}
+	var stored []int64
+	fail := true
+	w := NewNonRaidWriter(checkpoint, nil)
+	w.store = func(ids []int64) error {
+		if fail {
+			return errors.New("database is down")
+		}
+		stored = append(stored, ids...)
+		return nil
+	}
+
+	w.Add(1)
+	w.Add(2)
+	checkpoint.Resolve(3)
+	w.flush()
+	if lowWaterMark, _ := checkpoint.Snapshot(); lowWaterMark != 0 {
+		t.Errorf("low water mark moved to %d before the non-raids were stored", lowWaterMark)
+	}
+
+	// The failed batch is retried with the ids added since
+	fail = false
+	w.Add(4)
+	w.flush()
+	if fmt.Sprint(stored) != "[1 2 4]" {
+		t.Errorf("stored %v", stored)
+	}
+	if lowWaterMark, _ := checkpoint.Snapshot(); lowWaterMark != 4 {
+		t.Errorf("low water mark is %d once every id is resolved, want 4", lowWaterMark)
+	}
+}
+
+func TestNonRaidWriterClose(t *testing.T) {
+	checkpoint := NewCheckpoint(0, nil)
+	checkpoint.Dispatch(1)
+	var stored []int64
+	w := NewNonRaidWriter(checkpoint, nil)
+	w.store = func(ids []int64) error {
+		stored = append(stored, ids...)
+		return nil
+	}
+	go w.Run()
+
+	w.Add(1)
+	w.Close()
+	if fmt.Sprint(stored) != "[1]" {
+		t.Errorf("stored %v on close", stored)
+	}
+	if lowWaterMark, _ := checkpoint.Snapshot(); lowWaterMark != 1 {
+		t.Errorf("low water mark is %d, want 1", lowWaterMark)
+	}
+}
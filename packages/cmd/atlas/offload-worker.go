@@ -1,35 +1,34 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
-	"net/http"
-	"os"
 	"time"
 
-	"raidhub/packages/monitoring"
+	"raidhub/packages/bungie"
+	"raidhub/packages/bungie/health"
 	"raidhub/packages/pgcr"
-
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func offloadWorker(ch chan int64, rabbitChannel *amqp.Channel, db *sql.DB) {
-	securityKey := os.Getenv("BUNGIE_API_KEY")
-
-	client := &http.Client{}
+func offloadWorker(ch chan int64, checkpoint *Checkpoint, db *sql.DB) {
+	client := bungie.Default()
 
 	for id := range ch {
 		// Spawn a worker for each instanceId
+		checkpoint.Offload(id)
 		go func(instanceId int64) {
+			defer checkpoint.Release(instanceId)
 			log.Printf("Offloading instanceId %d", instanceId)
 			startTime := time.Now()
+			var lastResult pgcr.PGCRResult
 			for i := 1; i <= 5; i++ {
-				result, activity, raw, err := pgcr.FetchAndProcessPGCR(client, instanceId, securityKey)
+				result, activity, raw, err := pgcr.FetchAndProcessPGCR(context.Background(), client, instanceId)
+				lastResult = result
 
-				statusStr := fmt.Sprintf("%d", result)
 				attemptsStr := fmt.Sprintf("%d", -i)
-				monitoring.PGCRCrawlStatus.WithLabelValues(statusStr, attemptsStr).Inc()
+				crawlStats.ObserveStatus(result, attemptsStr)
 
 				if err != nil {
 					log.Println(err)
@@ -37,21 +36,30 @@ func offloadWorker(ch chan int64, rabbitChannel *amqp.Channel, db *sql.DB) {
 
 				if result == pgcr.NonRaid {
 					log.Printf("[Offload Worker] Found non-raid raid with instanceId %d", instanceId)
+					if err := pgcr.StoreNonRaid(instanceId, db); err != nil {
+						log.Printf("[Offload Worker] Failed to record non-raid instanceId %d: %s", instanceId, err)
+					}
+					resolveMissed(db, instanceId)
 					return
 				} else if result == pgcr.Success {
-					lag, committed, err := pgcr.StorePGCR(activity, raw, db, rabbitChannel)
+					lag, committed, err := pgcr.StorePGCR(context.Background(), activity, raw, db)
 					endTime := time.Now()
 					if err != nil {
+						lastResult = pgcr.StoreFailed
 						log.Println(err)
 					} else if committed {
 						log.Printf("[Offload Worker] Added PGCR with instanceId %d (%d, %.0f, %.0f)", instanceId, i, endTime.Sub(startTime).Seconds(), lag.Seconds())
+						resolveMissed(db, instanceId)
 						return
 					} else {
 						log.Printf("[Offload Worker] Found duplicate raid with instanceId %d (%d, %.0f, %.0f)", instanceId, i, endTime.Sub(startTime).Seconds(), lag.Seconds())
+						resolveMissed(db, instanceId)
+						return
 					}
 				} else if result == pgcr.SystemDisabled {
 					i--
-					time.Sleep(60 * time.Second)
+					health.Default().ReportDisabled(health.Destiny2)
+					health.Default().Wait(context.Background(), health.Destiny2)
 					continue
 				}
 
@@ -62,6 +70,7 @@ func offloadWorker(ch chan int64, rabbitChannel *amqp.Channel, db *sql.DB) {
 				// Exponential Backoff
 				time.Sleep(time.Duration(10*i*i) * time.Second)
 			}
+			recordMissed(db, instanceId, lastResult)
 			go logMissedInstance(instanceId, startTime)
 
 		}(id)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+
+	"raidhub/packages/monitoring"
+)
+
+// WorkerPool is a long-lived set of workers whose size can be changed while ids keep flowing.
+// Scaling down signals the newest workers to exit once they finish their current instance.
+type WorkerPool struct {
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+	stops []chan struct{}
+	work  func(stop <-chan struct{})
+}
+
+func NewWorkerPool(work func(stop <-chan struct{})) *WorkerPool {
+	return &WorkerPool{
+		work: work,
+	}
+}
+
+// Returns the number of workers the pool is scaled to, which may briefly differ from
+// the number of running workers while stopped workers finish their current instance
+func (p *WorkerPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.stops)
+}
+
+func (p *WorkerPool) Resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.stops) < n {
+		stop := make(chan struct{})
+		p.stops = append(p.stops, stop)
+		p.wg.Add(1)
+		monitoring.ActiveWorkers.Inc()
+		go func() {
+			defer p.wg.Done()
+			defer monitoring.ActiveWorkers.Dec()
+			p.work(stop)
+		}()
+	}
+
+	for len(p.stops) > n {
+		last := len(p.stops) - 1
+		close(p.stops[last])
+		p.stops = p.stops[:last]
+	}
+}
+
+// Stops every worker and waits for them to exit
+func (p *WorkerPool) Stop() {
+	p.Resize(0)
+	p.wg.Wait()
+}
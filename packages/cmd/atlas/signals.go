@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"raidhub/packages/monitoring"
+)
+
+const (
+	lagQuantile     = 0.20
+	lagWindow       = 3 * time.Minute
+	notFoundWindow  = 4 * time.Minute
+	defaultLagValue = 900
+)
+
+// Signals are the measurements the controller uses to pick the next worker count
+type Signals struct {
+	Lag              float64
+	NotFoundFraction float64
+}
+
+type SignalSource interface {
+	Read() (Signals, error)
+}
+
+// Computes the signals from the in-process sliding windows
+type windowSource struct {
+	stats *CrawlStats
+}
+
+func (s windowSource) Read() (Signals, error) {
+	lag := s.stats.LagQuantile(lagQuantile, lagWindow)
+	if lag == -1 {
+		lag = defaultLagValue
+	}
+
+	fractionNotFound := s.stats.NotFoundFraction(notFoundWindow)
+	if fractionNotFound == -1 {
+		fractionNotFound = 0
+	}
+
+	return Signals{
+		Lag:              lag,
+		NotFoundFraction: fractionNotFound,
+	}, nil
+}
+
+// Queries the signals from Prometheus, falling back to another source if Prometheus is unavailable
+type prometheusSource struct {
+	baseURL  string
+	fallback SignalSource
+}
+
+func (p prometheusSource) Read() (Signals, error) {
+	medianLag, err := p.execQuery(fmt.Sprintf(`histogram_quantile(%.2f, sum(rate(pgcr_crawl_summary_lag_bucket[2m])) by (le))`, lagQuantile), int(lagWindow.Minutes()))
+	if err != nil {
+		log.Printf("Failed to query lag from Prometheus, using in-process signals: %s", err)
+		return p.fallback.Read()
+	} else if medianLag == -1 {
+		medianLag = defaultLagValue
+	}
+
+	fractionNotFound, err := p.get404Fraction(int(notFoundWindow.Minutes()))
+	if err != nil {
+		log.Printf("Failed to query 404 fraction from Prometheus, using in-process signals: %s", err)
+		return p.fallback.Read()
+	}
+
+	return Signals{
+		Lag:              medianLag,
+		NotFoundFraction: fractionNotFound,
+	}, nil
+}
+
+func (p prometheusSource) get404Fraction(intervalMins int) (float64, error) {
+	f, err := p.execQuery(fmt.Sprintf(`sum(rate(pgcr_crawl_summary_status{status="3"}[%dm])) / sum(rate(pgcr_crawl_summary_status{}[%dm]))`, intervalMins, intervalMins), intervalMins)
+	if err != nil || f == -1 {
+		return 0, err
+	} else {
+		return f, err
+	}
+}
+
+func (p prometheusSource) execQuery(query string, intervalMins int) (float64, error) {
+	params := url.Values{}
+	params.Add("query", query)
+	params.Add("start", time.Now().Add(time.Duration(-intervalMins)*time.Minute).Format(time.RFC3339))
+	params.Add("end", time.Now().Format(time.RFC3339))
+	params.Add("step", "1m")
+
+	client := http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	url := fmt.Sprintf("%s/api/v1/query_range?%s", p.baseURL, params.Encode())
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+
+	var res monitoring.QueryRangeResponse
+	err = decoder.Decode(&res)
+	if err != nil {
+		return 0, err
+	}
+
+	// Creates a weighted average over the interval
+	c := 0
+	s := 0.0
+
+	if len(res.Data.Result) == 0 {
+		return -1, nil
+	}
+
+	for idx, y := range res.Data.Result[0].Values {
+		str, ok := y[1].(string)
+		if !ok {
+			return 0, fmt.Errorf("unexpected value in query result: %v", y[1])
+		}
+		val, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return 0, err
+		}
+		if math.IsNaN(val) {
+			continue
+		}
+		c += (idx + 1)
+		s += float64(idx+1) * val
+	}
+
+	if c == 0 {
+		c = 1
+	}
+
+	return s / float64(c), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"raidhub/packages/monitoring"
+	"raidhub/packages/pgcr"
+)
+
+func TestWindowSourceEmpty(t *testing.T) {
+	signals, err := windowSource{stats: NewCrawlStats(monitoring.PGCRCrawlLagBuckets)}.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Signals{Lag: defaultLagValue, NotFoundFraction: 0}); signals != want {
+		t.Errorf("Read() = %+v, want %+v", signals, want)
+	}
+}
+
+func TestWindowSource(t *testing.T) {
+	stats := NewCrawlStats(monitoring.PGCRCrawlLagBuckets)
+	for i := 0; i < 3; i++ {
+		stats.ObserveStatus(pgcr.NotFound, "1")
+	}
+	stats.ObserveStatus(pgcr.Success, "1")
+	for i := 0; i < 10; i++ {
+		stats.ObserveLag(pgcr.Success, "1", 20)
+	}
+
+	signals, err := windowSource{stats: stats}.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 20th percentile of 10 lags in the 15-25s bucket is interpolated 2/10 of the way through it
+	if want := (Signals{Lag: 17, NotFoundFraction: 0.75}); signals != want {
+		t.Errorf("Read() = %+v, want %+v", signals, want)
+	}
+}
+
+// Serves query_range results, value is called with each query
+func prometheus(t *testing.T, value func(query string) string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query_range" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		v := value(r.URL.Query().Get("query"))
+		if v == "" {
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"values":[[1,"NaN"],[2,%q],[3,%q]]}]}}`, v, v)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPrometheusSource(t *testing.T) {
+	server := prometheus(t, func(query string) string {
+		if strings.Contains(query, "histogram_quantile") {
+			return "30"
+		}
+		return "0.1"
+	})
+
+	signals, err := prometheusSource{baseURL: server.URL, fallback: failingSource{}}.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Signals{Lag: 30, NotFoundFraction: 0.1}); signals != want {
+		t.Errorf("Read() = %+v, want %+v", signals, want)
+	}
+}
+
+func TestPrometheusSourceNoData(t *testing.T) {
+	server := prometheus(t, func(query string) string {
+		return ""
+	})
+
+	signals, err := prometheusSource{baseURL: server.URL, fallback: failingSource{}}.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Signals{Lag: defaultLagValue, NotFoundFraction: 0}); signals != want {
+		t.Errorf("Read() = %+v, want %+v", signals, want)
+	}
+}
+
+func TestPrometheusSourceFallback(t *testing.T) {
+	fallback := fixedSource{Signals{Lag: 42, NotFoundFraction: 0.2}}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	// Only the 404 fraction query fails
+	partial := prometheus(t, func(query string) string {
+		if strings.Contains(query, "histogram_quantile") {
+			return "30"
+		}
+		return "not a number"
+	})
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	for name, url := range map[string]string{
+		"error response": failing.URL,
+		"partial":        partial.URL,
+		"unreachable":    unreachable.URL,
+	} {
+		t.Run(name, func(t *testing.T) {
+			signals, err := prometheusSource{baseURL: url, fallback: fallback}.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signals != fallback.signals {
+				t.Errorf("Read() = %+v, want the fallback %+v", signals, fallback.signals)
+			}
+		})
+	}
+}
+
+type fixedSource struct {
+	signals Signals
+}
+
+func (s fixedSource) Read() (Signals, error) {
+	return s.signals, nil
+}
+
+type failingSource struct{}
+
+func (failingSource) Read() (Signals, error) {
+	return Signals{}, fmt.Errorf("fallback used")
+}
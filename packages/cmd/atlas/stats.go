@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"raidhub/packages/monitoring"
+	"raidhub/packages/pgcr"
+)
+
+const (
+	statsResolution = 5 * time.Second
+	statsRetention  = 10 * time.Minute
+)
+
+type statsBucket struct {
+	index    int64
+	statuses map[pgcr.PGCRResult]int
+	total    int
+	lag      []int
+}
+
+// CrawlStats keeps a sliding window of the crawl status and lag events alongside the
+// Prometheus metrics, so Atlas can make decisions without querying Prometheus
+type CrawlStats struct {
+	mu         sync.Mutex
+	buckets    []statsBucket
+	lagBuckets []float64
+}
+
+func NewCrawlStats(lagBuckets []float64) *CrawlStats {
+	return &CrawlStats{
+		buckets:    make([]statsBucket, statsRetention/statsResolution),
+		lagBuckets: lagBuckets,
+	}
+}
+
+// ObserveStatus records the result of a PGCR request
+func (s *CrawlStats) ObserveStatus(result pgcr.PGCRResult, attempts string) {
+	monitoring.PGCRCrawlStatus.WithLabelValues(statusLabel(result), attempts).Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.current(time.Now())
+	b.statuses[result]++
+	b.total++
+}
+
+// ObserveLag records how far behind the end of an activity the crawler found it
+func (s *CrawlStats) ObserveLag(result pgcr.PGCRResult, attempts string, seconds float64) {
+	monitoring.PGCRCrawlLag.WithLabelValues(statusLabel(result), attempts).Observe(seconds)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.current(time.Now())
+	i := 0
+	for i < len(s.lagBuckets) && seconds > s.lagBuckets[i] {
+		i++
+	}
+	b.lag[i]++
+}
+
+// Returns the fraction of requests over the window which were not found, or -1 if there were none
+func (s *CrawlStats) NotFoundFraction(window time.Duration) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notFound := 0
+	total := 0
+	s.each(time.Now(), window, func(b *statsBucket) {
+		notFound += b.statuses[pgcr.NotFound]
+		total += b.total
+	})
+
+	if total == 0 {
+		return -1
+	}
+	return float64(notFound) / float64(total)
+}
+
+// Returns the q-quantile of the lag over the window, interpolated within the histogram
+// buckets the same way as Prometheus' histogram_quantile, or -1 if there were no observations
+func (s *CrawlStats) LagQuantile(q float64, window time.Duration) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make([]int, len(s.lagBuckets)+1)
+	total := 0
+	s.each(time.Now(), window, func(b *statsBucket) {
+		for i, c := range b.lag {
+			counts[i] += c
+			total += c
+		}
+	})
+
+	if total == 0 {
+		return -1
+	}
+
+	rank := q * float64(total)
+	cumulative := 0
+	for i, c := range counts {
+		if float64(cumulative+c) < rank || c == 0 {
+			cumulative += c
+			continue
+		}
+		if i == len(s.lagBuckets) {
+			// +Inf bucket
+			return s.lagBuckets[len(s.lagBuckets)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = s.lagBuckets[i-1]
+		}
+		upper := s.lagBuckets[i]
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(c)
+	}
+
+	return s.lagBuckets[len(s.lagBuckets)-1]
+}
+
+func (s *CrawlStats) current(now time.Time) *statsBucket {
+	index := now.UnixNano() / int64(statsResolution)
+	b := &s.buckets[index%int64(len(s.buckets))]
+	if b.index != index {
+		b.index = index
+		b.statuses = make(map[pgcr.PGCRResult]int)
+		b.total = 0
+		b.lag = make([]int, len(s.lagBuckets)+1)
+	}
+	return b
+}
+
+func (s *CrawlStats) each(now time.Time, window time.Duration, fn func(b *statsBucket)) {
+	latest := now.UnixNano() / int64(statsResolution)
+	earliest := latest - int64(window/statsResolution)
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		if b.statuses != nil && b.index > earliest && b.index <= latest {
+			fn(b)
+		}
+	}
+}
+
+func statusLabel(result pgcr.PGCRResult) string {
+	return fmt.Sprintf("%d", result)
+}
@@ -1,11 +1,10 @@
 package main
 
-import "github.com/rabbitmq/amqp091-go"
-
 type ConsumerConfig struct {
 	LatestId       int64
 	OffloadChannel chan int64
-	RabbitChannel  *amqp091.Channel
+	Checkpoint     *Checkpoint
+	NonRaids       *NonRaidWriter
 }
 
 type WorkerResult struct {
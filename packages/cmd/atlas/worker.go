@@ -1,47 +1,63 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"math/rand"
-	"net/http"
-	"os"
-	"sync"
 	"time"
 
-	"raidhub/packages/monitoring"
+	"raidhub/packages/bungie"
+	"raidhub/packages/bungie/health"
 	"raidhub/packages/pgcr"
-
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func Worker(wg *sync.WaitGroup, ch chan int64, offloadChannel chan int64, rabbitChannel *amqp.Channel, db *sql.DB) {
-	defer wg.Done()
-
-	securityKey := os.Getenv("BUNGIE_API_KEY")
+// Worker crawls ids from the channel until it is stopped while idle or the channel is closed
+func Worker(ch <-chan int64, stop <-chan struct{}, offloadChannel chan int64, checkpoint *Checkpoint, nonRaids *NonRaidWriter, db *sql.DB) {
+	client := bungie.Default()
 
-	client := &http.Client{}
+	// Cancelled when the worker is stopped, so it doesn't wait out an outage
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
 	randomVariation := retryDelayTime / 3
 
-	for instanceID := range ch {
+	for {
+		var instanceID int64
+		var ok bool
+		select {
+		case <-stop:
+			return
+		case instanceID, ok = <-ch:
+			if !ok {
+				return
+			}
+		}
+
 		startTime := time.Now()
 		notFoundCount := 0
 		errCount := 0
 		i := 0
+		resolvedByWriter := false
 
 		for {
 			reqStartTime := time.Now()
-			result, activity, raw, err := pgcr.FetchAndProcessPGCR(client, instanceID, securityKey)
+			result, activity, raw, err := pgcr.FetchAndProcessPGCR(context.Background(), client, instanceID)
 			if err != nil && result != pgcr.NotFound {
 				log.Println(err)
 			}
 
-			statusStr := fmt.Sprintf("%d", result)
 			attemptsStr := fmt.Sprintf("%d", i+1)
 
-			monitoring.PGCRCrawlStatus.WithLabelValues(statusStr, attemptsStr).Inc()
+			crawlStats.ObserveStatus(result, attemptsStr)
 
 			// Handle the result
 			if result == pgcr.NonRaid {
@@ -52,12 +68,15 @@ func Worker(wg *sync.WaitGroup, ch chan int64, offloadChannel chan int64, rabbit
 				endDate := pgcr.CalculateDateCompleted(startDate, raw.Entries[0])
 
 				lag := time.Since(endDate)
-				monitoring.PGCRCrawlLag.WithLabelValues(statusStr, attemptsStr).Observe(float64(lag.Seconds()))
+				crawlStats.ObserveLag(result, attemptsStr, lag.Seconds())
+				// Recorded in batches so argus can tell non-raids apart from gaps
+				nonRaids.Add(instanceID)
+				resolvedByWriter = true
 				break
 			} else if result == pgcr.Success {
-				lag, committed, err := pgcr.StorePGCR(activity, raw, db, rabbitChannel)
+				lag, committed, err := pgcr.StorePGCR(context.Background(), activity, raw, db)
 				if lag != nil {
-					monitoring.PGCRCrawlLag.WithLabelValues(statusStr, attemptsStr).Observe(float64(lag.Seconds()))
+					crawlStats.ObserveLag(result, attemptsStr, lag.Seconds())
 				}
 				if err != nil {
 					errCount++
@@ -78,23 +97,32 @@ func Worker(wg *sync.WaitGroup, ch chan int64, offloadChannel chan int64, rabbit
 			} else if result == pgcr.NotFound {
 				notFoundCount++
 			} else if result == pgcr.SystemDisabled {
-				monitoring.PGCRCrawlLag.WithLabelValues(statusStr, attemptsStr).Observe(0)
-				time.Sleep(45 * time.Second)
+				crawlStats.ObserveLag(result, attemptsStr, 0)
+				health.Default().ReportDisabled(health.Destiny2)
+				if err := health.Default().Wait(ctx, health.Destiny2); err != nil {
+					// Stopped during the outage, which also happens when the pool shrinks. Hand the id to the
+					// offload worker so it is still crawled and the low water mark can move past it.
+					checkpoint.Offload(instanceID)
+					offloadChannel <- instanceID
+					return
+				}
 				continue
 			} else if result == pgcr.InsufficientPrivileges {
 				go logMissedInstance(instanceID, startTime)
 				logInsufficentPrivileges(instanceID)
-				pgcr.WriteMissedLog(instanceID)
+				recordMissed(db, instanceID, result)
 				break
 			} else if result == pgcr.BadFormat {
-				pgcr.WriteMissedLog(instanceID)
+				recordMissed(db, instanceID, result)
+				checkpoint.Offload(instanceID)
 				offloadChannel <- instanceID
 				break
 			}
 
 			// If we have not found the instance id after some time
 			if notFoundCount > 4 || errCount > 3 {
-				pgcr.WriteMissedLog(instanceID)
+				recordMissed(db, instanceID, result)
+				checkpoint.Offload(instanceID)
 				offloadChannel <- instanceID
 				break
 			}
@@ -103,5 +131,21 @@ func Worker(wg *sync.WaitGroup, ch chan int64, offloadChannel chan int64, rabbit
 			time.Sleep(timeout)
 			i++
 		}
+
+		if !resolvedByWriter {
+			checkpoint.Resolve(instanceID)
+		}
+	}
+}
+
+func recordMissed(db *sql.DB, instanceId int64, result pgcr.PGCRResult) {
+	if err := pgcr.WriteMissed(db, instanceId, result); err != nil {
+		log.Printf("Failed to record missed instance %d: %s", instanceId, err)
+	}
+}
+
+func resolveMissed(db *sql.DB, instanceId int64) {
+	if err := pgcr.ResolveMissed(db, instanceId); err != nil {
+		log.Printf("Failed to resolve missed instance %d: %s", instanceId, err)
 	}
 }
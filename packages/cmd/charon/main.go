@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"raidhub/packages/async"
+	"raidhub/packages/rabbit"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	queue   = flag.String("queue", "", "work queue whose dead letters to inspect, e.g. player_requests")
+	limit   = flag.Int("n", 10, "maximum number of dead letters to read")
+	requeue = flag.Bool("requeue", false, "move the dead letters back onto the work queue instead of only printing them")
+	maxBody = flag.Int("max_body", 500, "maximum number of body bytes to print (0 for all)")
+)
+
+func main() {
+	flag.Parse()
+	if *queue == "" {
+		log.Fatalln("-queue is required")
+	}
+
+	client, err := rabbit.Init()
+	if err != nil {
+		log.Fatalf("Error connecting to rabbit: %s", err)
+	}
+	defer rabbit.Cleanup()
+
+	ch, err := client.Channel()
+	if err != nil {
+		log.Fatalf("Failed to create channel: %s", err)
+	}
+	defer ch.Close()
+
+	dead := async.DeadLetterQueue(*queue)
+	q, err := ch.QueueDeclarePassive(dead, true, false, false, false, nil)
+	if err != nil {
+		log.Fatalf("Failed to inspect %s: %s", dead, err)
+	}
+	log.Printf("%s has %d dead letters", dead, q.Messages)
+
+	var held []amqp.Delivery
+	requeued := 0
+	for i := 0; i < *limit; i++ {
+		msg, ok, err := ch.Get(dead, false)
+		if err != nil {
+			log.Fatalf("Failed to read from %s: %s", dead, err)
+		}
+		if !ok {
+			break
+		}
+		printDeadLetter(i, msg)
+
+		if !*requeue {
+			held = append(held, msg)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err = async.Requeue(ctx, *queue, msg)
+		cancel()
+		if err != nil {
+			msg.Nack(false, true)
+			log.Fatalf("Failed to requeue dead letter: %s", err)
+		}
+		if err := msg.Ack(false); err != nil {
+			log.Fatalf("Failed to remove requeued dead letter: %s", err)
+		}
+		requeued++
+	}
+
+	// Return the inspected messages to the dead letter queue
+	if len(held) > 0 {
+		if err := held[len(held)-1].Nack(true, true); err != nil {
+			log.Fatalf("Failed to return dead letters: %s", err)
+		}
+	}
+
+	if *requeue {
+		log.Printf("Requeued %d dead letters onto %s", requeued, *queue)
+	}
+}
+
+func printDeadLetter(i int, msg amqp.Delivery) {
+	body := msg.Body
+	truncated := ""
+	if *maxBody > 0 && len(body) > *maxBody {
+		body = body[:*maxBody]
+		truncated = "..."
+	}
+	log.Printf("[%d] retries=%d\n\t%s%s", i, async.Retries(msg), body, truncated)
+}
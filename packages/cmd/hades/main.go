@@ -2,251 +2,202 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"path/filepath"
-	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	"raidhub/packages/bungie"
+	"raidhub/packages/bungie/health"
+	"raidhub/packages/config"
 	"raidhub/packages/discord"
 	"raidhub/packages/monitoring"
 	"raidhub/packages/pgcr"
 	"raidhub/packages/postgres"
-	"raidhub/packages/rabbit"
-
-	"github.com/rabbitmq/amqp091-go"
 )
 
 const (
 	numWorkers = 100
 )
 
-func main() {
-	cwd, err := os.Getwd()
-	if err != nil {
-		panic(err)
-	}
-
-	monitoring.RegisterPrometheus(9091)
-
-	src := filepath.Join(cwd, "logs", "missed.log")
-	temp := filepath.Join(cwd, "logs", "missed.temp.log")
-
-	_, err = os.Stat(temp)
-	if err != nil {
-		if os.IsNotExist(err) {
-			err = moveFile(src, temp)
-			if err != nil {
-				panic(err)
-			}
-
-			_, err = createFile(src)
-			if err != nil {
-				panic(err)
-			}
-		} else {
-			panic(err)
-		}
-	}
-
-	file, err := os.Open(temp)
-	if err != nil {
-		panic(err)
-	}
-	defer file.Close()
-
-	// Create a map to store unique numbers
-	uniqueNumbers := make(map[int64]bool)
-
-	// Read the file line by line
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		number, err := strconv.ParseInt(line, 10, 64)
-		if err != nil {
-			fmt.Printf("Error parsing line %s: %v\n", line, err)
-			continue
-		}
-		uniqueNumbers[number] = true
-	}
+var (
+	batchSize  = flag.Int("batch", 10_000, "number of due instances to claim at a time")
+	importPath = flag.String("import", "", "import instance ids from a legacy missed.log before running (optional)")
+)
 
-	if err := scanner.Err(); err != nil {
+func main() {
+	flag.Parse()
+	if err := config.Load().Bungie.Validate(); err != nil {
 		log.Fatal(err)
 	}
 
+	monitoring.RegisterPrometheus(config.Load().Prometheus.Port(9091))
+
 	db, err := postgres.Connect()
 	if err != nil {
 		log.Fatalf("Error connecting to the database: %s", err)
 	}
 	defer db.Close()
-	stmnt, err := db.Prepare("SELECT instance_id FROM activity INNER JOIN pgcr USING (instance_id) WHERE instance_id = $1 LIMIT 1;")
-	var numbers []int64
-	for num := range uniqueNumbers {
-		var foo int64
-		err := stmnt.QueryRow(num).Scan(&foo)
+
+	if *importPath != "" {
+		imported, err := importMissedLog(db, *importPath)
 		if err != nil {
-			log.Printf("Preparing %d", num)
-			numbers = append(numbers, num)
-		} else {
-			log.Printf("Skipping %d", num)
+			log.Fatalf("Error importing %s: %s", *importPath, err)
 		}
+		log.Printf("Imported %d instance ids from %s", imported, *importPath)
 	}
 
-	log.Printf("Found %d missing PGCRs", len(numbers))
-	// Sort the numbers
-	sort.Slice(numbers, func(i, j int) bool {
-		return numbers[i] < numbers[j]
-	})
-
+	expanded, err := pgcr.ExpandMissedRanges(db)
 	if err != nil {
-		log.Fatalf("Error connecting to the database: %s", err)
+		log.Fatalf("Error expanding missed ranges: %s", err)
 	}
-	defer db.Close()
-
-	conn, err := rabbit.Init()
-	if err != nil {
-		log.Fatalf("Error connecting to rabbit: %s", err)
+	if expanded > 0 {
+		log.Printf("Expanded missed ranges into %d instance ids", expanded)
 	}
-	defer rabbit.Cleanup()
 
-	rabbitChannel, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("Failed to create channel: %s", err)
+	var processed, found, failed int
+	for {
+		numbers, err := pgcr.ClaimDueMissed(db, *batchSize)
+		if err != nil {
+			log.Fatalf("Error claiming missed instances: %s", err)
+		}
+		if len(numbers) == 0 {
+			break
+		}
+
+		log.Printf("Claimed %d missed PGCRs starting at %d", len(numbers), numbers[0])
+		f, e := process(numbers, db)
+		processed += len(numbers)
+		found += f
+		failed += e
 	}
-	defer rabbitChannel.Close()
 
-	var found []int64
-	var failed []int64
-	if len(numbers) > 0 {
-		latestID := numbers[0]
-		ch := make(chan int64)
-		successes := make(chan int64)
-		failures := make(chan int64)
-		var wg sync.WaitGroup
+	webhook(processed, failed, found)
+}
 
-		// Start workers
-		log.Printf("Workers starting at %d", latestID)
-		for i := 0; i < numWorkers; i++ {
-			wg.Add(1)
-			go worker(ch, successes, failures, db, rabbitChannel, &wg)
-		}
+func process(numbers []int64, db *sql.DB) (int, int) {
+	ch := make(chan int64)
+	var found, failed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
 
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
 		go func() {
-			for id := range successes {
-				found = append(found, id)
-			}
+			defer wg.Done()
+			worker(ch, db, func(success bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				if success {
+					found++
+				} else {
+					failed++
+				}
+			})
 		}()
-
-		var wg2 sync.WaitGroup
-		wg2.Add(1)
-		go func() {
-			defer wg2.Done()
-			for id := range failures {
-				failed = append(failed, id)
-			}
-		}()
-
-		for j := 0; j < len(numbers); j++ {
-			latestID = numbers[j]
-			ch <- latestID
-		}
-
-		close(ch)
-		wg.Wait()
-		close(failures)
-		close(successes)
-		wg2.Wait()
 	}
 
-	if err := os.Remove(temp); err != nil {
-		panic(err)
+	for _, id := range numbers {
+		ch <- id
 	}
 
-	log.Println("Temporary file deleted successfully")
+	close(ch)
+	wg.Wait()
 
-	webhook(len(numbers), len(failed), len(found))
+	return found, failed
 }
 
-func worker(ch chan int64, successes chan int64, failures chan int64, db *sql.DB, rabbitChannel *amqp091.Channel, wg *sync.WaitGroup) {
-	defer wg.Done()
-	securityKey := os.Getenv("BUNGIE_API_KEY")
-
-	client := &http.Client{}
+func worker(ch chan int64, db *sql.DB, done func(success bool)) {
+	client := bungie.Default()
 
 	for instanceID := range ch {
-		result, activity, raw, err := pgcr.FetchAndProcessPGCR(client, instanceID, securityKey)
+		health.Default().Wait(context.Background(), health.Destiny2)
+		result, activity, raw, err := pgcr.FetchAndProcessPGCR(context.Background(), client, instanceID)
+		if result == pgcr.SystemDisabled {
+			health.Default().ReportDisabled(health.Destiny2)
+		}
 		if err != nil {
 			log.Println(err)
 		}
 
 		if result == pgcr.NonRaid {
 			log.Printf("Non raid %d", instanceID)
+			if err := pgcr.StoreNonRaid(instanceID, db); err != nil {
+				log.Printf("Failed to record non raid %d: %s", instanceID, err)
+			}
+			resolve(db, instanceID)
 			continue
 		} else if result == pgcr.Success {
-			_, committed, err := pgcr.StorePGCR(activity, raw, db, rabbitChannel)
+			_, committed, err := pgcr.StorePGCR(context.Background(), activity, raw, db)
 			if err != nil {
 				log.Printf("Failed to store raid %d: %s", instanceID, err)
-				writeMissedLog(instanceID)
-				failures <- instanceID
-			} else if committed {
-				log.Printf("Found raid %d", instanceID)
-				successes <- instanceID
+				retry(db, instanceID, pgcr.StoreFailed)
+				done(false)
+			} else {
+				if committed {
+					log.Printf("Found raid %d", instanceID)
+					done(true)
+				}
+				resolve(db, instanceID)
 			}
 		} else {
 			log.Printf("Could not resolve instance id %d: %s", instanceID, err)
-			writeMissedLog(instanceID)
-			failures <- instanceID
+			retry(db, instanceID, result)
+			done(false)
 		}
 	}
 }
 
-func createFile(src string) (*os.File, error) {
-	file, err := os.Create(src)
-	return file, err
-}
-
-func moveFile(src, dst string) error {
-	err := os.Rename(src, dst)
-	return err
+func resolve(db *sql.DB, instanceId int64) {
+	if err := pgcr.ResolveMissed(db, instanceId); err != nil {
+		log.Printf("Failed to resolve missed instance %d: %s", instanceId, err)
+	}
 }
 
-func writeMissedLog(instanceId int64) {
-	cwd, err := os.Getwd()
-	if err != nil {
-		panic(err)
+func retry(db *sql.DB, instanceId int64, result pgcr.PGCRResult) {
+	if err := pgcr.WriteMissed(db, instanceId, result); err != nil {
+		log.Printf("Failed to reschedule missed instance %d: %s", instanceId, err)
 	}
+}
 
-	// Open the file in append mode with write permissions
-	file, err := os.OpenFile(filepath.Join(cwd, "logs", "missed.log"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+func importMissedLog(db *sql.DB, path string) (int64, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		log.Fatalln(err)
+		return 0, err
 	}
 	defer file.Close()
 
-	// Create a writer to append to the file
-	writer := bufio.NewWriter(file)
-
-	// Write the line you want to append
-	_, err = writer.WriteString(fmt.Sprint(instanceId) + "\n")
-	if err != nil {
-		log.Fatalln(err)
+	uniqueNumbers := make(map[int64]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		number, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			fmt.Printf("Error parsing line %s: %v\n", line, err)
+			continue
+		}
+		uniqueNumbers[number] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
 	}
 
-	// Flush the writer to ensure the data is written to the file
-	err = writer.Flush()
-	if err != nil {
-		log.Fatalln(err)
+	numbers := make([]int64, 0, len(uniqueNumbers))
+	for number := range uniqueNumbers {
+		numbers = append(numbers, number)
 	}
+
+	return pgcr.ImportMissed(db, numbers)
 }
 
 func webhook(count int, failed int, found int) {
 	// Discord webhook URL
-	webhookURL := os.Getenv("HADES_WEBHOOK_URL")
+	webhookURL := config.Load().Discord.HadesWebhookURL
 
 	// Message to be sent
 	message := fmt.Sprintf("Info: Processed %d missing PGCR(s). Failed on %d. Added %d to the dataset.", count, failed, found)
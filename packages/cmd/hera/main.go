@@ -41,18 +41,12 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	conn, err := rabbit.Init()
+	_, err = rabbit.Init()
 	if err != nil {
 		log.Fatalf("Error connecting to RabbitMQ: %s", err)
 	}
 	defer rabbit.Cleanup()
 
-	ch, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("Error creating a channel: %s", err)
-	}
-	defer ch.Close()
-
 	// Get all players who are in the top 1000 of individual leaderboard
 	rows, err := db.QueryContext(ctx, `
 	SELECT membership_id, membership_type FROM (
@@ -93,7 +87,7 @@ func main() {
 		go func() {
 			defer wg.Done()
 			for player := range queue {
-				res, err := bungie.GetGroupsForMember(player.membershipType, player.membershipId)
+				res, err := bungie.Default().GetGroupsForMember(ctx, player.membershipType, player.membershipId)
 				if err != nil {
 					log.Fatalf("Error getting groups for player %d: %s", player.membershipId, err)
 				}
@@ -178,10 +172,10 @@ func main() {
 				}
 
 				for page := 1; ; page++ {
-					results, err := bungie.GetMembersOfGroup(group.GroupId, page)
+					results, err := bungie.Default().GetMembersOfGroup(ctx, group.GroupId, page)
 					if err != nil {
 						time.Sleep(5 * time.Second)
-						results, err = bungie.GetMembersOfGroup(group.GroupId, page)
+						results, err = bungie.Default().GetMembersOfGroup(ctx, group.GroupId, page)
 						if err != nil {
 							log.Fatalf("Error getting members of group %d: %s", group.GroupId, err)
 						}
@@ -193,7 +187,9 @@ func main() {
 						if err != nil {
 							atomic.AddInt32(memberFailurePointer, 1)
 							if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
-								player_crawl.SendMessage(ch, member.DestinyUserInfo.MembershipId)
+								if err := player_crawl.SendMessage(ctx, member.DestinyUserInfo.MembershipId); err != nil {
+									log.Printf("Error sending player %d to be crawled: %s", member.DestinyUserInfo.MembershipId, err)
+								}
 							} else {
 								log.Fatalf("Error inserting into the clan_members table: %s", err)
 							}
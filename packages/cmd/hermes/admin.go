@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"raidhub/packages/async"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Reports and changes the concurrency of the registered queues
+//
+//	GET  /queues                          lists every queue
+//	POST /queues/<name>?consumers=<n>     scales a queue to n consumers, up to its limit
+type admin struct {
+	mu     sync.Mutex
+	queues map[string]*async.QueueWorker
+}
+
+type queueStatus struct {
+	Queue     string `json:"queue"`
+	Consumers int    `json:"consumers"`
+	// Omitted when the queue has no limit
+	MaxConsumers int    `json:"maxConsumers,omitempty"`
+	Prefetch     int    `json:"prefetch"`
+	Timeout      string `json:"timeout"`
+}
+
+func newAdmin() *admin {
+	return &admin{
+		queues: make(map[string]*async.QueueWorker),
+	}
+}
+
+func (a *admin) add(qw *async.QueueWorker) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.queues[qw.QueueName] = qw
+}
+
+func (a *admin) serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/queues", a.list)
+	mux.HandleFunc("/queues/", a.scale)
+	log.Printf("Admin endpoint listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Admin endpoint stopped: %s", err)
+	}
+}
+
+func (a *admin) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.mu.Lock()
+	statuses := make([]queueStatus, 0, len(a.queues))
+	for _, qw := range a.queues {
+		statuses = append(statuses, status(qw))
+	}
+	a.mu.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Queue < statuses[j].Queue
+	})
+	writeJSON(w, statuses)
+}
+
+func (a *admin) scale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/queues/")
+	a.mu.Lock()
+	qw, ok := a.queues[name]
+	a.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown queue", http.StatusNotFound)
+		return
+	}
+
+	consumers, err := strconv.Atoi(r.URL.Query().Get("consumers"))
+	if err != nil || consumers < 0 || consumers > 100 {
+		http.Error(w, "consumers must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	if max := qw.Config.MaxConsumers; max > 0 && consumers > max {
+		http.Error(w, fmt.Sprintf("queue %s allows at most %d consumers", name, max), http.StatusBadRequest)
+		return
+	}
+
+	before := qw.Consumers()
+	qw.SetConsumers(consumers)
+	log.Printf("Scaled queue %s from %d to %d consumers", name, before, consumers)
+	writeJSON(w, status(qw))
+}
+
+func status(qw *async.QueueWorker) queueStatus {
+	return queueStatus{
+		Queue:        qw.QueueName,
+		Consumers:    qw.Consumers(),
+		MaxConsumers: qw.Config.MaxConsumers,
+		Prefetch:     qw.Config.Prefetch,
+		Timeout:      qw.Config.Timeout.String(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write admin response: %s", err)
+	}
+}
@@ -1,24 +1,39 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"raidhub/packages/async"
 	"raidhub/packages/async/activity_history"
 	"raidhub/packages/async/bonus_pgcr"
 	"raidhub/packages/async/character_fill"
 	"raidhub/packages/async/clan_crawl"
 	"raidhub/packages/async/pgcr_clickhouse"
 	"raidhub/packages/async/player_crawl"
-	"raidhub/packages/bungie"
+	"raidhub/packages/bungie/health"
+	"raidhub/packages/config"
 	"raidhub/packages/monitoring"
 	"raidhub/packages/postgres"
 	"raidhub/packages/rabbit"
-	"raidhub/packages/util"
 	"sync"
+	"syscall"
 	"time"
 )
 
+var (
+	drainTimeout = flag.Duration("drain_timeout", 30*time.Second, "how long to let in-flight messages finish when shutting down")
+	adminAddr    = flag.String("admin", "localhost:8093", "address for the admin endpoint which reports and changes queue concurrency")
+)
+
 func main() {
+	flag.Parse()
 	log.SetFlags(0) // Disable timestamps
+	if err := config.Load().Bungie.Validate(); err != nil {
+		log.Fatal(err)
+	}
 	db, err := postgres.Connect()
 	if err != nil {
 		log.Fatal("Error connecting to postgres", err)
@@ -31,97 +46,81 @@ func main() {
 	}
 	defer rabbit.Cleanup()
 
-	var destiny2ApiWg sync.WaitGroup
-	readonlyDestiny2ApiWg := util.NewReadOnlyWaitGroup(&destiny2ApiWg)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var queues sync.WaitGroup
+	admin := newAdmin()
+	// Registers a queue with the given number of consumers unless the environment overrides it
+	register := func(qw *async.QueueWorker, consumers int) {
+		defaults := qw.Config
+		defaults.Consumers = consumers
+		qw.Config = async.QueueConfigFromEnv(qw.QueueName, defaults)
+		qw.Start(ctx)
+		admin.add(qw)
+
+		queues.Add(1)
+		go func() {
+			defer queues.Done()
+			qw.Wait()
+		}()
+	}
+
+	// Start polling the Bungie API status before any messages arrive, workers hold their messages while a system they need is disabled
+	health.Default()
 
 	activityHistoryQueue := activity_history.Create()
 	activityHistoryQueue.Conn = conn
 	activityHistoryQueue.Db = db
-	activityHistoryQueue.Wg = &readonlyDestiny2ApiWg
-	go activityHistoryQueue.Register(3)
+	register(&activityHistoryQueue, 3)
 
 	playersQueue := player_crawl.Create()
 	playersQueue.Db = db
 	playersQueue.Conn = conn
-	playersQueue.Wg = &readonlyDestiny2ApiWg
-	go playersQueue.Register(10)
+	register(&playersQueue, 10)
 
 	activityCharactersQueue := character_fill.Create()
 	activityCharactersQueue.Db = db
 	activityCharactersQueue.Conn = conn
-	activityCharactersQueue.Wg = &readonlyDestiny2ApiWg
-	go activityCharactersQueue.Register(5)
+	register(&activityCharactersQueue, 5)
 
 	pgcrsClickhouseQueue := pgcr_clickhouse.CreateClickhouseQueue()
 	pgcrsClickhouseQueue.Db = db
 	pgcrsClickhouseQueue.Conn = conn
-	go pgcrsClickhouseQueue.Register(1)
+	register(&pgcrsClickhouseQueue, 1)
 
-	bonus_pgcr.CreateOutboundChannel(conn)
 	bonusPgcrsFetchQueue := bonus_pgcr.CreateFetchWorker()
 	bonusPgcrsFetchQueue.Db = db
 	bonusPgcrsFetchQueue.Conn = conn
-	bonusPgcrsFetchQueue.Wg = &readonlyDestiny2ApiWg
-	go bonusPgcrsFetchQueue.Register(25)
+	register(&bonusPgcrsFetchQueue, 25)
 
 	bonusPgcrsStoreQueue := bonus_pgcr.CreateStoreWorker()
 	bonusPgcrsStoreQueue.Db = db
 	bonusPgcrsStoreQueue.Conn = conn
-	// 1 worker because it's a write operation with often related records which would cause deadlocks
-	go bonusPgcrsStoreQueue.Register(1)
-
-	var groupsApiWg sync.WaitGroup
-	readonlyGroupsApiWg := util.NewReadOnlyWaitGroup(&groupsApiWg)
+	// Limited to 1 worker by the queue, it's a write operation with often related records which would cause deadlocks
+	register(&bonusPgcrsStoreQueue, 1)
 
 	clanQueue := clan_crawl.Create()
 	clanQueue.Db = db
 	clanQueue.Conn = conn
-	clanQueue.Wg = &readonlyGroupsApiWg
-	go clanQueue.Register(1)
+	register(&clanQueue, 1)
 
-	monitoring.RegisterPrometheus(8083)
+	monitoring.RegisterPrometheus(config.Load().Prometheus.Port(8083))
+	go admin.serve(*adminAddr)
 
-	// Set up Bungie API monitoring
+	<-ctx.Done()
+	log.Println("Shutting down, waiting for in-flight messages")
+
+	drained := make(chan struct{})
 	go func() {
-		destiny2Enabled := true
-		groupsEnabled := true
-		for {
-			log.Printf("Checking Bungie API status")
-			res, err := bungie.GetCommonSettings()
-			if err != nil {
-				log.Printf("Failed to get common settings: %s", err)
-				time.Sleep(5 * time.Second)
-				res, err = bungie.GetCommonSettings()
-				if err != nil {
-					log.Fatalf("[Fatal] Failed to get common settings: %s", err)
-				}
-			}
-
-			if !res.Systems["Destiny2"].Enabled && destiny2Enabled {
-				destiny2ApiWg.Add(1)
-				destiny2Enabled = false
-				log.Printf("Destiny 2 API is disabled")
-			} else if res.Systems["Destiny2"].Enabled && !destiny2Enabled {
-				destiny2ApiWg.Add(-1)
-				destiny2Enabled = true
-				log.Printf("Destiny 2 API is enabled")
-			}
-
-			if !res.Systems["Groups"].Enabled && groupsEnabled {
-				groupsApiWg.Add(1)
-				groupsEnabled = false
-				log.Printf("Groups API is disabled")
-			} else if res.Systems["Groups"].Enabled && !groupsEnabled {
-				groupsApiWg.Add(-1)
-				groupsEnabled = true
-				log.Printf("Groups API is enabled")
-			}
-
-			time.Sleep(60 * time.Second)
-		}
+		queues.Wait()
+		close(drained)
 	}()
 
-	// Keep the main thread running
-	forever := make(chan bool)
-	<-forever
+	select {
+	case <-drained:
+		log.Println("Drained all queues")
+	case <-time.After(*drainTimeout):
+		log.Println("Timed out waiting for in-flight messages, they will be redelivered")
+	}
 }
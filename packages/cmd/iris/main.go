@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"raidhub/packages/outbox"
+	"raidhub/packages/postgres"
+	"raidhub/packages/rabbit"
+)
+
+var (
+	batchSize    = flag.Int("batch", 500, "number of outbox rows to publish at a time")
+	pollInterval = flag.Duration("interval", time.Second, "how often to poll for new outbox rows when idle")
+	retention    = flag.Duration("retention", 24*time.Hour, "how long to keep sent outbox rows")
+	maxAttempts  = flag.Int("max_attempts", 20, "number of failed publishes after which an outbox row is parked")
+)
+
+func main() {
+	flag.Parse()
+
+	db, err := postgres.Connect()
+	if err != nil {
+		log.Fatalf("Error connecting to the database: %s", err)
+	}
+	defer db.Close()
+
+	client, err := rabbit.Init()
+	if err != nil {
+		log.Fatalf("Error connecting to rabbit: %s", err)
+	}
+	defer rabbit.Cleanup()
+
+	relay := outbox.NewRelay(db, client)
+	relay.BatchSize = *batchSize
+	relay.PollInterval = *pollInterval
+	relay.Retention = *retention
+	relay.MaxAttempts = *maxAttempts
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Println("Relaying the outbox to rabbit")
+	relay.Run(ctx)
+	log.Println("Stopped relaying")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"raidhub/packages/async/activity_history"
 	"raidhub/packages/postgres"
@@ -21,18 +22,12 @@ func main() {
 	defer db.Close()
 
 	log.Println("connecting")
-	conn, err := rabbit.Init()
+	_, err = rabbit.Init()
 	if err != nil {
 		panic(err)
 	}
 	defer rabbit.Cleanup()
 
-	ch, err := conn.Channel()
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
-
 	log.Println("querying")
 	rows, err := db.Query(`SELECT * FROM (
 			SELECT membership_id FROM player
@@ -50,7 +45,7 @@ func main() {
 	log.Println("scanning")
 	for rows.Next() {
 		rows.Scan(&id)
-		err = activity_history.SendMessage(ch, id)
+		err = activity_history.SendMessage(context.Background(), id)
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"raidhub/packages/bungie/fake"
+)
+
+var (
+	port           = flag.Int("port", 7778, "port to listen on")
+	fixtures       = flag.String("fixtures", "", "directory of fixture responses (optional)")
+	latest         = flag.Int64("latest", 0, "latest available instance id, 0 makes every id available")
+	idsPerSecond   = flag.Float64("ids_per_second", 50, "rate at which the latest instance id advances")
+	raidFraction   = flag.Float64("raid_fraction", 0.05, "fraction of generated PGCRs which are raids")
+	disabled       = flag.Bool("disabled", false, "respond with SystemDisabled")
+	throttle       = flag.Int("throttle", 0, "ThrottleSeconds sent with error responses")
+	rateLimitEvery = flag.Int64("rate_limit_every", 0, "reject every nth request with a 403")
+	redacted       = flag.String("redacted", "", "comma separated instance ids which return InsufficientPrivileges")
+	private        = flag.String("private", "", "comma separated membership ids with private activity history")
+	missingPlayers = flag.String("missing_players", "", "comma separated membership ids which return DestinyAccountNotFound")
+	characters     = flag.Int("characters", 3, "characters of each generated player")
+	activities     = flag.Int("activities", 20, "raids in the activity history of each generated character")
+	missingGroups  = flag.String("missing_groups", "", "comma separated group ids which return GroupNotFound")
+	members        = flag.Int("members", 100, "members of each generated clan")
+	clanless       = flag.String("clanless", "", "comma separated membership ids which are not in a clan")
+)
+
+func main() {
+	flag.Parse()
+
+	server := fake.NewServer(*fixtures, fake.Scenario{
+		LatestInstanceId: *latest,
+		IdsPerSecond:     *idsPerSecond,
+		RaidFraction:     *raidFraction,
+		SystemDisabled:   *disabled,
+		ThrottleSeconds:  *throttle,
+		RateLimitEvery:   *rateLimitEvery,
+		Redacted:         parseIds(*redacted),
+		Private:          parseIds(*private),
+
+		MissingPlayers:         parseIds(*missingPlayers),
+		CharactersPerPlayer:    *characters,
+		ActivitiesPerCharacter: *activities,
+		MissingGroups:          parseIds(*missingGroups),
+		MembersPerGroup:        *members,
+		Clanless:               parseIds(*clanless),
+	})
+
+	log.Printf("Serving a fake Bungie API on port %d", *port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), server))
+}
+
+func parseIds(s string) map[int64]bool {
+	ids := make(map[int64]bool)
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid id %s: %s", part, err)
+		}
+		ids[id] = true
+	}
+	return ids
+}
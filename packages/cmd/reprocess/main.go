@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"raidhub/packages/async/pgcr_clickhouse"
+	"raidhub/packages/bungie"
+	"raidhub/packages/pgcr"
+	"raidhub/packages/postgres"
+	"raidhub/packages/rabbit"
+)
+
+var (
+	startId        = flag.Int64("start", 0, "first instance id to reprocess")
+	endId          = flag.Int64("end", -1, "last instance id to reprocess (default: no limit)")
+	hash           = flag.Int64("hash", -1, "only reprocess instances of this activity hash")
+	from           = flag.String("from", "", "only reprocess instances started at or after this date (RFC3339 or YYYY-MM-DD)")
+	to             = flag.String("to", "", "only reprocess instances started before this date (RFC3339 or YYYY-MM-DD)")
+	numWorkers     = flag.Int("workers", 8, "number of instances to reprocess concurrently")
+	batchSize      = flag.Int("batch", 1000, "number of raw PGCRs to read at a time")
+	dryRun         = flag.Bool("dry_run", true, "only print the differences, do not write them")
+	clickhouse     = flag.Bool("clickhouse", false, "re-publish reprocessed instances to the pgcr_clickhouse queue")
+	checkpointPath = flag.String("checkpoint", "", "file to save progress to and resume from (optional)")
+	maxDiffs       = flag.Int("max_diffs", 20, "maximum number of differences to print per instance")
+)
+
+type rawPGCR struct {
+	instanceId int64
+	data       []byte
+}
+
+type stats struct {
+	scanned int64
+	changed int64
+	failed  int64
+}
+
+func main() {
+	flag.Parse()
+
+	db, err := postgres.Connect()
+	if err != nil {
+		log.Fatalf("Error connecting to the database: %s", err)
+	}
+	defer db.Close()
+
+	if *clickhouse && !*dryRun {
+		_, err := rabbit.Init()
+		if err != nil {
+			log.Fatalf("Error connecting to rabbit: %s", err)
+		}
+		defer rabbit.Cleanup()
+	}
+
+	query, args := buildQuery()
+
+	cursor := *startId - 1
+	if *checkpointPath != "" {
+		if saved, err := readCheckpoint(*checkpointPath); err == nil && saved > cursor {
+			log.Printf("Resuming from checkpoint %d", saved)
+			cursor = saved
+		} else if err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Error reading checkpoint: %s", err)
+		}
+	}
+
+	if *dryRun {
+		log.Println("Dry run, no changes will be written")
+	}
+
+	var s stats
+	start := time.Now()
+	for {
+		batch, err := readBatch(db, query, append([]any{cursor}, args...))
+		if err != nil {
+			log.Fatalf("Error reading raw PGCRs after %d: %s", cursor, err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		process(batch, db, &s)
+
+		cursor = batch[len(batch)-1].instanceId
+		if *checkpointPath != "" {
+			if err := writeCheckpoint(*checkpointPath, cursor); err != nil {
+				log.Fatalf("Error writing checkpoint: %s", err)
+			}
+		}
+		log.Printf("Reprocessed up to %d: %d scanned, %d changed, %d failed (%.0f/s)",
+			cursor, s.scanned, s.changed, s.failed, float64(s.scanned)/time.Since(start).Seconds())
+	}
+
+	log.Printf("Done: %d scanned, %d changed, %d failed", s.scanned, s.changed, s.failed)
+}
+
+// Builds the batch query, where $1 is the cursor and the filters follow
+func buildQuery() (string, []any) {
+	var conditions []string
+	var args []any
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)+1))
+	}
+
+	if *endId != -1 {
+		add("instance_id <= $%d", *endId)
+	}
+	if *hash != -1 {
+		add("hash = $%d", *hash)
+	}
+	if *from != "" {
+		add("date_started >= $%d", parseDate(*from))
+	}
+	if *to != "" {
+		add("date_started < $%d", parseDate(*to))
+	}
+
+	query := `SELECT instance_id, data FROM pgcr JOIN instance USING (instance_id) WHERE instance_id > $1`
+	for _, condition := range conditions {
+		query += " AND " + condition
+	}
+	query += fmt.Sprintf(" ORDER BY instance_id ASC LIMIT %d", *batchSize)
+	return query, args
+}
+
+func readBatch(db *sql.DB, query string, args []any) ([]rawPGCR, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []rawPGCR
+	for rows.Next() {
+		var r rawPGCR
+		if err := rows.Scan(&r.instanceId, &r.data); err != nil {
+			return nil, err
+		}
+		batch = append(batch, r)
+	}
+	return batch, rows.Err()
+}
+
+func process(batch []rawPGCR, db *sql.DB, s *stats) {
+	queue := make(chan rawPGCR)
+	var wg sync.WaitGroup
+	for i := 0; i < *numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range queue {
+				atomic.AddInt64(&s.scanned, 1)
+				changed, err := reprocess(r, db)
+				if err != nil {
+					atomic.AddInt64(&s.failed, 1)
+					log.Printf("Error reprocessing %d: %s", r.instanceId, err)
+				} else if changed {
+					atomic.AddInt64(&s.changed, 1)
+				}
+			}
+		}()
+	}
+
+	for _, r := range batch {
+		queue <- r
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func reprocess(r rawPGCR, db *sql.DB) (bool, error) {
+	decompressed, err := pgcr.GzipDecompress(r.data)
+	if err != nil {
+		return false, err
+	}
+
+	var report bungie.DestinyPostGameCarnageReport
+	if err := json.Unmarshal(decompressed, &report); err != nil {
+		return false, err
+	}
+
+	processed, err := pgcr.ProcessDestinyReport(&report)
+	if err != nil {
+		return false, err
+	}
+
+	diffs, err := pgcr.DiffStored(processed, db)
+	if err != nil {
+		return false, err
+	}
+
+	if len(diffs) > 0 {
+		var b strings.Builder
+		fmt.Fprintf(&b, "Instance %d has %d differences", r.instanceId, len(diffs))
+		for i, d := range diffs {
+			if i == *maxDiffs {
+				fmt.Fprintf(&b, "\n\t... %d more", len(diffs)-i)
+				break
+			}
+			fmt.Fprintf(&b, "\n\t%s", d)
+		}
+		log.Println(b.String())
+	}
+
+	if *dryRun {
+		return len(diffs) > 0, nil
+	}
+
+	if len(diffs) > 0 {
+		if err := pgcr.ReplaceStored(processed, db); err != nil {
+			return false, err
+		}
+	}
+
+	if *clickhouse {
+		if err := pgcr_clickhouse.SendToClickhouse(context.Background(), processed); err != nil {
+			return false, err
+		}
+	}
+
+	return len(diffs) > 0, nil
+}
+
+func parseDate(s string) time.Time {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		log.Fatalf("Invalid date %s", s)
+	}
+	return t
+}
+
+func readCheckpoint(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func writeCheckpoint(path string, instanceId int64) error {
+	return os.WriteFile(path, []byte(strconv.FormatInt(instanceId, 10)+"\n"), 0644)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"raidhub/packages/async/activity_history"
@@ -74,18 +75,12 @@ func main() {
 	}
 
 	// Connect to the RabbitMQ
-	conn, err := rabbit.Init()
+	_, err = rabbit.Init()
 	if err != nil {
 		log.Fatalf("Failed to create rabbit connection: %s", err)
 	}
 	defer rabbit.Cleanup()
 
-	rabbitChannel, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("Failed to create rabbit channel: %s", err)
-	}
-	defer rabbitChannel.Close()
-
 	var wg sync.WaitGroup
 	for _, id := range membershipIds {
 		wg.Add(1)
@@ -95,11 +90,11 @@ func main() {
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = player_crawl.SendMessage(rabbitChannel, idInt64)
+			err = player_crawl.SendMessage(context.Background(), idInt64)
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = activity_history.SendMessage(rabbitChannel, idInt64)
+			err = activity_history.SendMessage(context.Background(), idInt64)
 			if err != nil {
 				log.Fatal(err)
 			}
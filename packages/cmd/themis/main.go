@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"raidhub/packages/pgcr"
+	"raidhub/packages/pgcr/golden"
+	"raidhub/packages/postgres"
+)
+
+var (
+	dir     = flag.String("dir", "./packages/pgcr/golden/corpus", "directory of the golden corpus")
+	update  = flag.Bool("update", false, "rewrite the golden files instead of checking them")
+	run     = flag.String("run", "", "only check cases whose name contains this string")
+	export  = flag.String("export", "", "comma separated instance ids to export from the database into the corpus")
+	name    = flag.String("name", "", "case name prefix for exported instances (default: instance id)")
+	verbose = flag.Bool("verbose", false, "log passing cases")
+)
+
+func main() {
+	flag.Parse()
+
+	if *export != "" {
+		exportInstances()
+		return
+	}
+
+	cases, err := golden.Load(*dir)
+	if err != nil {
+		log.Fatalf("Error loading corpus: %s", err)
+	}
+
+	failed := 0
+	checked := 0
+	for _, c := range cases {
+		if !strings.Contains(c.Name, *run) {
+			continue
+		}
+		checked++
+
+		if *update {
+			if err := c.Update(); err != nil {
+				log.Fatalf("Error updating %s: %s", c.Name, err)
+			}
+			log.Printf("Updated %s", c.Name)
+			continue
+		}
+
+		diffs, err := c.Check()
+		if err != nil {
+			failed++
+			log.Printf("FAIL %s: %s", c.Name, err)
+		} else if len(diffs) > 0 {
+			failed++
+			log.Printf("FAIL %s", c.Name)
+			for _, d := range diffs {
+				fmt.Printf("\t%s\n", d)
+			}
+		} else if *verbose {
+			log.Printf("ok   %s", c.Name)
+		}
+	}
+
+	if *update {
+		log.Printf("Updated %d cases", checked)
+		return
+	}
+
+	log.Printf("Checked %d cases, %d failed", checked, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func exportInstances() {
+	db, err := postgres.Connect()
+	if err != nil {
+		log.Fatalf("Error connecting to the database: %s", err)
+	}
+	defer db.Close()
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, part := range strings.Split(*export, ",") {
+		instanceId, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid instance id %s: %s", part, err)
+		}
+
+		report, err := pgcr.RetrieveJSON(instanceId, db)
+		if err != nil {
+			log.Fatalf("Error retrieving pgcr %d: %s", instanceId, err)
+		}
+
+		caseName := strconv.FormatInt(instanceId, 10)
+		if *name != "" {
+			caseName = *name + "-" + caseName
+		}
+
+		c, err := golden.Export(*dir, caseName, report)
+		if err != nil {
+			log.Fatalf("Error exporting %d: %s", instanceId, err)
+		}
+		log.Printf("Exported %s", c.RawPath())
+	}
+}
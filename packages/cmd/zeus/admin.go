@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
+)
+
+type limiterStatus struct {
+	Tokens float64 `json:"tokens"`
+	Limit  float64 `json:"limit"`
+	Burst  int     `json:"burst"`
+}
+
+type sourceLimits struct {
+	Source string        `json:"source"`
+	Stats  limiterStatus `json:"stats"`
+	WWW    limiterStatus `json:"www"`
+	// Fraction of the base rate the limiters are slowed to
+	Factor           float64    `json:"factor"`
+	QuarantinedUntil *time.Time `json:"quarantinedUntil,omitempty"`
+}
+
+type keyLimits struct {
+	Key              string     `json:"key"`
+	QuarantinedUntil *time.Time `json:"quarantinedUntil,omitempty"`
+}
+
+type clientUsage struct {
+	Client   string         `json:"client"`
+	Priority int            `json:"priority"`
+	Quota    *limiterStatus `json:"quota,omitempty"`
+	Requests int64          `json:"requests"`
+	Upstream int64          `json:"upstream"`
+	Rejected int64          `json:"rejected"`
+}
+
+type limits struct {
+	Sources []sourceLimits `json:"sources"`
+	Keys    []keyLimits    `json:"keys"`
+}
+
+// Serves metrics, health checks and the state of the rate limiters
+//
+//	GET /metrics       Prometheus metrics
+//	GET /healthz       ok while the process is up
+//	GET /readyz        ok while requests are being accepted
+//	GET /debug/limits  tokens left in the limiters of each source address and which addresses and keys are quarantined
+//	GET /debug/clients requests made by each client, how many went upstream or were over quota, and its quota
+func serveAdmin(addr string, t *transport, clients []*client, ready *atomic.Bool) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	})
+	mux.HandleFunc("/debug/limits", func(w http.ResponseWriter, r *http.Request) {
+		var l limits
+		for i, source := range t.sources {
+			l.Sources = append(l.Sources, sourceLimits{
+				Source:           source,
+				Stats:            status(t.statsRl[i]),
+				WWW:              status(t.wwwRl[i]),
+				Factor:           t.addresses[i].rate(),
+				QuarantinedUntil: quarantinedUntil(t.addresses[i]),
+			})
+		}
+		for i, key := range t.keys {
+			l.Keys = append(l.Keys, keyLimits{
+				Key:              apiKeyLabel(i),
+				QuarantinedUntil: quarantinedUntil(key),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(l); err != nil {
+			log.Printf("Failed to write limits: %s", err)
+		}
+	})
+
+	clients = append(clients[:len(clients):len(clients)], legacyClient, anonymousClient)
+	mux.HandleFunc("/debug/clients", func(w http.ResponseWriter, r *http.Request) {
+		var usage []clientUsage
+		for _, c := range clients {
+			u := clientUsage{
+				Client:   c.name,
+				Priority: c.priority,
+				Requests: c.requests.Load(),
+				Upstream: c.upstream.Load(),
+				Rejected: c.rejected.Load(),
+			}
+			if c.quota != nil {
+				quota := status(c.quota)
+				u.Quota = &quota
+			}
+			usage = append(usage, u)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(usage); err != nil {
+			log.Printf("Failed to write client usage: %s", err)
+		}
+	})
+
+	log.Printf("Admin endpoint listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Admin endpoint stopped: %s", err)
+	}
+}
+
+func status(rl *rate.Limiter) limiterStatus {
+	return limiterStatus{
+		Tokens: rl.Tokens(),
+		Limit:  float64(rl.Limit()),
+		Burst:  rl.Burst(),
+	}
+}
+
+func quarantinedUntil(t *throttle) *time.Time {
+	until := t.quarantinedUntil()
+	if !until.After(time.Now()) {
+		return nil
+	}
+	return &until
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long responses to the paths matching a pattern are cached. A zero ttl caches forever.
+type cacheRule struct {
+	pattern *regexp.Regexp
+	ttl     time.Duration
+}
+
+// Parses rules such as "/Platform/Settings/?$=30s;PostGameCarnageReport=forever", the first match wins
+func parseCacheRules(s string) ([]cacheRule, error) {
+	var rules []cacheRule
+	for _, part := range strings.Split(s, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.LastIndex(part, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("rule %q is not pattern=ttl", part)
+		}
+		pattern, err := regexp.Compile(part[:i])
+		if err != nil {
+			return nil, err
+		}
+		var ttl time.Duration
+		if part[i+1:] != "forever" {
+			if ttl, err = time.ParseDuration(part[i+1:]); err != nil {
+				return nil, err
+			}
+			if ttl <= 0 {
+				return nil, fmt.Errorf("rule %q must have a positive ttl", part)
+			}
+		}
+		rules = append(rules, cacheRule{pattern, ttl})
+	}
+	return rules, nil
+}
+
+// A snapshot of a response which can be handed to any number of clients
+type cachedResponse struct {
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Expires time.Time // Zero if it never expires
+}
+
+func (c *cachedResponse) response(r *http.Request, source string) *http.Response {
+	header := c.Header.Clone()
+	header.Set("X-Zeus-Cache", source)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", c.Status, http.StatusText(c.Status)),
+		StatusCode:    c.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(c.Body)),
+		ContentLength: int64(len(c.Body)),
+		Request:       r,
+	}
+}
+
+func (c *cachedResponse) expired() bool {
+	return !c.Expires.IsZero() && time.Now().After(c.Expires)
+}
+
+// An in-flight upstream request which identical requests wait on
+type call struct {
+	done chan struct{}
+	res  *cachedResponse
+	err  error
+}
+
+// A cache sits in front of the proxy's transport. Concurrent identical GETs share one upstream request,
+// and successful responses to paths with a cache rule are kept in memory, bounded by size in least recently
+// used order, and on disk if they never expire.
+type cache struct {
+	next     http.RoundTripper
+	rules    []cacheRule
+	maxBytes int64
+	dir      string
+
+	mu       sync.Mutex
+	inflight map[string]*call
+	entries  map[string]*list.Element
+	lru      *list.List // of *cacheEntry, most recently used first
+	bytes    int64
+}
+
+type cacheEntry struct {
+	key string
+	res *cachedResponse
+}
+
+func newCache(next http.RoundTripper, rules []cacheRule, maxBytes int64, dir string) *cache {
+	return &cache{
+		next:     next,
+		rules:    rules,
+		maxBytes: maxBytes,
+		dir:      dir,
+		inflight: make(map[string]*call),
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *cache) RoundTrip(r *http.Request) (*http.Response, error) {
+	// Responses to authenticated requests belong to one user
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+		cacheRequests.WithLabelValues("bypass").Inc()
+		return c.next.RoundTrip(r)
+	}
+
+	key := keyClass(r) + " " + r.URL.Host + r.URL.RequestURI()
+	ttl, cacheable := c.ttl(r.URL.Path)
+
+	if cacheable {
+		if res := c.get(key); res != nil {
+			cacheRequests.WithLabelValues("hit").Inc()
+			return res.response(r, "hit"), nil
+		}
+	}
+
+	c.mu.Lock()
+	if cl, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-cl.done:
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+		if cl.err != nil {
+			return nil, cl.err
+		}
+		cacheRequests.WithLabelValues("coalesced").Inc()
+		return cl.res.response(r, "coalesced"), nil
+	}
+	cl := &call{done: make(chan struct{})}
+	c.inflight[key] = cl
+	c.mu.Unlock()
+
+	cacheRequests.WithLabelValues("miss").Inc()
+	cl.res, cl.err = c.fetch(r)
+	if cl.err == nil && cacheable && cacheableResponse(cl.res) {
+		if ttl > 0 {
+			cl.res.Expires = time.Now().Add(ttl)
+		}
+		c.put(key, cl.res, true)
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(cl.done)
+
+	if cl.err != nil {
+		return nil, cl.err
+	}
+	return cl.res.response(r, "miss"), nil
+}
+
+// Makes the upstream request on behalf of every client waiting on it, so one client going away doesn't fail the rest
+func (c *cache) fetch(r *http.Request) (*cachedResponse, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), time.Minute)
+	defer cancel()
+
+	res, err := c.next.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	header := res.Header.Clone()
+	header.Del("Set-Cookie")
+	return &cachedResponse{
+		Status: res.StatusCode,
+		Header: header,
+		Body:   body,
+	}, nil
+}
+
+// Requests sent with the pooled keys share responses. Callers with their own key only share with the same key,
+// so an invalid key's errors never reach anyone else and a key is always checked by Bungie at least once.
+func keyClass(r *http.Request) string {
+	if clientFrom(r.Context()) != anonymousClient {
+		return "pooled"
+	}
+	sum := sha256.Sum256([]byte(r.Header.Get("x-api-key")))
+	return "key:" + hex.EncodeToString(sum[:8])
+}
+
+func (c *cache) ttl(path string) (time.Duration, bool) {
+	if c.maxBytes <= 0 {
+		return 0, false
+	}
+	for _, rule := range c.rules {
+		if rule.pattern.MatchString(path) {
+			return rule.ttl, true
+		}
+	}
+	return 0, false
+}
+
+// Only successful Bungie responses are kept, some errors come back as a 200
+func cacheableResponse(res *cachedResponse) bool {
+	if res.Status != http.StatusOK {
+		return false
+	}
+	var data struct {
+		ErrorCode int `json:"ErrorCode"`
+	}
+	return json.Unmarshal(res.Body, &data) == nil && data.ErrorCode == 1
+}
+
+func (c *cache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if !entry.res.expired() {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return entry.res
+		}
+		c.remove(el)
+	}
+	c.mu.Unlock()
+
+	res := c.readDisk(key)
+	if res != nil {
+		c.put(key, res, false)
+	}
+	return res
+}
+
+// Keeps res in memory, and on disk too if persist is set and it never expires
+func (c *cache) put(key string, res *cachedResponse, persist bool) {
+	size := int64(len(res.Body))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, res})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	cacheBytes.Set(float64(c.bytes))
+	cacheEntries.Set(float64(len(c.entries)))
+	c.mu.Unlock()
+
+	if persist && res.Expires.IsZero() {
+		c.writeDisk(key, res)
+	}
+}
+
+// Must hold c.mu
+func (c *cache) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.res.Body))
+	cacheBytes.Set(float64(c.bytes))
+	cacheEntries.Set(float64(len(c.entries)))
+}
+
+func (c *cache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *cache) readDisk(key string) *cachedResponse {
+	if c.dir == "" {
+		return nil
+	}
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var res cachedResponse
+	if err := gob.NewDecoder(f).Decode(&res); err != nil {
+		log.Printf("Failed to read cached response %s: %s", f.Name(), err)
+		return nil
+	}
+	return &res
+}
+
+func (c *cache) writeDisk(key string, res *cachedResponse) {
+	if c.dir == "" {
+		return
+	}
+	// Write to a temporary file first so a reader never sees half a response
+	f, err := os.CreateTemp(c.dir, "tmp-")
+	if err != nil {
+		log.Printf("Failed to cache response on disk: %s", err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(res)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf("Failed to cache response on disk: %s", err)
+	}
+}
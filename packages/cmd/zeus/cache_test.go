@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An upstream which holds every request until release is closed
+type heldUpstream struct {
+	calls    atomic.Int64
+	release  chan struct{}
+	body     string
+	canceled atomic.Bool
+}
+
+func (u *heldUpstream) RoundTrip(r *http.Request) (*http.Response, error) {
+	u.calls.Add(1)
+	if u.release != nil {
+		<-u.release
+	}
+	if r.Context().Err() != nil {
+		u.canceled.Store(true)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(u.body)),
+		Request:    r,
+	}, nil
+}
+
+func request(ctx context.Context, path string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "https://www.bungie.net"+path, nil).WithContext(ctx)
+	r.Header.Set("X-API-Key", "mine")
+	return r
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	up := &heldUpstream{release: make(chan struct{}), body: `{"ErrorCode":1,"Response":{}}`}
+	// No rules, so only coalescing can keep the requests from reaching upstream
+	c := newCache(up, nil, 1<<20, "")
+
+	const n = 10
+	sources := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.RoundTrip(request(context.Background(), "/Platform/Settings/"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != up.body {
+				t.Errorf("got body %s", body)
+			}
+			sources <- res.Header.Get("X-Zeus-Cache")
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(up.release)
+	wg.Wait()
+	close(sources)
+
+	if calls := up.calls.Load(); calls != 1 {
+		t.Errorf("upstream was called %d times, want 1", calls)
+	}
+	counts := make(map[string]int)
+	for source := range sources {
+		counts[source]++
+	}
+	if counts["miss"] != 1 || counts["coalesced"] != n-1 {
+		t.Errorf("got %v, want 1 miss and %d coalesced", counts, n-1)
+	}
+}
+
+func TestCacheCoalescingCancel(t *testing.T) {
+	up := &heldUpstream{release: make(chan struct{}), body: `{"ErrorCode":1,"Response":{}}`}
+	c := newCache(up, nil, 1<<20, "")
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := c.RoundTrip(request(leaderCtx, "/Platform/Settings/"))
+		leader <- err
+	}()
+	for up.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	followerCtx, cancelFollower := context.WithCancel(context.Background())
+	follower := make(chan error, 1)
+	go func() {
+		_, err := c.RoundTrip(request(followerCtx, "/Platform/Settings/"))
+		follower <- err
+	}()
+	others := make(chan error, 3)
+	for i := 0; i < cap(others); i++ {
+		go func() {
+			_, err := c.RoundTrip(request(context.Background(), "/Platform/Settings/"))
+			others <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// A waiter which gives up returns straight away
+	cancelFollower()
+	if err := <-follower; err != context.Canceled {
+		t.Errorf("cancelled follower returned %v", err)
+	}
+	// The caller which started the upstream request going away doesn't cancel it for the rest
+	cancelLeader()
+	close(up.release)
+	<-leader
+	for i := 0; i < cap(others); i++ {
+		if err := <-others; err != nil {
+			t.Errorf("waiter failed: %s", err)
+		}
+	}
+	if up.canceled.Load() {
+		t.Error("the upstream request was cancelled with the leader")
+	}
+	if calls := up.calls.Load(); calls != 1 {
+		t.Errorf("upstream was called %d times, want 1", calls)
+	}
+}
+
+func TestCacheErrorsNotCached(t *testing.T) {
+	rules, err := parseCacheRules("PostGameCarnageReport=forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		`{"ErrorCode":1653,"ErrorStatus":"DestinyPGCRNotFound"}`,
+		`{"ErrorCode":5,"ErrorStatus":"SystemDisabled"}`,
+		`not json`,
+	} {
+		up := &heldUpstream{body: body}
+		c := newCache(up, rules, 1<<20, "")
+		for i := 0; i < 2; i++ {
+			res, err := c.RoundTrip(request(context.Background(), "/Platform/Destiny2/Stats/PostGameCarnageReport/1/"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source := res.Header.Get("X-Zeus-Cache"); source != "miss" {
+				t.Errorf("%s: request %d was a %s", body, i+1, source)
+			}
+		}
+		if calls := up.calls.Load(); calls != 2 {
+			t.Errorf("%s: upstream was called %d times, want 2", body, calls)
+		}
+	}
+
+	up := &heldUpstream{body: `{"ErrorCode":1,"Response":{}}`}
+	c := newCache(up, rules, 1<<20, "")
+	c.RoundTrip(request(context.Background(), "/Platform/Destiny2/Stats/PostGameCarnageReport/1/"))
+	res, _ := c.RoundTrip(request(context.Background(), "/Platform/Destiny2/Stats/PostGameCarnageReport/1/"))
+	if source := res.Header.Get("X-Zeus-Cache"); source != "hit" || up.calls.Load() != 1 {
+		t.Errorf("a successful response was not cached, got a %s", source)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Header callers identify themselves with, it is never forwarded to Bungie
+const tokenHeader = "X-Zeus-Token"
+
+// A client is a service calling Zeus. Identified clients always use the pooled API keys, are served by
+// priority when the egresses are saturated, and may be held to a quota.
+type client struct {
+	name     string
+	token    string
+	priority int
+	// Requests per second allowed to the client, nil if it is unlimited. Every request counts, including
+	// those answered from the cache, since the quota is checked before the cache is consulted.
+	quota *rate.Limiter
+
+	// Usage since Zeus started
+	requests atomic.Int64
+	upstream atomic.Int64
+	rejected atomic.Int64
+}
+
+var (
+	// Callers presenting BUNGIE_API_KEY, as every service did before clients had tokens
+	legacyClient = &client{name: "default"}
+	// Callers using their own API key
+	anonymousClient = &client{name: "anonymous"}
+)
+
+// Parses clients such as "atlas:token1:10,hermes:token2:0:50" as name:token[:priority[:requests per second]].
+// A missing or zero rate leaves the client unlimited.
+func parseClients(entries []string) ([]*client, error) {
+	var clients []*client
+	seen := make(map[string]bool)
+	for i, entry := range entries {
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 4 || parts[0] == "" || parts[1] == "" {
+			// Don't log the entry, it may be a bare token
+			return nil, fmt.Errorf("client %d is not name:token[:priority[:rate]]", i+1)
+		}
+		c := &client{name: parts[0], token: parts[1]}
+		if seen[c.name] || seen[c.token] {
+			return nil, fmt.Errorf("client %s is repeated or shares a token", c.name)
+		}
+		seen[c.name], seen[c.token] = true, true
+
+		var err error
+		if len(parts) > 2 {
+			if c.priority, err = strconv.Atoi(parts[2]); err != nil {
+				return nil, fmt.Errorf("client %s has an invalid priority: %w", c.name, err)
+			}
+		}
+		if len(parts) > 3 {
+			perSecond, err := strconv.ParseFloat(parts[3], 64)
+			if err != nil || perSecond < 0 {
+				return nil, fmt.Errorf("client %s has an invalid rate %q", c.name, parts[3])
+			}
+			if perSecond > 0 {
+				c.quota = rate.NewLimiter(rate.Limit(perSecond), max(1, int(math.Ceil(perSecond))))
+			}
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+type clientKey struct{}
+
+// The client a request to the transport was made for
+func clientFrom(ctx context.Context) *client {
+	if c, ok := ctx.Value(clientKey{}).(*client); ok {
+		return c
+	}
+	return anonymousClient
+}
+
+// Identifies the caller of each request and enforces its quota before passing it to next, so cache hits
+// count against the quota too
+func identify(clients []*client, next http.Handler) http.Handler {
+	byToken := make(map[string]*client)
+	for _, c := range clients {
+		byToken[c.token] = c
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := anonymousClient
+		if token := r.Header.Get(tokenHeader); token != "" {
+			var ok bool
+			if c, ok = byToken[token]; !ok {
+				clientRequests.WithLabelValues("unknown", strconv.Itoa(http.StatusUnauthorized)).Inc()
+				http.Error(w, "unknown zeus token", http.StatusUnauthorized)
+				return
+			}
+			r.Header.Del(tokenHeader)
+		} else if r.Header.Get("x-api-key") == securityKey {
+			c = legacyClient
+		}
+
+		c.requests.Add(1)
+		if c.quota != nil {
+			if wait := reserve(c.quota); wait > 0 {
+				c.rejected.Add(1)
+				clientRequests.WithLabelValues(c.name, strconv.Itoa(http.StatusTooManyRequests)).Inc()
+				quotaExceeded(w, c, wait)
+				return
+			}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), clientKey{}, c)))
+		clientRequests.WithLabelValues(c.name, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// Takes a token if one is free, otherwise returns how long until one will be
+func reserve(rl *rate.Limiter) time.Duration {
+	res := rl.Reserve()
+	wait := res.Delay()
+	if wait > 0 {
+		res.Cancel()
+	}
+	return wait
+}
+
+// Rejects the request the way Bungie throttles, so callers back off with the retries they already have
+func quotaExceeded(w http.ResponseWriter, c *client, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]any{
+		"ErrorCode":       38,
+		"ErrorStatus":     "ThrottleLimitExceededSeconds",
+		"Message":         fmt.Sprintf("Zeus quota of %s exceeded", c.name),
+		"ThrottleSeconds": seconds,
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Lets the reverse proxy flush through the recorder
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
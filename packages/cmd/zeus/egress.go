@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"raidhub/packages/config"
+	"time"
+)
+
+// An egress is one route out to Bungie. Each gets its own rate limiters, so more of them allow more throughput.
+type egress struct {
+	// The source address or proxy, used in metrics and logs
+	name string
+	rt   http.RoundTripper
+}
+
+// Builds the egresses for cfg.Egress:
+//
+//	ipv6     n sequential addresses starting at IPV6, which must be assigned to this host
+//	default  a single route through the host's default address
+//	proxy    one route through each of ZEUS_PROXIES
+func newEgresses(cfg config.Zeus, n int) ([]egress, error) {
+	strategy := cfg.Egress
+	if strategy == "" {
+		strategy = "default"
+		if cfg.IPv6 != "" {
+			strategy = "ipv6"
+		}
+	}
+
+	switch strategy {
+	case "ipv6":
+		return ipv6Egresses(cfg.IPv6, n)
+	case "default":
+		return []egress{{
+			name: "default",
+			rt:   newRoundTripper("default", &net.Dialer{}, nil),
+		}}, nil
+	case "proxy":
+		return proxyEgresses(cfg.Proxies)
+	default:
+		return nil, fmt.Errorf("unknown egress %q, expected ipv6, default or proxy", strategy)
+	}
+}
+
+func ipv6Egresses(start string, n int) ([]egress, error) {
+	addr, err := netip.ParseAddr(start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IPV6: %w", err)
+	}
+
+	var egresses []egress
+	for i := 0; i < n; i++ {
+		if *printAddrs {
+			fmt.Printf("sudo ip -6 addr add %s/64 dev %s\n", addr.String(), *ipv6interface)
+		}
+		d := &net.Dialer{
+			LocalAddr: &net.TCPAddr{
+				IP: net.IP(addr.AsSlice()),
+			},
+		}
+		egresses = append(egresses, egress{
+			name: addr.String(),
+			rt:   newRoundTripper(addr.String(), d, nil),
+		})
+		addr = addr.Next()
+	}
+	return egresses, nil
+}
+
+func proxyEgresses(proxies []string) ([]egress, error) {
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("the proxy egress needs ZEUS_PROXIES")
+	}
+
+	var egresses []egress
+	for _, p := range proxies {
+		u, err := url.Parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("proxy %s must be http, https or socks5", u.Redacted())
+		}
+		// Credentials stay out of metrics
+		name := u.Scheme + "://" + u.Host
+		egresses = append(egresses, egress{
+			name: name,
+			rt:   newRoundTripper(name, &net.Dialer{}, http.ProxyURL(u)),
+		})
+	}
+	return egresses, nil
+}
+
+// A transport which dials with d, optionally through a proxy, and counts the bytes of its connections under name
+func newRoundTripper(name string, d *net.Dialer, proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	d.Timeout = 30 * time.Second
+	d.KeepAlive = 30 * time.Second
+
+	rt := http.DefaultTransport.(*http.Transport).Clone()
+	rt.Proxy = proxy
+	rt.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+		return wrappedConn{conn, name}, err
+	}
+	return rt
+}
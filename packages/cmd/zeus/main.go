@@ -11,32 +11,33 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"raidhub/packages/config"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/joho/godotenv"
-	"github.com/paulbellamy/ratecounter"
 	"golang.org/x/time/rate"
 )
 
 var (
 	ipv6interface = flag.String("interface", "enp1s0", "ipv6 interface")
-	ipv6n         = flag.Int("v6_n", 1, "number of sequential ipv6 addresses")
+	ipv6n         = flag.Int("v6_n", 1, "number of sequential ipv6 addresses for the ipv6 egress")
 	port          = flag.Int("port", 7777, "port to listen on")
-	printAddrs    = flag.Bool("print_addrs", false, "print ipv6 addresses")
+	printAddrs    = flag.Bool("print_addrs", false, "print the commands to add the ipv6 addresses")
 	verbose       = flag.Bool("verbose", false, "print logs")
+	drainTimeout  = flag.Duration("drain_timeout", 30*time.Second, "how long to let in-flight requests finish when shutting down")
+	adminAddr     = flag.String("admin", ":7778", "address for metrics, health checks and /debug/limits")
+	cacheSize     = flag.Int("cache_size", 256, "megabytes of responses to cache in memory, 0 to only coalesce identical requests")
+	cacheDir      = flag.String("cache_dir", "", "directory to keep responses which never expire, such as PGCRs (optional)")
+	cacheRules    = flag.String("cache_rules", "/Destiny2/Stats/PostGameCarnageReport/=forever;/Platform/Settings/?$=30s;/LinkedProfiles/=1m;/GroupV2/=1m", "path pattern=ttl rules for which responses to cache, separated by ;")
 )
 
-var (
-	securityKey         = ""
-	rateIntervalSeconds = 10
-	rateInterval        = time.Second * time.Duration(rateIntervalSeconds)
-	writeCounter        = ratecounter.NewRateCounter(rateInterval)
-	readCounter         = ratecounter.NewRateCounter(rateInterval)
-)
+var securityKey = ""
 
 type transport struct {
 	nW      int64
@@ -44,64 +45,141 @@ type transport struct {
 	rt      []http.RoundTripper
 	statsRl []*rate.Limiter
 	wwwRl   []*rate.Limiter
-	apiKeys []string
+	// Hand out the tokens of the limiters by client priority
+	statsQueue []*scheduler
+	wwwQueue   []*scheduler
+	apiKeys    []string
+	// The name of the egress of each round tripper
+	sources []string
+	// Throttling of each egress, over both of its limiters, and of each API key
+	addresses []*throttle
+	keys      []*throttle
 }
 
-var proxyTransport = &transport{}
-
 func main() {
 	flag.Parse()
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	cfg := config.Load()
+	if err := cfg.Bungie.Validate(); err != nil {
+		log.Fatal(err)
 	}
 
-	securityKey = os.Getenv("BUNGIE_API_KEY")
-	if securityKey == "" {
-		log.Fatal("must pass BUNGIE_API_KEY")
+	securityKey = cfg.Bungie.APIKey
+	if len(cfg.Zeus.APIKeys) == 0 {
+		log.Fatal("must pass ZEUS_API_KEYS")
 	}
 
-	proxyTransport.apiKeys = strings.Split(os.Getenv("ZEUS_API_KEYS"), ",")
+	clients, err := parseClients(cfg.Zeus.Clients)
+	if err != nil {
+		log.Fatalf("Invalid ZEUS_CLIENTS: %s", err)
+	}
 
-	addr := netip.MustParseAddr(os.Getenv("IPV6"))
-	for i := 0; i < *ipv6n; i++ {
-		d := &net.Dialer{
-			LocalAddr: &net.TCPAddr{
-				IP: net.IP(addr.AsSlice()),
-			},
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}
-		rt := http.DefaultTransport.(*http.Transport).Clone()
-		rt.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			conn, err := d.DialContext(ctx, network, addr)
-			if err != nil {
-				return conn, err
-			}
-			return wrappedConn{conn}, err
+	egresses, err := newEgresses(cfg.Zeus, *ipv6n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printAddrs {
+		return
+	}
+	proxyTransport := newTransport(cfg.Zeus.APIKeys, egresses)
+	log.Printf("Sending requests through %d egresses", len(egresses))
+
+	rules, err := parseCacheRules(*cacheRules)
+	if err != nil {
+		log.Fatalf("Invalid -cache_rules: %s", err)
+	}
+	if *cacheDir != "" {
+		if err := os.MkdirAll(*cacheDir, 0o755); err != nil {
+			log.Fatal(err)
 		}
-		if *printAddrs {
-			fmt.Printf("sudo ip -6 addr add %s/64 dev %s\n", addr.String(), *ipv6interface)
+	}
+	responseCache := newCache(proxyTransport, rules, int64(*cacheSize)<<20, *cacheDir)
+
+	handler, err := newProxy(cfg.Zeus, responseCache, clients)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registerMetrics()
+	var ready atomic.Bool
+	go serveAdmin(*adminAddr, proxyTransport, clients, &ready)
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", *port),
+		Handler: handler,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		ready.Store(false)
+		log.Println("Shutting down, waiting for in-flight requests")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Timed out waiting for in-flight requests: %s", err)
 		}
-		proxyTransport.statsRl = append(proxyTransport.statsRl, rate.NewLimiter(rate.Every(time.Second/40), 90))
-		proxyTransport.wwwRl = append(proxyTransport.wwwRl, rate.NewLimiter(rate.Every(time.Second/12), 25))
-		proxyTransport.rt = append(proxyTransport.rt, rt)
-		addr = addr.Next()
+	}()
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ready.Store(true)
+	log.Printf("Ready on port %d", *port)
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Serve returns as soon as shutdown begins
+	<-drained
+	log.Println("Stopped")
+}
+
+// A transport which sends requests through the egresses, swapping in the API keys for identified clients
+func newTransport(apiKeys []string, egresses []egress) *transport {
+	t := &transport{apiKeys: apiKeys}
+	for i := range apiKeys {
+		t.keys = append(t.keys, newThrottle(apiKeyLabel(i)))
 	}
+	for i, e := range egresses {
+		t.statsRl = append(t.statsRl, rate.NewLimiter(rate.Every(time.Second/40), 90))
+		t.wwwRl = append(t.wwwRl, rate.NewLimiter(rate.Every(time.Second/12), 25))
+		t.statsQueue = append(t.statsQueue, newScheduler(t.statsRl[i]))
+		t.wwwQueue = append(t.wwwQueue, newScheduler(t.wwwRl[i]))
+		t.rt = append(t.rt, e.rt)
+		t.sources = append(t.sources, e.name)
+		t.addresses = append(t.addresses, newThrottle(e.name, t.statsRl[i], t.wwwRl[i]))
+	}
+	return t
+}
+
+// The handler clients call, which proxies their requests to the upstreams through next
+func newProxy(cfg config.Zeus, next http.RoundTripper, clients []*client) (http.Handler, error) {
+	wwwUpstream, err := url.Parse(cfg.WWWUpstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ZEUS_WWW_UPSTREAM: %w", err)
+	}
+	statsUpstream, err := url.Parse(cfg.StatsUpstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ZEUS_STATS_UPSTREAM: %w", err)
+	}
+
 	rp := &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
+			upstream := wwwUpstream
 			if strings.Contains(r.URL.Path, "Destiny2/Stats/PostGameCarnageReport") {
-				r.URL.Host = "stats.bungie.net"
-			} else {
-				r.URL.Host = "www.bungie.net"
+				upstream = statsUpstream
 			}
-			r.URL.Scheme = "https"
+			r.URL.Host = upstream.Host
+			r.URL.Scheme = upstream.Scheme
 			r.Header.Set("User-Agent", "")
 			r.Header.Del("x-forwarded-for")
+			// Left to the transport, which asks for gzip itself and decompresses, so Bungie's errors can be read
+			r.Header.Del("Accept-Encoding")
 		},
-		Transport: proxyTransport,
-	}
-	if *printAddrs {
-		return
+		Transport: next,
 	}
 	mainHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("x-betteruptime-probe") != "" {
@@ -111,24 +189,42 @@ func main() {
 
 		rp.ServeHTTP(w, r)
 	})
-	log.Printf("Ready on port %d", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), mainHandler))
+	return identify(clients, mainHandler), nil
 }
 
 func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
-	var rl *rate.Limiter
+	stats := strings.Contains(r.URL.Path, "Destiny2/Stats/PostGameCarnageReport")
 	var n int64
-	if strings.Contains(r.URL.Path, "Destiny2/Stats/PostGameCarnageReport") {
+	if stats {
 		n = atomic.AddInt64(&t.nS, 1)
-		r.Host = "stats.bungie.net"
-		rl = t.statsRl[n%int64(len(t.statsRl))]
 	} else {
 		n = atomic.AddInt64(&t.nW, 1)
-		r.Host = "www.bungie.net"
-		rl = t.wwwRl[n%int64(len(t.wwwRl))]
 	}
-	apiKey := t.apiKeys[n%int64(len(t.apiKeys))]
-	if r.Header.Get("x-api-key") == securityKey {
+	r.Host = r.URL.Host
+
+	// Skip the addresses and keys which are quarantined
+	i, err := pick(r.Context(), t.addresses, n)
+	if err != nil {
+		return nil, err
+	}
+	address := t.addresses[i]
+	source := t.sources[i]
+	queue := t.wwwQueue[i]
+	if stats {
+		queue = t.statsQueue[i]
+	}
+
+	c := clientFrom(r.Context())
+	var key *throttle
+	keyLabel := "client"
+	if c != anonymousClient {
+		k, err := pick(r.Context(), t.keys, n)
+		if err != nil {
+			return nil, err
+		}
+		key = t.keys[k]
+		apiKey := t.apiKeys[k]
+		keyLabel = apiKeyLabel(k)
 		if *verbose {
 			fmt.Printf("Security key provided: %s\n", r.Header.Get("x-api-key"))
 			fmt.Printf("Using API Key: %s\n", apiKey)
@@ -140,23 +236,59 @@ func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
 		fmt.Printf("Sending Request: %s\n", r.URL.String())
 		fmt.Printf("Request Headers: %s\n", r.Header)
 	}
-	rt := t.rt[n%int64(len(t.rt))]
-	rl.Wait(r.Context())
-	return rt.RoundTrip(r)
+	rt := t.rt[i]
+
+	waitStart := time.Now()
+	if err := queue.wait(r.Context(), c.priority); err != nil {
+		return nil, err
+	}
+	limiterWait.WithLabelValues(r.Host, source, c.name).Observe(time.Since(waitStart).Seconds())
+
+	c.upstream.Add(1)
+	start := time.Now()
+	res, err := rt.RoundTrip(r)
+	requestDuration.WithLabelValues(r.Host, source).Observe(time.Since(start).Seconds())
+	if err != nil {
+		requests.WithLabelValues(r.Host, source, keyLabel, c.name, "error").Inc()
+		return nil, err
+	}
+
+	requests.WithLabelValues(r.Host, source, keyLabel, c.name, strconv.Itoa(res.StatusCode)).Inc()
+	if res.StatusCode == http.StatusOK {
+		address.succeed()
+		if key != nil {
+			key.succeed()
+		}
+		return res, nil
+	}
+
+	data := readBungieError(r.Host, res)
+	switch {
+	case res.StatusCode == http.StatusForbidden:
+		// Blocks are made by address
+		address.penalize(data.ThrottleSeconds)
+	case key != nil && (res.StatusCode == http.StatusTooManyRequests || data.ThrottleSeconds > 0 || throttleErrorCodes[data.ErrorCode]):
+		// Throttles count against the key. A client with its own key gets its throttle passed through
+		// without slowing the address down for everyone else.
+		key.penalize(data.ThrottleSeconds)
+	}
+	return res, nil
 }
 
+// Counts the bytes moved over an upstream connection
 type wrappedConn struct {
 	net.Conn
+	source string
 }
 
-// Read writes all data read from the underlying connection to sc.Writer.
 func (c wrappedConn) Read(b []byte) (int, error) {
-	readCounter.Incr(int64(len(b)))
-	return c.Conn.Read(b)
+	n, err := c.Conn.Read(b)
+	connBytes.WithLabelValues(c.source, "in").Add(float64(n))
+	return n, err
 }
 
-// Write writes all data written to the underlying connection to sc.Writer.
 func (c wrappedConn) Write(b []byte) (int, error) {
-	writeCounter.Incr(int64(len(b)))
-	return c.Conn.Write(b)
+	n, err := c.Conn.Write(b)
+	connBytes.WithLabelValues(c.source, "out").Add(float64(n))
+	return n, err
 }
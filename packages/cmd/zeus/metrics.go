@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var requests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "zeus_requests",
+	},
+	[]string{"host", "source", "api_key", "client", "status"},
+)
+
+// Bungie's ErrorStatus of responses which were not a 200
+var bungieErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "zeus_bungie_errors",
+	},
+	[]string{"host", "error_status"},
+)
+
+var requestDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "zeus_request_duration",
+		Buckets: []float64{0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{"host", "source"},
+)
+
+// Time spent waiting on the rate limiter of a source address
+var limiterWait = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "zeus_limiter_wait",
+		Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	},
+	[]string{"host", "source", "client"},
+)
+
+// Responses to each client, including cache hits and requests rejected by its quota
+var clientRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "zeus_client_requests",
+	},
+	[]string{"client", "status"},
+)
+
+// Bytes read from and written to upstream connections
+var connBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "zeus_bytes",
+	},
+	[]string{"source", "direction"},
+)
+
+// Fraction of its base rate each source address is allowed
+var rateFactor = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "zeus_rate_factor",
+	},
+	[]string{"name"},
+)
+
+// Throttled responses by the API key or source address they were blamed on
+var throttled = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "zeus_throttled",
+	},
+	[]string{"name"},
+)
+
+// Requests answered from the cache (hit), by sharing another client's upstream request (coalesced),
+// by going upstream (miss), or which can't be cached at all (bypass)
+var cacheRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "zeus_cache_requests",
+	},
+	[]string{"result"},
+)
+
+var cacheBytes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "zeus_cache_bytes",
+	},
+)
+
+var cacheEntries = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "zeus_cache_entries",
+	},
+)
+
+func registerMetrics() {
+	prometheus.MustRegister(requests)
+	prometheus.MustRegister(bungieErrors)
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(limiterWait)
+	prometheus.MustRegister(clientRequests)
+	prometheus.MustRegister(connBytes)
+	prometheus.MustRegister(rateFactor)
+	prometheus.MustRegister(throttled)
+	prometheus.MustRegister(cacheRequests)
+	prometheus.MustRegister(cacheBytes)
+	prometheus.MustRegister(cacheEntries)
+}
+
+// API keys are never used as labels, only their position in ZEUS_API_KEYS
+func apiKeyLabel(i int) string {
+	return "key" + strconv.Itoa(i)
+}
+
+type bungieResponse struct {
+	ErrorCode       int    `json:"ErrorCode"`
+	ErrorStatus     string `json:"ErrorStatus"`
+	ThrottleSeconds int    `json:"ThrottleSeconds"`
+}
+
+// Reads the error of a response which was not a 200, leaving the body to be read again by the client
+func readBungieError(host string, res *http.Response) bungieResponse {
+	var data bungieResponse
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+	res.Body = replayedBody{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+	if err == nil {
+		json.Unmarshal(body, &data)
+	}
+
+	status := data.ErrorStatus
+	if status == "" {
+		status = "Unknown"
+	}
+	bungieErrors.WithLabelValues(host, status).Inc()
+	return data
+}
+
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
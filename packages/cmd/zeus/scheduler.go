@@ -0,0 +1,125 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// A scheduler hands out the tokens of a rate limiter by priority. While nobody is waiting requests take
+// tokens straight from the limiter, once it is saturated waiters are served highest priority first and
+// in arrival order within a priority.
+type scheduler struct {
+	rl *rate.Limiter
+
+	mu      sync.Mutex
+	waiters waiterHeap
+	seq     int64
+	wake    chan struct{}
+}
+
+type waiter struct {
+	priority int
+	seq      int64
+	ready    chan struct{}
+	index    int // Position in the heap, -1 once it has been served
+}
+
+func newScheduler(rl *rate.Limiter) *scheduler {
+	s := &scheduler{
+		rl:   rl,
+		wake: make(chan struct{}, 1),
+	}
+	go s.run()
+	return s
+}
+
+// Blocks until a token is granted to the caller or ctx is done
+func (s *scheduler) wait(ctx context.Context, priority int) error {
+	s.mu.Lock()
+	if len(s.waiters) == 0 && s.rl.Allow() {
+		s.mu.Unlock()
+		return nil
+	}
+	w := &waiter{
+		priority: priority,
+		seq:      s.seq,
+		ready:    make(chan struct{}),
+	}
+	s.seq++
+	heap.Push(&s.waiters, w)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if w.index >= 0 {
+			heap.Remove(&s.waiters, w.index)
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *scheduler) run() {
+	for range s.wake {
+		for s.queued() > 0 {
+			// The limiter's rate never drops to zero, so this always returns
+			s.rl.Wait(context.Background())
+			s.mu.Lock()
+			// A token is lost if every waiter gave up in the meantime
+			if len(s.waiters) > 0 {
+				w := heap.Pop(&s.waiters).(*waiter)
+				close(w.ready)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *scheduler) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiters)
+}
+
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() any {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*h = old[:len(old)-1]
+	return w
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// A scheduler whose limiter has no tokens left and grants one every 50ms
+func saturatedScheduler() *scheduler {
+	rl := rate.NewLimiter(rate.Every(50*time.Millisecond), 1)
+	rl.Allow()
+	return newScheduler(rl)
+}
+
+// Queues waiters one at a time and returns the order they were granted tokens in
+func grantOrder(t *testing.T, s *scheduler, priorities []int) []string {
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for i, priority := range priorities {
+		name := fmt.Sprintf("%d:%d", i, priority)
+		queued := s.queued()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.wait(context.Background(), priority); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		}()
+		for s.queued() == queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wg.Wait()
+	return order
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	order := grantOrder(t, saturatedScheduler(), []int{0, 0, 10, 5, 10, 0})
+	want := "[2:10 4:10 3:5 0:0 1:0 5:0]"
+	if fmt.Sprint(order) != want {
+		t.Errorf("granted %v, want %s", order, want)
+	}
+}
+
+func TestSchedulerUnsaturated(t *testing.T) {
+	s := newScheduler(rate.NewLimiter(rate.Inf, 1))
+	for i := 0; i < 10; i++ {
+		if err := s.wait(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.queued(); n != 0 {
+		t.Errorf("%d waiters are queued", n)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := saturatedScheduler()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- s.wait(ctx, 100) }()
+	for s.queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("cancelled waiter returned %v", err)
+	}
+	if n := s.queued(); n != 0 {
+		t.Fatalf("the cancelled waiter is still queued with %d others", n-1)
+	}
+
+	// The next waiter is still served
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.wait(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	minQuarantine = 5 * time.Second
+	maxQuarantine = 5 * time.Minute
+	// Lowest fraction of its base rate a throttled address is slowed to
+	minFactor = 0.1
+	// Fraction of the base rate regained with each successful request
+	recoveryStep = 0.01
+	// Successful requests which forgive one strike
+	forgiveAfter = 100
+)
+
+// Bungie error codes which mean the caller is being throttled
+var throttleErrorCodes = map[int]bool{
+	35: true, // ThrottleLimitExceeded
+	36: true, // ThrottleLimitExceededMinutes
+	37: true, // ThrottleLimitExceededMomentarily
+	38: true, // ThrottleLimitExceededSeconds
+	51: true, // PerEndpointRequestThrottleExceeded
+}
+
+// A throttle tracks how Bungie is treating one API key or source address. Each throttled response
+// quarantines it for longer and halves the rate of its limiters, and successful requests recover
+// the rate a step at a time.
+type throttle struct {
+	name     string
+	limiters []*rate.Limiter
+	base     []rate.Limit
+
+	mu        sync.Mutex
+	strikes   int
+	successes int
+	until     time.Time
+	factor    float64
+}
+
+func newThrottle(name string, limiters ...*rate.Limiter) *throttle {
+	t := &throttle{
+		name:     name,
+		limiters: limiters,
+		factor:   1,
+	}
+	for _, rl := range limiters {
+		t.base = append(t.base, rl.Limit())
+	}
+	if len(limiters) > 0 {
+		rateFactor.WithLabelValues(name).Set(1)
+	}
+	return t
+}
+
+// The time its quarantine ends, which is in the past if it is available
+func (t *throttle) quarantinedUntil() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.until
+}
+
+func (t *throttle) rate() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.factor
+}
+
+// Records a throttled response. Bungie's ThrottleSeconds, if any, is the least it is quarantined for.
+func (t *throttle) penalize(throttleSeconds int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.strikes++
+	t.successes = 0
+	quarantine := minQuarantine << min(t.strikes-1, 10)
+	if quarantine > maxQuarantine {
+		quarantine = maxQuarantine
+	}
+	if wait := time.Duration(throttleSeconds) * time.Second; wait > quarantine {
+		quarantine = wait
+	}
+	t.until = time.Now().Add(quarantine)
+	throttled.WithLabelValues(t.name).Inc()
+
+	if len(t.limiters) == 0 {
+		log.Printf("Throttled %s, quarantined for %s", t.name, quarantine)
+		return
+	}
+	t.setFactor(max(t.factor/2, minFactor))
+	log.Printf("Throttled %s, quarantined for %s at %.0f%% of its rate", t.name, quarantine, t.factor*100)
+}
+
+// Records a successful response
+func (t *throttle) succeed() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.strikes > 0 {
+		t.successes++
+		if t.successes >= forgiveAfter {
+			t.strikes--
+			t.successes = 0
+		}
+	}
+	if t.factor < 1 && len(t.limiters) > 0 {
+		t.setFactor(min(t.factor+recoveryStep, 1))
+	}
+}
+
+func (t *throttle) setFactor(factor float64) {
+	t.factor = factor
+	for i, rl := range t.limiters {
+		rl.SetLimit(t.base[i] * rate.Limit(factor))
+	}
+	rateFactor.WithLabelValues(t.name).Set(factor)
+}
+
+// Picks the next available throttle in round robin order starting at n. If every one is quarantined,
+// waits for the one released first.
+func pick(ctx context.Context, throttles []*throttle, n int64) (int, error) {
+	now := time.Now()
+	soonest := -1
+	var soonestUntil time.Time
+	for j := 0; j < len(throttles); j++ {
+		i := int((n + int64(j)) % int64(len(throttles)))
+		until := throttles[i].quarantinedUntil()
+		if !until.After(now) {
+			return i, nil
+		}
+		if soonest == -1 || until.Before(soonestUntil) {
+			soonest, soonestUntil = i, until
+		}
+	}
+
+	timer := time.NewTimer(soonestUntil.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return soonest, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
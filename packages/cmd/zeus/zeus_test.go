@@ -0,0 +1,303 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"raidhub/packages/config"
+
+	"golang.org/x/time/rate"
+)
+
+// A stand-in for Bungie which records the API key of every request
+type upstream struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	keys  map[string][]string // by path
+	order []string            // paths in the order they arrived
+}
+
+func newUpstream(t *testing.T) *upstream {
+	u := &upstream{keys: make(map[string][]string)}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		u.keys[r.URL.Path] = append(u.keys[r.URL.Path], r.Header.Get("X-API-Key"))
+		u.order = append(u.order, r.URL.Path)
+		u.mu.Unlock()
+
+		if r.Header.Get(tokenHeader) != "" {
+			t.Errorf("%s was forwarded upstream", tokenHeader)
+		}
+
+		status, body := http.StatusOK, `{"ErrorCode":1,"ErrorStatus":"Success","Response":{}}`
+		if strings.Contains(r.URL.Path, "Throttled") {
+			status, body = http.StatusTooManyRequests, `{"ErrorCode":36,"ErrorStatus":"ThrottleLimitExceededMinutes","ThrottleSeconds":60}`
+		} else if strings.Contains(r.URL.Path, "Blocked") {
+			status, body = http.StatusForbidden, `{}`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// Bungie compresses whenever it is asked to
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(status)
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			io.WriteString(gz, body)
+			return
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *upstream) arrivals() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.order...)
+}
+
+func (u *upstream) keysFor(path string) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.keys[path]...)
+}
+
+type zeus struct {
+	*httptest.Server
+	transport *transport
+}
+
+// Starts Zeus in front of u with two pooled keys. clients are ZEUS_CLIENTS entries, by default one atlas client.
+func newZeus(t *testing.T, u *upstream, clients ...string) *zeus {
+	securityKey = "security"
+	cfg := config.Zeus{
+		APIKeys:       []string{"pool0", "pool1"},
+		Egress:        "default",
+		WWWUpstream:   u.URL,
+		StatsUpstream: u.URL,
+	}
+	egresses, err := newEgresses(cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) == 0 {
+		clients = []string{"atlas:token:10"}
+	}
+	parsed, err := parseClients(clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := parseCacheRules("/Destiny2/Stats/PostGameCarnageReport/=forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := newTransport(cfg.APIKeys, egresses)
+	handler, err := newProxy(cfg, newCache(tr, rules, 1<<20, ""), parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &zeus{server, tr}
+}
+
+func (z *zeus) get(t *testing.T, path string, header ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, z.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func TestKeySwapping(t *testing.T) {
+	u := newUpstream(t)
+	z := newZeus(t, u)
+
+	z.get(t, "/Platform/Destiny2/3/Profile/1/", "X-API-Key", "security")
+	z.get(t, "/Platform/Destiny2/3/Profile/2/", "X-API-Key", "mine")
+	z.get(t, "/Platform/Destiny2/3/Profile/3/", "X-API-Key", "mine", tokenHeader, "token")
+
+	for path, want := range map[string]string{
+		"/Platform/Destiny2/3/Profile/1/": "pool",
+		"/Platform/Destiny2/3/Profile/2/": "mine",
+		"/Platform/Destiny2/3/Profile/3/": "pool",
+	} {
+		keys := u.keysFor(path)
+		if len(keys) != 1 || !strings.HasPrefix(keys[0], want) {
+			t.Errorf("%s was sent with %v, want a %s key", path, keys, want)
+		}
+	}
+
+	if res := z.get(t, "/Platform/Settings/", tokenHeader, "unknown"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unknown token returned %d", res.StatusCode)
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	u := newUpstream(t)
+	z := newZeus(t, u)
+	const path = "/Platform/Destiny2/Stats/PostGameCarnageReport/1/"
+
+	first := z.get(t, path, "X-API-Key", "security")
+	second := z.get(t, path, "X-API-Key", "security")
+	if first.Header.Get("X-Zeus-Cache") != "miss" || second.Header.Get("X-Zeus-Cache") != "hit" {
+		t.Errorf("got %q then %q, want miss then hit", first.Header.Get("X-Zeus-Cache"), second.Header.Get("X-Zeus-Cache"))
+	}
+	var body struct{ ErrorCode int }
+	if err := json.NewDecoder(second.Body).Decode(&body); err != nil || body.ErrorCode != 1 {
+		t.Errorf("cached body is not the response: %v", err)
+	}
+
+	// Callers with their own key don't share the pooled keys' responses
+	if res := z.get(t, path, "X-API-Key", "mine"); res.Header.Get("X-Zeus-Cache") != "miss" {
+		t.Errorf("own key got %q, want miss", res.Header.Get("X-Zeus-Cache"))
+	}
+	if n := len(u.keysFor(path)); n != 2 {
+		t.Errorf("upstream was called %d times, want 2", n)
+	}
+}
+
+func TestThrottleQuarantine(t *testing.T) {
+	u := newUpstream(t)
+	z := newZeus(t, u)
+
+	z.get(t, "/Platform/Throttled/", "X-API-Key", "security")
+	keys := u.keysFor("/Platform/Throttled/")
+	if len(keys) != 1 {
+		t.Fatalf("upstream was called %d times", len(keys))
+	}
+	throttledKey := 0
+	if keys[0] == "pool1" {
+		throttledKey = 1
+	}
+	// ThrottleSeconds is read from the compressed body and is the least the key is quarantined for
+	if until := z.transport.keys[throttledKey].quarantinedUntil(); time.Until(until) < 50*time.Second {
+		t.Errorf("key%d is quarantined until %s", throttledKey, until)
+	}
+	if until := z.transport.addresses[0].quarantinedUntil(); until.After(time.Now()) {
+		t.Error("the address was quarantined for a throttled key")
+	}
+
+	// Every following request uses the other key
+	for i := 0; i < 3; i++ {
+		z.get(t, "/Platform/Settings/", "X-API-Key", "security")
+	}
+	for _, key := range u.keysFor("/Platform/Settings/") {
+		if key == z.transport.apiKeys[throttledKey] {
+			t.Errorf("the quarantined key%d was used", throttledKey)
+		}
+	}
+
+	// A caller with their own key gets the throttle, the address stays available to everyone else
+	res := z.get(t, "/Platform/Throttled/", "X-API-Key", "mine")
+	var body struct{ ThrottleSeconds int }
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || res.StatusCode != http.StatusTooManyRequests || body.ThrottleSeconds != 60 {
+		t.Errorf("own key got %d with ThrottleSeconds %d, want the throttle passed through", res.StatusCode, body.ThrottleSeconds)
+	}
+	if until := z.transport.addresses[0].quarantinedUntil(); until.After(time.Now()) {
+		t.Errorf("the address was quarantined until %s by a throttle on a caller's own key", until)
+	}
+	if rate := z.transport.addresses[0].rate(); rate != 1 {
+		t.Errorf("the address is at %.0f%% of its rate", rate*100)
+	}
+
+	// Blocks are made by address, whoever's key was used
+	z.get(t, "/Platform/Blocked/", "X-API-Key", "mine")
+	if until := z.transport.addresses[0].quarantinedUntil(); !until.After(time.Now()) {
+		t.Error("the address was not quarantined after a 403")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	u := newUpstream(t)
+	z := newZeus(t, u, "hermes:hermes-token:0:1")
+	const path = "/Platform/Destiny2/Stats/PostGameCarnageReport/1/"
+
+	if res := z.get(t, path, tokenHeader, "hermes-token"); res.StatusCode != http.StatusOK {
+		t.Fatalf("first request returned %d", res.StatusCode)
+	}
+
+	// Over quota, even though the response is cached
+	res := z.get(t, path, tokenHeader, "hermes-token")
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second request returned %d, want 429", res.StatusCode)
+	}
+	if retryAfter, _ := strconv.Atoi(res.Header.Get("Retry-After")); retryAfter < 1 {
+		t.Errorf("Retry-After is %q", res.Header.Get("Retry-After"))
+	}
+	var body struct {
+		ErrorCode       int
+		ErrorStatus     string
+		ThrottleSeconds int
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ErrorCode != 38 || body.ErrorStatus != "ThrottleLimitExceededSeconds" || body.ThrottleSeconds < 1 {
+		t.Errorf("got %+v, want a Bungie throttle", body)
+	}
+
+	// Other callers are not held to hermes' quota
+	if res := z.get(t, path, "X-API-Key", "security"); res.StatusCode != http.StatusOK {
+		t.Errorf("legacy caller got %d", res.StatusCode)
+	}
+	if n := len(u.keysFor(path)); n != 1 {
+		t.Errorf("upstream was called %d times, want 1", n)
+	}
+}
+
+// With the limiter saturated, atlas' requests overtake the hermes requests which queued before them
+func TestPriority(t *testing.T) {
+	u := newUpstream(t)
+	z := newZeus(t, u, "atlas:atlas-token:10", "hermes:hermes-token:0")
+	rl := rate.NewLimiter(rate.Every(100*time.Millisecond), 1)
+	rl.Allow()
+	queue := newScheduler(rl)
+	z.transport.wwwQueue[0] = queue
+
+	var wg sync.WaitGroup
+	send := func(path string, token string) {
+		queued := queue.queued()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			z.get(t, path, tokenHeader, token)
+		}()
+		for queue.queued() == queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	send("/Platform/Hermes1/", "hermes-token")
+	send("/Platform/Hermes2/", "hermes-token")
+	send("/Platform/Atlas1/", "atlas-token")
+	send("/Platform/Hermes3/", "hermes-token")
+	send("/Platform/Atlas2/", "atlas-token")
+	wg.Wait()
+
+	want := "[/Platform/Atlas1/ /Platform/Atlas2/ /Platform/Hermes1/ /Platform/Hermes2/ /Platform/Hermes3/]"
+	if got := fmt.Sprint(u.arrivals()); got != want {
+		t.Errorf("upstream saw %s, want %s", got, want)
+	}
+}
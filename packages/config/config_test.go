@@ -0,0 +1,47 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDSN(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Postgres
+		want string
+	}{
+		{
+			"fields",
+			Postgres{Host: "db", Port: 5432, User: "raidhub", Password: "secret", Database: "raidhub", SSLMode: "disable", ApplicationName: "atlas"},
+			"postgres://raidhub:secret@db:5432/raidhub?application_name=atlas&sslmode=disable",
+		},
+		{
+			"url",
+			Postgres{URL: "postgresql://raidhub@db/raidhub?application_name=mine", ApplicationName: "atlas", StatementTimeout: time.Second},
+			"postgresql://raidhub@db/raidhub?application_name=mine&statement_timeout=1000",
+		},
+		{
+			"key/value",
+			Postgres{URL: "host=db user=raidhub", ApplicationName: "atlas", StatementTimeout: time.Second, LockTimeout: 2 * time.Second},
+			"host=db user=raidhub application_name='atlas' statement_timeout='1000' lock_timeout='2000'",
+		},
+		{
+			"key/value with settings",
+			Postgres{URL: "host=db application_name = mine", ApplicationName: "it's", LockTimeout: time.Second},
+			"host=db application_name = mine lock_timeout='1000'",
+		},
+		{
+			"key/value quoting",
+			Postgres{URL: "host=db", ApplicationName: `it's a\name`},
+			`host=db application_name='it\'s a\\name'`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.DSN(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fills every field of the structs in cfg from the variable named by its env tag, falling back to its default tag
+func load(cfg *Config) error {
+	return walk(cfg, func(field reflect.Value, tag reflect.StructTag) error {
+		name := tag.Get("env")
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			value = tag.Get("default")
+		}
+		if value == "" {
+			return nil
+		}
+		if err := set(field, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// Logs every setting, showing only whether secrets are set
+func (c *Config) Log() {
+	log.Println("Configuration:")
+	walk(c, func(field reflect.Value, tag reflect.StructTag) error {
+		value := fmt.Sprint(field.Interface())
+		if field.Kind() == reflect.Slice {
+			value = strings.Trim(value, "[]")
+		}
+		if tag.Get("secret") == "true" && !field.IsZero() {
+			value = "[redacted]"
+		}
+		log.Printf("  %s=%s", tag.Get("env"), value)
+		return nil
+	})
+}
+
+func walk(cfg *Config, fn func(field reflect.Value, tag reflect.StructTag) error) error {
+	sections := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			if err := fn(section.Field(j), section.Type().Field(j).Tag); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func set(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case []string:
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Package messages wraps queue payloads in a versioned envelope. Every message type registers a decoder
+// for each schema version it has had, and all of them produce the current payload type, so producers and
+// consumers can be upgraded independently.
+package messages
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type Envelope struct {
+	Type          string          `json:"type"`
+	Version       int             `json:"version"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	CorrelationId string          `json:"correlationId"`
+	Origin        string          `json:"origin"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+var (
+	ErrUnknownType = errors.New("unknown message type")
+	ErrWrongType   = errors.New("message has the wrong type for this queue")
+)
+
+// Name of the service producing messages, defaults to the binary name
+var Origin = filepath.Base(os.Args[0])
+
+type decoder func(payload json.RawMessage) (any, error)
+
+type key struct {
+	msgType string
+	version int
+}
+
+var (
+	mu       sync.RWMutex
+	decoders = make(map[key]decoder)
+)
+
+// Registers how to decode version of msgType. Version 0 is a bare payload sent before envelopes existed.
+func Register(msgType string, version int, decode func(payload json.RawMessage) (any, error)) {
+	mu.Lock()
+	defer mu.Unlock()
+	decoders[key{msgType, version}] = decode
+}
+
+// A decoder which unmarshals the payload into a *T
+func JSON[T any]() func(payload json.RawMessage) (any, error) {
+	return func(payload json.RawMessage) (any, error) {
+		v := new(T)
+		if err := json.Unmarshal(payload, v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+// Wraps payload in an envelope, carrying over the correlation id from ctx or starting a new one
+func New(ctx context.Context, msgType string, version int, payload any) (*Envelope, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	correlationId := CorrelationId(ctx)
+	if correlationId == "" {
+		correlationId = newId()
+	}
+
+	return &Envelope{
+		Type:          msgType,
+		Version:       version,
+		CreatedAt:     time.Now().UTC(),
+		CorrelationId: correlationId,
+		Origin:        Origin,
+		Payload:       body,
+	}, nil
+}
+
+// The message to publish for the envelope
+func (e *Envelope) Publishing() (amqp.Publishing, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	return amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		Type:          e.Type,
+		CorrelationId: e.CorrelationId,
+		Timestamp:     e.CreatedAt,
+		AppId:         e.Origin,
+		Body:          body,
+	}, nil
+}
+
+// Returns ctx carrying the envelope's correlation id, so messages created from it share the id
+func (e *Envelope) Context(ctx context.Context) context.Context {
+	return WithCorrelationId(ctx, e.CorrelationId)
+}
+
+type correlationKey struct{}
+
+func WithCorrelationId(ctx context.Context, correlationId string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, correlationId)
+}
+
+// The correlation id carried by ctx, or "" if there is none
+func CorrelationId(ctx context.Context) string {
+	correlationId, _ := ctx.Value(correlationKey{}).(string)
+	return correlationId
+}
+
+// The correlation id of a delivery. Messages relayed from the outbox only carry it in the envelope.
+func DeliveryCorrelationId(msg amqp.Delivery) string {
+	if msg.CorrelationId != "" {
+		return msg.CorrelationId
+	}
+	var env struct {
+		CorrelationId string `json:"correlationId"`
+	}
+	if err := json.Unmarshal(msg.Body, &env); err != nil {
+		return ""
+	}
+	return env.CorrelationId
+}
+
+// Decodes body as a message of msgType into the current payload type T.
+// A body without an envelope is decoded as version 0 of msgType.
+func Decode[T any](body []byte, msgType string) (*T, *Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, nil, err
+	}
+	if env.Type == "" {
+		env = Envelope{
+			Type:    msgType,
+			Version: 0,
+			Payload: body,
+		}
+	} else if env.Type != msgType {
+		return nil, &env, fmt.Errorf("%w: expected %s, got %s", ErrWrongType, msgType, env.Type)
+	}
+
+	mu.RLock()
+	decode, ok := decoders[key{env.Type, env.Version}]
+	mu.RUnlock()
+	if !ok {
+		return nil, &env, fmt.Errorf("%w: %s version %d", ErrUnknownType, env.Type, env.Version)
+	}
+
+	v, err := decode(env.Payload)
+	if err != nil {
+		return nil, &env, err
+	}
+	payload, ok := v.(*T)
+	if !ok {
+		return nil, &env, fmt.Errorf("decoder for %s version %d returned %T", env.Type, env.Version, v)
+	}
+	return payload, &env, nil
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,18 @@
+package monitoring
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// 1 while a Bungie API system is enabled, 0 while it is disabled
+var BungieSystemEnabled = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "bungie_system_enabled",
+	},
+	[]string{"system"},
+)
+
+var BungieSystemTransitions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "bungie_system_transitions",
+	},
+	[]string{"system"},
+)
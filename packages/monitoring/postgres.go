@@ -0,0 +1,19 @@
+package monitoring
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Exports the pool statistics of db as go_sql_* metrics labelled with name
+func RegisterDBStats(db *sql.DB, name string) {
+	err := prometheus.Register(collectors.NewDBStatsCollector(db, name))
+	var registered prometheus.AlreadyRegisteredError
+	if err != nil && !errors.As(err, &registered) {
+		log.Printf("Failed to register database stats for %s: %s", name, err)
+	}
+}
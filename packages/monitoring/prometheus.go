@@ -23,10 +23,12 @@ var PGCRCrawlStatus = prometheus.NewCounterVec(
 	[]string{"status", "attempts"},
 )
 
+var PGCRCrawlLagBuckets = []float64{5, 15, 25, 30, 35, 40, 45, 60, 90, 300, 1800, 14400, 86400}
+
 var PGCRCrawlLag = prometheus.NewHistogramVec(
 	prometheus.HistogramOpts{
 		Name:    "pgcr_crawl_summary_lag",
-		Buckets: []float64{5, 15, 25, 30, 35, 40, 45, 60, 90, 300, 1800, 14400, 86400},
+		Buckets: PGCRCrawlLagBuckets,
 	},
 	[]string{"status", "attempts"},
 )
@@ -45,6 +47,13 @@ func RegisterPrometheus(port int) {
 	prometheus.MustRegister(PGCRCrawlLag)
 	prometheus.MustRegister(PGCRCrawlStatus)
 	prometheus.MustRegister(GetPostGameCarnageReportRequest)
+	prometheus.MustRegister(QueueMessages)
+	prometheus.MustRegister(QueueProcessingDuration)
+	prometheus.MustRegister(QueueInFlight)
+	prometheus.MustRegister(QueueConsumers)
+	prometheus.MustRegister(QueueDepth)
+	prometheus.MustRegister(BungieSystemEnabled)
+	prometheus.MustRegister(BungieSystemTransitions)
 
 	http.Handle("/metrics", promhttp.Handler())
 
@@ -0,0 +1,42 @@
+package monitoring
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Messages settled by a queue worker, by result (ack, retry, dead_letter or requeued)
+var QueueMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "queue_messages_processed",
+	},
+	[]string{"queue", "result"},
+)
+
+// Time spent in a queue worker's processor, in seconds
+var QueueProcessingDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "queue_processing_duration",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	},
+	[]string{"queue"},
+)
+
+var QueueInFlight = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "queue_messages_in_flight",
+	},
+	[]string{"queue"},
+)
+
+var QueueConsumers = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "queue_consumers",
+	},
+	[]string{"queue"},
+)
+
+// Messages ready in a queue and its retry and dead letter queues, as reported by the broker
+var QueueDepth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "queue_depth",
+	},
+	[]string{"queue"},
+)
@@ -0,0 +1,19 @@
+// Package outbox records RabbitMQ messages in Postgres inside the transaction which produces them,
+// so they are published if and only if the transaction commits. The relay publishes pending rows.
+package outbox
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// Records a message to be published to queue once tx commits
+func Write(tx *sql.Tx, queue string, message any) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO outbox (queue, body) VALUES ($1, $2)`, queue, body)
+	return err
+}
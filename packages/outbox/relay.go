@@ -0,0 +1,162 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"raidhub/packages/rabbit"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// A Relay publishes pending outbox rows in order with publisher confirms and marks them sent.
+// Several relays can run at once since rows are claimed with SKIP LOCKED. Delivery is at least once.
+// Messages are mandatory, so a row for a queue which doesn't exist is returned by the broker. Returned and
+// nacked rows are retried with exponential backoff, letting the rows behind them go first, and are parked
+// once they run out of attempts.
+type Relay struct {
+	Publisher    publisher
+	BatchSize    int
+	PollInterval time.Duration
+	// Sent rows older than this are deleted
+	Retention time.Duration
+	// The delay before the first retry of a row, which doubles with every attempt up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// Rows which fail this many times are parked, with a NULL next_attempt_at, until they are requeued by hand
+	MaxAttempts int
+
+	store store
+}
+
+// Publishes a message and waits for its confirm, implemented by rabbit.Publisher
+type publisher interface {
+	Publish(ctx context.Context, queue string, mandatory bool, msg amqp.Publishing) error
+}
+
+type pending struct {
+	id       int64
+	queue    string
+	body     []byte
+	attempts int
+}
+
+func NewRelay(db *sql.DB, client *rabbit.Client) *Relay {
+	return &Relay{
+		Publisher:     rabbit.NewPublisher(client),
+		BatchSize:     500,
+		PollInterval:  time.Second,
+		Retention:     24 * time.Hour,
+		RetryDelay:    10 * time.Second,
+		MaxRetryDelay: time.Hour,
+		MaxAttempts:   20,
+		store:         postgresStore{db},
+	}
+}
+
+// Relays until ctx is cancelled. A failed batch is retried after the poll interval.
+func (r *Relay) Run(ctx context.Context) {
+	lastPrune := time.Time{}
+	for {
+		if time.Since(lastPrune) > time.Hour {
+			if pruned, err := r.store.prune(r.Retention); err != nil {
+				log.Printf("Failed to prune the outbox: %s", err)
+			} else if pruned > 0 {
+				log.Printf("Pruned %d sent outbox rows", pruned)
+			}
+			lastPrune = time.Now()
+		}
+
+		sent, err := r.RelayBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to relay the outbox: %s", err)
+		}
+
+		if err != nil || sent < r.BatchSize {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.PollInterval):
+			}
+		}
+	}
+}
+
+// Publishes one batch of due rows and returns the number which were confirmed
+func (r *Relay) RelayBatch(ctx context.Context) (int, error) {
+	tx, err := r.store.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	batch, err := tx.claim(r.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	// Published one at a time to keep them in order, the rows handled before a failure are still marked
+	var acked, retried, parked []int64
+	var delays []time.Duration
+	var publishErr error
+	for _, p := range batch {
+		err := r.Publisher.Publish(ctx, p.queue, true, amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    strconv.FormatInt(p.id, 10),
+			Body:         p.body,
+		})
+		var returnedErr *rabbit.ReturnedError
+		if err == nil {
+			acked = append(acked, p.id)
+			continue
+		} else if !errors.As(err, &returnedErr) && !errors.Is(err, rabbit.ErrNacked) {
+			publishErr = err
+			break
+		}
+
+		if p.attempts+1 >= r.MaxAttempts {
+			log.Printf("Outbox message %d for %s failed %d times, parking it: %s", p.id, p.queue, p.attempts+1, err)
+			parked = append(parked, p.id)
+		} else {
+			delay := r.retryDelay(p.attempts)
+			log.Printf("Outbox message %d for %s failed, retrying in %s: %s", p.id, p.queue, delay, err)
+			retried = append(retried, p.id)
+			delays = append(delays, delay)
+		}
+	}
+
+	if len(retried) > 0 {
+		if err := tx.reschedule(retried, delays); err != nil {
+			return 0, err
+		}
+	}
+	if len(parked) > 0 {
+		if err := tx.park(parked); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.markSent(acked); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(acked), publishErr
+}
+
+// The delay before retrying a row which has failed attempts times before this failure
+func (r *Relay) retryDelay(attempts int) time.Duration {
+	delay := r.RetryDelay << min(attempts, 30)
+	if delay <= 0 || delay > r.MaxRetryDelay {
+		return r.MaxRetryDelay
+	}
+	return delay
+}
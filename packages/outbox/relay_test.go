@@ -0,0 +1,171 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"raidhub/packages/rabbit"
+	"sort"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// An outbox table in memory, with a clock the test moves
+type memoryStore struct {
+	now  time.Time
+	rows map[int64]*memoryRow
+}
+
+type memoryRow struct {
+	pending
+	sent          bool
+	nextAttemptAt *time.Time
+}
+
+type memoryTx struct {
+	s *memoryStore
+}
+
+func newMemoryStore(queues ...string) *memoryStore {
+	s := &memoryStore{now: time.Unix(1_700_000_000, 0), rows: make(map[int64]*memoryRow)}
+	for i, queue := range queues {
+		now := s.now
+		s.rows[int64(i+1)] = &memoryRow{pending: pending{id: int64(i + 1), queue: queue}, nextAttemptAt: &now}
+	}
+	return s
+}
+
+func (s *memoryStore) begin(ctx context.Context) (storeTx, error)   { return memoryTx{s}, nil }
+func (s *memoryStore) prune(retention time.Duration) (int64, error) { return 0, nil }
+
+func (tx memoryTx) claim(limit int) ([]pending, error) {
+	var batch []pending
+	for _, row := range tx.s.rows {
+		if !row.sent && row.nextAttemptAt != nil && !row.nextAttemptAt.After(tx.s.now) {
+			batch = append(batch, row.pending)
+		}
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].id < batch[j].id })
+	return batch[:min(limit, len(batch))], nil
+}
+
+func (tx memoryTx) markSent(ids []int64) error {
+	for _, id := range ids {
+		tx.s.rows[id].sent = true
+		tx.s.rows[id].attempts++
+	}
+	return nil
+}
+
+func (tx memoryTx) reschedule(ids []int64, delays []time.Duration) error {
+	for i, id := range ids {
+		next := tx.s.now.Add(delays[i])
+		tx.s.rows[id].nextAttemptAt = &next
+		tx.s.rows[id].attempts++
+	}
+	return nil
+}
+
+func (tx memoryTx) park(ids []int64) error {
+	for _, id := range ids {
+		tx.s.rows[id].nextAttemptAt = nil
+		tx.s.rows[id].attempts++
+	}
+	return nil
+}
+
+func (tx memoryTx) Commit() error   { return nil }
+func (tx memoryTx) Rollback() error { return nil }
+
+// Returns messages for queues which don't exist, like a broker with mandatory publishes
+type fakePublisher struct {
+	queues    map[string]bool
+	published []string
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, queue string, mandatory bool, msg amqp.Publishing) error {
+	if !mandatory {
+		return errors.New("not mandatory")
+	}
+	if !p.queues[queue] {
+		return &rabbit.ReturnedError{Queue: queue, ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	}
+	p.published = append(p.published, msg.MessageId)
+	return nil
+}
+
+func newTestRelay(s *memoryStore, p *fakePublisher) *Relay {
+	return &Relay{
+		Publisher:     p,
+		BatchSize:     2,
+		RetryDelay:    10 * time.Second,
+		MaxRetryDelay: time.Minute,
+		MaxAttempts:   4,
+		store:         s,
+	}
+}
+
+func TestReturnedRowsDoNotStarve(t *testing.T) {
+	// The two rows at the head of the outbox are for a queue which doesn't exist
+	s := newMemoryStore("missing", "missing", "player_requests", "player_requests", "player_requests")
+	p := &fakePublisher{queues: map[string]bool{"player_requests": true}}
+	relay := newTestRelay(s, p)
+
+	for i := 0; i < 3; i++ {
+		if _, err := relay.RelayBatch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(p.published) != "[3 4 5]" {
+		t.Errorf("published %v, want the rows behind the returned ones", p.published)
+	}
+	for _, id := range []int64{1, 2} {
+		row := s.rows[id]
+		if row.sent || row.attempts != 1 || !row.nextAttemptAt.Equal(s.now.Add(10*time.Second)) {
+			t.Errorf("row %d: sent %t after %d attempts, next at %s", id, row.sent, row.attempts, row.nextAttemptAt)
+		}
+	}
+}
+
+func TestReturnedRowsBackOffAndPark(t *testing.T) {
+	s := newMemoryStore("missing")
+	p := &fakePublisher{}
+	relay := newTestRelay(s, p)
+	row := s.rows[1]
+
+	for _, want := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second} {
+		relay.RelayBatch(context.Background())
+		if got := row.nextAttemptAt.Sub(s.now); got != want {
+			t.Fatalf("retry after %d attempts in %s, want %s", row.attempts, got, want)
+		}
+		// Not due yet
+		relay.RelayBatch(context.Background())
+		s.now = *row.nextAttemptAt
+	}
+
+	relay.RelayBatch(context.Background())
+	if row.nextAttemptAt != nil || row.attempts != 4 {
+		t.Fatalf("row was not parked after %d attempts", row.attempts)
+	}
+	s.now = s.now.Add(time.Hour)
+	if batch, _ := (memoryTx{s}).claim(10); len(batch) != 0 {
+		t.Errorf("parked row was claimed")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	relay := &Relay{RetryDelay: 10 * time.Second, MaxRetryDelay: time.Hour}
+	for attempts, want := range map[int]time.Duration{
+		0:   10 * time.Second,
+		1:   20 * time.Second,
+		8:   2560 * time.Second,
+		9:   time.Hour,
+		100: time.Hour,
+	} {
+		if got := relay.retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
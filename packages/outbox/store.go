@@ -0,0 +1,97 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The outbox table as the relay uses it, so the relay can be tested without Postgres
+type store interface {
+	begin(ctx context.Context) (storeTx, error)
+	// Deletes rows which were sent longer than retention ago
+	prune(retention time.Duration) (int64, error)
+}
+
+// Rows claimed by a transaction stay locked from other relays until it ends
+type storeTx interface {
+	// Claims up to limit rows which are due, in id order, skipping parked rows and rows claimed by other relays
+	claim(limit int) ([]pending, error)
+	markSent(ids []int64) error
+	// Counts a failed attempt at each row and makes it due again after its delay
+	reschedule(ids []int64, delays []time.Duration) error
+	// Counts a failed attempt at each row and stops retrying it
+	park(ids []int64) error
+	Commit() error
+	Rollback() error
+}
+
+type postgresStore struct {
+	db *sql.DB
+}
+
+type postgresTx struct {
+	*sql.Tx
+}
+
+func (s postgresStore) begin(ctx context.Context) (storeTx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return postgresTx{tx}, nil
+}
+
+func (s postgresStore) prune(retention time.Duration) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM outbox WHERE sent_at < NOW() - $1 * INTERVAL '1 second'`, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (tx postgresTx) claim(limit int) ([]pending, error) {
+	rows, err := tx.Query(`SELECT id, queue, body, attempts FROM outbox
+		WHERE sent_at IS NULL AND next_attempt_at <= NOW()
+		ORDER BY id ASC
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.queue, &p.body, &p.attempts); err != nil {
+			return nil, err
+		}
+		batch = append(batch, p)
+	}
+	return batch, rows.Err()
+}
+
+func (tx postgresTx) markSent(ids []int64) error {
+	_, err := tx.Exec(`UPDATE outbox SET sent_at = NOW(), attempts = attempts + 1 WHERE id = ANY($1)`, pq.Array(ids))
+	return err
+}
+
+func (tx postgresTx) reschedule(ids []int64, delays []time.Duration) error {
+	seconds := make([]float64, len(delays))
+	for i, d := range delays {
+		seconds[i] = d.Seconds()
+	}
+	_, err := tx.Exec(`UPDATE outbox
+		SET attempts = attempts + 1, next_attempt_at = NOW() + d.delay * INTERVAL '1 second'
+		FROM UNNEST($1::bigint[], $2::float8[]) AS d(id, delay)
+		WHERE outbox.id = d.id`, pq.Array(ids), pq.Array(seconds))
+	return err
+}
+
+func (tx postgresTx) park(ids []int64) error {
+	_, err := tx.Exec(`UPDATE outbox SET attempts = attempts + 1, next_attempt_at = NULL WHERE id = ANY($1)`, pq.Array(ids))
+	return err
+}
@@ -1,14 +1,14 @@
 package pgcr
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
-	"os"
 	"raidhub/packages/bungie"
 	"raidhub/packages/monitoring"
 	"raidhub/packages/pgcr_types"
-	"sync"
 	"time"
 )
 
@@ -22,90 +22,67 @@ const (
 	InsufficientPrivileges PGCRResult = 5
 	BadFormat              PGCRResult = 6
 	InternalError          PGCRResult = 7
+	StoreFailed            PGCRResult = 8
 )
 
-var (
-	pgcrUrlBase string
-	once        sync.Once
-)
-
-func getPgcrURL() string {
-	once.Do(func() {
-		pgcrUrlBase = os.Getenv("PGCR_URL_BASE")
-		if pgcrUrlBase == "" {
-			pgcrUrlBase = "https://stats.bungie.net/"
-		}
-	})
-	return pgcrUrlBase
-}
-
-func FetchAndProcessPGCR(client *http.Client, instanceID int64, apiKey string) (PGCRResult, *pgcr_types.ProcessedActivity, *bungie.DestinyPostGameCarnageReport, error) {
+func FetchAndProcessPGCR(ctx context.Context, client *bungie.Client, instanceID int64) (PGCRResult, *pgcr_types.ProcessedActivity, *bungie.DestinyPostGameCarnageReport, error) {
 	start := time.Now()
-	decoder, statusCode, cleanup, err := bungie.GetPGCR(client, getPgcrURL(), instanceID, apiKey)
-	if err != nil {
-		log.Printf("Error fetching instanceId %d: %s", instanceID, err)
-		return InternalError, nil, nil, err
-	}
-	defer cleanup()
+	report, err := client.GetPGCR(ctx, instanceID)
 
-	if statusCode != http.StatusOK {
-		var data bungie.BungieError
-		if err := decoder.Decode(&data); err != nil {
+	var apiErr *bungie.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.ErrorStatus == "" {
 			log.Printf("Error decoding response for instanceId %d: %s", instanceID, err)
-			monitoring.GetPostGameCarnageReportRequest.WithLabelValues(fmt.Sprintf("Unknown%d", statusCode)).Observe(float64(time.Since(start).Milliseconds()))
-			if statusCode == 404 {
+			monitoring.GetPostGameCarnageReportRequest.WithLabelValues(fmt.Sprintf("Unknown%d", apiErr.StatusCode)).Observe(float64(time.Since(start).Milliseconds()))
+			if apiErr.StatusCode == 404 {
 				return NotFound, nil, nil, err
-			} else if statusCode == 403 {
+			} else if apiErr.StatusCode == 403 {
 				// Rate Limit
 				time.Sleep(120 * time.Second)
 			}
 			return BadFormat, nil, nil, err
 		}
-		monitoring.GetPostGameCarnageReportRequest.WithLabelValues(data.ErrorStatus).Observe(float64(time.Since(start).Milliseconds()))
+		monitoring.GetPostGameCarnageReportRequest.WithLabelValues(apiErr.ErrorStatus).Observe(float64(time.Since(start).Milliseconds()))
 
-		defer func() {
-			if data.ThrottleSeconds > 0 {
-				log.Printf("Throttled: %d seconds", data.ThrottleSeconds)
-				time.Sleep(time.Duration(data.ThrottleSeconds) * time.Second)
-			}
-		}()
-
-		if data.ErrorCode == 1653 {
+		if apiErr.ErrorCode == 1653 {
 			// PGCRNotFound
-			return NotFound, nil, nil, fmt.Errorf("%s", data.ErrorStatus)
+			return NotFound, nil, nil, fmt.Errorf("%s", apiErr.ErrorStatus)
 		}
 
-		log.Printf("Error response for instanceId %d: %s (%d)", instanceID, data.Message, data.ErrorCode)
-		if data.ErrorCode == 5 {
+		log.Printf("Error response for instanceId %d: %s (%d)", instanceID, apiErr.Message, apiErr.ErrorCode)
+		if apiErr.ErrorCode == 5 {
 			// SystemDisabled
-			return SystemDisabled, nil, nil, fmt.Errorf("%s", data.ErrorStatus)
-		} else if data.ErrorCode == 1672 {
+			return SystemDisabled, nil, nil, fmt.Errorf("%s", apiErr.ErrorStatus)
+		} else if apiErr.ErrorCode == 1672 {
 			// BabelTimeout
-			return NotFound, nil, nil, fmt.Errorf("%s", data.ErrorStatus)
-		} else if data.ErrorCode == 12 {
+			return NotFound, nil, nil, fmt.Errorf("%s", apiErr.ErrorStatus)
+		} else if apiErr.ErrorCode == 12 {
 			// InsufficientPrivileges, redacted
-			return InsufficientPrivileges, nil, nil, fmt.Errorf("%s", data.ErrorStatus)
+			return InsufficientPrivileges, nil, nil, fmt.Errorf("%s", apiErr.ErrorStatus)
 		}
 
 		return BadFormat, nil, nil, nil
+	} else if err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			log.Printf("Error decoding response for instanceId %d: %s", instanceID, err)
+			return BadFormat, nil, nil, err
+		}
+		log.Printf("Error fetching instanceId %d: %s", instanceID, err)
+		return InternalError, nil, nil, err
 	}
+	monitoring.GetPostGameCarnageReportRequest.WithLabelValues("Success").Observe(float64(time.Since(start).Milliseconds()))
 
-	var data bungie.DestinyPostGameCarnageReportResponse
-	if err := decoder.Decode(&data); err != nil {
-		log.Printf("Error decoding response for instanceId %d: %s", instanceID, err)
-		return BadFormat, nil, nil, err
-	}
-	monitoring.GetPostGameCarnageReportRequest.WithLabelValues(data.ErrorStatus).Observe(float64(time.Since(start).Milliseconds()))
-
-	if data.Response.ActivityDetails.Mode != 4 {
-		return NonRaid, nil, &data.Response, nil
+	if report.ActivityDetails.Mode != 4 {
+		return NonRaid, nil, report, nil
 	}
 
-	pgcr, err := ProcessDestinyReport(&data.Response)
+	pgcr, err := ProcessDestinyReport(report)
 	if err != nil {
 		log.Println(err)
 		return BadFormat, nil, nil, err
 	}
 
-	return Success, pgcr, &data.Response, nil
+	return Success, pgcr, report, nil
 }
@@ -0,0 +1,53 @@
+package golden
+
+import (
+	"fmt"
+
+	"raidhub/packages/bungie"
+)
+
+const (
+	anonymousMembershipId = 4611686018400000000
+	anonymousCharacterId  = 2305843009200000000
+)
+
+// Replaces the identity of every player with a stable placeholder. Players keep their relative order
+// and a player's characters stay grouped under the same membership id, so processing is unaffected.
+func Anonymize(report *bungie.DestinyPostGameCarnageReport) {
+	memberships := make(map[int64]int64)
+	characters := make(map[int64]int64)
+
+	for i := range report.Entries {
+		entry := &report.Entries[i]
+		userInfo := &entry.Player.DestinyUserInfo
+
+		membershipId, ok := memberships[userInfo.MembershipId]
+		if !ok {
+			membershipId = anonymousMembershipId + int64(len(memberships)+1)
+			memberships[userInfo.MembershipId] = membershipId
+		}
+		characterId, ok := characters[entry.CharacterId]
+		if !ok {
+			characterId = anonymousCharacterId + int64(len(characters)+1)
+			characters[entry.CharacterId] = characterId
+		}
+
+		userInfo.MembershipId = membershipId
+		entry.CharacterId = characterId
+		userInfo.IconPath = nil
+
+		n := membershipId - anonymousMembershipId
+		if userInfo.DisplayName != nil {
+			displayName := fmt.Sprintf("Player%d", n)
+			userInfo.DisplayName = &displayName
+		}
+		if userInfo.BungieGlobalDisplayName != nil && *userInfo.BungieGlobalDisplayName != "" {
+			globalDisplayName := fmt.Sprintf("Player%d", n)
+			userInfo.BungieGlobalDisplayName = &globalDisplayName
+		}
+		if userInfo.BungieGlobalDisplayNameCode != nil {
+			code := int(n)
+			userInfo.BungieGlobalDisplayNameCode = &code
+		}
+	}
+}
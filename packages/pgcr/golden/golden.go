@@ -0,0 +1,186 @@
+// Package golden checks ProcessDestinyReport against a corpus of raw PGCRs and their expected output.
+//
+// Each case is a pair of files in the corpus directory: <name>.pgcr.json holds the raw PGCR in the
+// same format stored in the pgcr table, and <name>.golden.json holds the processed activity.
+//
+// Cases are named <raid>-<era>-<rule> or <rule>-<variant> after the processing rule they pin down.
+// Until instances are exported from production with `themis -export`, the corpus holds hand-built
+// reports, one per rule, written through Export so they have the same shape and anonymized ids.
+package golden
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"raidhub/packages/bungie"
+	"raidhub/packages/pgcr"
+	"raidhub/packages/pgcr_types"
+)
+
+const (
+	rawSuffix    = ".pgcr.json"
+	goldenSuffix = ".golden.json"
+)
+
+type Case struct {
+	Name string
+	Dir  string
+}
+
+func (c Case) RawPath() string {
+	return filepath.Join(c.Dir, c.Name+rawSuffix)
+}
+
+func (c Case) GoldenPath() string {
+	return filepath.Join(c.Dir, c.Name+goldenSuffix)
+}
+
+// Returns every case in the corpus directory, sorted by name
+func Load(dir string) ([]Case, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+rawSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	cases := make([]Case, 0, len(matches))
+	for _, match := range matches {
+		cases = append(cases, Case{
+			Name: strings.TrimSuffix(filepath.Base(match), rawSuffix),
+			Dir:  dir,
+		})
+	}
+	return cases, nil
+}
+
+// Processes the raw PGCR of a case. Players are sorted by membership id so the output is stable.
+func (c Case) Process() (*pgcr_types.ProcessedActivity, error) {
+	data, err := os.ReadFile(c.RawPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var report bungie.DestinyPostGameCarnageReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+
+	processed, err := pgcr.ProcessDestinyReport(&report)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(processed.Players, func(i, j int) bool {
+		return processed.Players[i].Player.MembershipId < processed.Players[j].Player.MembershipId
+	})
+	return processed, nil
+}
+
+// Processes the case and returns the differences from its golden file, one per line
+func (c Case) Check() ([]string, error) {
+	processed, err := c.Process()
+	if err != nil {
+		return nil, err
+	}
+
+	golden, err := os.ReadFile(c.GoldenPath())
+	if err != nil {
+		return nil, err
+	}
+
+	actual, err := json.Marshal(processed)
+	if err != nil {
+		return nil, err
+	}
+
+	var want, got any
+	if err := json.Unmarshal(golden, &want); err != nil {
+		return nil, fmt.Errorf("invalid golden file: %s", err)
+	}
+	if err := json.Unmarshal(actual, &got); err != nil {
+		return nil, err
+	}
+
+	return diff("", want, got), nil
+}
+
+// Rewrites the golden file of the case from the current processing rules
+func (c Case) Update() error {
+	processed, err := c.Process()
+	if err != nil {
+		return err
+	}
+	return writeJSON(c.GoldenPath(), processed)
+}
+
+// Writes an anonymized raw PGCR into the corpus as a new case along with its golden file
+func Export(dir string, name string, report *bungie.DestinyPostGameCarnageReport) (*Case, error) {
+	Anonymize(report)
+
+	c := Case{Name: name, Dir: dir}
+	if err := writeJSON(c.RawPath(), report); err != nil {
+		return nil, err
+	}
+	if err := c.Update(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func diff(path string, want any, got any) []string {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(w)+len(g))
+		for key := range w {
+			keys = append(keys, key)
+		}
+		for key := range g {
+			if _, ok := w[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		var diffs []string
+		for _, key := range keys {
+			diffs = append(diffs, diff(path+"."+key, w[key], g[key])...)
+		}
+		return diffs
+	case []any:
+		g, ok := got.([]any)
+		if !ok {
+			break
+		}
+		if len(w) != len(g) {
+			return []string{fmt.Sprintf("%s: expected %d elements, got %d", path, len(w), len(g))}
+		}
+
+		var diffs []string
+		for i := range w {
+			diffs = append(diffs, diff(fmt.Sprintf("%s[%d]", path, i), w[i], g[i])...)
+		}
+		return diffs
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		return []string{fmt.Sprintf("%s: expected %v, got %v", path, want, got)}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package golden
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files instead of checking them")
+
+// Run with -update after an intended change to the processing rules, then review the diff of the golden files
+func TestCorpus(t *testing.T) {
+	cases, err := Load("corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("the corpus is empty")
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			if *update {
+				if err := c.Update(); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			diffs, err := c.Check()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diffs) > 0 {
+				t.Errorf("differs from %s:\n\t%s", c.GoldenPath(), strings.Join(diffs, "\n\t"))
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package pgcr
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	missedRetryBase    = 30 * time.Minute
+	missedRetryMax     = 7 * 24 * time.Hour
+	missedMaxAttempts  = 12
+	missedClaimTimeout = time.Hour
+)
+
+// Records a failed attempt at an instance id and schedules its next retry with exponential backoff
+func WriteMissed(db *sql.DB, instanceId int64, result PGCRResult) error {
+	_, err := db.Exec(`INSERT INTO missed_instance (instance_id, last_result, attempts, next_retry)
+		VALUES ($1, $2, 1, NOW() + $3 * INTERVAL '1 second')
+		ON CONFLICT (instance_id)
+		DO UPDATE SET
+			last_result = $2,
+			attempts = missed_instance.attempts + 1,
+			next_retry = CASE
+					WHEN missed_instance.attempts + 1 >= $5 THEN NULL
+					ELSE NOW() + LEAST($4, $3 * POWER(2, missed_instance.attempts)) * INTERVAL '1 second'
+				END`,
+		instanceId, result, missedRetryBase.Seconds(), missedRetryMax.Seconds(), missedMaxAttempts)
+	return err
+}
+
+// Records a range of instance ids around a missed instance, which is expanded when retries are scheduled
+func WriteMissedRange(db *sql.DB, startId int64, endId int64, reason string) error {
+	_, err := db.Exec(`INSERT INTO missed_instance_range (start_id, end_id, reason) VALUES ($1, $2, $3)`,
+		startId, endId, reason)
+	return err
+}
+
+// Removes an instance id which has been stored or found to be a non-raid
+func ResolveMissed(db *sql.DB, instanceId int64) error {
+	_, err := db.Exec(`DELETE FROM missed_instance WHERE instance_id = $1`, instanceId)
+	return err
+}
+
+// Expands every pending range into individual missed instances, skipping ids which are already stored
+func ExpandMissedRanges(db *sql.DB) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`DELETE FROM missed_instance_range RETURNING start_id, end_id`)
+	if err != nil {
+		return 0, err
+	}
+
+	type idRange struct{ start, end int64 }
+	var ranges []idRange
+	for rows.Next() {
+		var r idRange
+		if err := rows.Scan(&r.start, &r.end); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ranges = append(ranges, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var added int64
+	for _, r := range ranges {
+		result, err := tx.Exec(`INSERT INTO missed_instance (instance_id)
+			SELECT id FROM generate_series($1::bigint, $2::bigint) AS id
+			WHERE NOT EXISTS (SELECT 1 FROM instance WHERE instance_id = id)
+				AND NOT EXISTS (SELECT 1 FROM instance_non_raid_range WHERE int8range(start_id, end_id, '[]') @> id)
+			ON CONFLICT (instance_id) DO NOTHING`, r.start, r.end)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		added += n
+	}
+
+	return added, tx.Commit()
+}
+
+// Claims up to limit instance ids which are due for a retry. Claimed ids are not due again until
+// the claim expires, so a crashed run does not lose them.
+func ClaimDueMissed(db *sql.DB, limit int) ([]int64, error) {
+	rows, err := db.Query(`UPDATE missed_instance
+		SET next_retry = NOW() + $2 * INTERVAL '1 second'
+		WHERE instance_id IN (
+			SELECT instance_id FROM missed_instance
+			WHERE next_retry <= NOW()
+			ORDER BY instance_id ASC
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING instance_id`, limit, missedClaimTimeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Inserts instance ids from the legacy missed.log into the missed instance table
+func ImportMissed(db *sql.DB, instanceIds []int64) (int64, error) {
+	result, err := db.Exec(`INSERT INTO missed_instance (instance_id)
+		SELECT UNNEST($1::bigint[])
+		ON CONFLICT (instance_id) DO NOTHING`, pq.Array(instanceIds))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
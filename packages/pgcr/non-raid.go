@@ -0,0 +1,79 @@
+package pgcr
+
+import (
+	"database/sql"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// An inclusive range of instance ids
+type IdRange struct {
+	Start int64
+	End   int64
+}
+
+// Records an instance id which resolved to a non-raid activity, so that audits can tell
+// the difference between ids which were never attempted and ids which are not raids
+func StoreNonRaid(instanceId int64, db *sql.DB) error {
+	return StoreNonRaids([]int64{instanceId}, db)
+}
+
+// Records a batch of non-raid instance ids in one statement, as one row per contiguous run
+func StoreNonRaids(instanceIds []int64, db *sql.DB) error {
+	ranges := NonRaidRanges(instanceIds)
+	if len(ranges) == 0 {
+		return nil
+	}
+	starts := make([]int64, len(ranges))
+	ends := make([]int64, len(ranges))
+	for i, r := range ranges {
+		starts[i] = r.Start
+		ends[i] = r.End
+	}
+	_, err := db.Exec(`INSERT INTO instance_non_raid_range (start_id, end_id)
+		SELECT * FROM UNNEST($1::bigint[], $2::bigint[])`, pq.Array(starts), pq.Array(ends))
+	return err
+}
+
+// Collapses instance ids into sorted contiguous ranges
+func NonRaidRanges(instanceIds []int64) []IdRange {
+	ids := append([]int64(nil), instanceIds...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var ranges []IdRange
+	for _, id := range ids {
+		if n := len(ranges); n > 0 && id <= ranges[n-1].End+1 {
+			ranges[n-1].End = max(ranges[n-1].End, id)
+			continue
+		}
+		ranges = append(ranges, IdRange{Start: id, End: id})
+	}
+	return ranges
+}
+
+// Returns the merged non-raid ranges which overlap the ids strictly between after and before, clipped to them
+func GetNonRaidRanges(db *sql.DB, after int64, before int64) ([]IdRange, error) {
+	rows, err := db.Query(`SELECT GREATEST(start_id, $1 + 1), LEAST(end_id, $2 - 1) FROM instance_non_raid_range
+		WHERE int8range(start_id, end_id, '[]') && int8range($1, $2, '()')
+		ORDER BY 1`, after, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ranges []IdRange
+	for rows.Next() {
+		var r IdRange
+		if err := rows.Scan(&r.Start, &r.End); err != nil {
+			return nil, err
+		}
+		// Rows come ordered by start, so overlapping rows merge into the last range
+		if n := len(ranges); n > 0 && r.Start <= ranges[n-1].End+1 {
+			ranges[n-1].End = max(ranges[n-1].End, r.End)
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, rows.Err()
+}
@@ -0,0 +1,16 @@
+package pgcr
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNonRaidRanges(t *testing.T) {
+	got := NonRaidRanges([]int64{12, 3, 4, 10, 5, 11, 4, 20})
+	if want := "[{3 5} {10 12} {20 20}]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+	if got := NonRaidRanges(nil); len(got) != 0 {
+		t.Errorf("got %v for no ids", got)
+	}
+}
@@ -0,0 +1,365 @@
+package pgcr
+
+import (
+	"database/sql"
+	"fmt"
+	"raidhub/packages/pgcr_types"
+	"raidhub/packages/postgres"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Compares the rows stored for an instance against a freshly processed activity. Each difference
+// is reported as "table[key].column: stored X, processed Y". The per-player aggregates written by
+// StorePGCR (sherpas, first clears, player_stats) are not compared.
+func DiffStored(pgcr *pgcr_types.ProcessedActivity, db *sql.DB) ([]string, error) {
+	stored, err := storedRows(pgcr.InstanceId, db)
+	if err != nil {
+		return nil, err
+	}
+	processed := processedRows(pgcr)
+
+	keys := make([]string, 0, len(processed))
+	for key := range processed {
+		keys = append(keys, key)
+	}
+	for key := range stored {
+		if _, ok := processed[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var diffs []string
+	for _, key := range keys {
+		s, inStored := stored[key]
+		p, inProcessed := processed[key]
+		if !inStored {
+			s = "<missing>"
+		}
+		if !inProcessed {
+			p = "<missing>"
+		}
+		if s != p {
+			diffs = append(diffs, fmt.Sprintf("%s: stored %s, processed %s", key, s, p))
+		}
+	}
+	return diffs, nil
+}
+
+// Rewrites the instance, instance_player, instance_character and instance_character_weapon rows of
+// an already stored instance from a freshly processed activity
+func ReplaceStored(pgcr *pgcr_types.ProcessedActivity, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE "instance" SET
+			"hash" = $2,
+			"flawless" = $3,
+			"completed" = $4,
+			"fresh" = $5,
+			"player_count" = $6,
+			"date_started" = $7,
+			"date_completed" = $8,
+			"platform_type" = $9,
+			"duration" = $10,
+			"score" = $11
+		WHERE "instance_id" = $1`, pgcr.InstanceId, pgcr.Hash,
+		pgcr.Flawless, pgcr.Completed, pgcr.Fresh, pgcr.PlayerCount,
+		pgcr.DateStarted, pgcr.DateCompleted, pgcr.MembershipType, pgcr.DurationSeconds, pgcr.Score)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("instance %d is not stored", pgcr.InstanceId)
+	}
+
+	var membershipIds, characterIds, weaponCharacterIds, weaponMembershipIds, weaponHashes []int64
+	for _, playerActivity := range pgcr.Players {
+		if _, err := postgres.UpsertPlayer(tx, &playerActivity.Player); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO "instance_player" ("instance_id", "membership_id", "completed", "time_played_seconds")
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT ("instance_id", "membership_id")
+			DO UPDATE SET "completed" = EXCLUDED."completed", "time_played_seconds" = EXCLUDED."time_played_seconds"`,
+			pgcr.InstanceId, playerActivity.Player.MembershipId, playerActivity.Finished, playerActivity.TimePlayedSeconds)
+		if err != nil {
+			return err
+		}
+
+		for _, character := range playerActivity.Characters {
+			membershipIds = append(membershipIds, playerActivity.Player.MembershipId)
+			characterIds = append(characterIds, character.CharacterId)
+
+			_, err = tx.Exec(`INSERT INTO "instance_character" (
+					"instance_id", "membership_id", "character_id", "class_hash", "emblem_hash", "completed",
+					"score", "kills", "assists", "deaths", "precision_kills", "super_kills", "grenade_kills",
+					"melee_kills", "time_played_seconds", "start_seconds"
+				)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+				ON CONFLICT ("instance_id", "membership_id", "character_id")
+				DO UPDATE SET
+					"class_hash" = EXCLUDED."class_hash",
+					"emblem_hash" = EXCLUDED."emblem_hash",
+					"completed" = EXCLUDED."completed",
+					"score" = EXCLUDED."score",
+					"kills" = EXCLUDED."kills",
+					"assists" = EXCLUDED."assists",
+					"deaths" = EXCLUDED."deaths",
+					"precision_kills" = EXCLUDED."precision_kills",
+					"super_kills" = EXCLUDED."super_kills",
+					"grenade_kills" = EXCLUDED."grenade_kills",
+					"melee_kills" = EXCLUDED."melee_kills",
+					"time_played_seconds" = EXCLUDED."time_played_seconds",
+					"start_seconds" = EXCLUDED."start_seconds"`,
+				pgcr.InstanceId, playerActivity.Player.MembershipId,
+				character.CharacterId, character.ClassHash, character.EmblemHash, character.Completed, character.Score,
+				character.Kills, character.Assists, character.Deaths, character.PrecisionKills, character.SuperKills,
+				character.GrenadeKills, character.MeleeKills, character.TimePlayedSeconds, character.StartSeconds)
+			if err != nil {
+				return err
+			}
+
+			for _, weapon := range character.Weapons {
+				weaponMembershipIds = append(weaponMembershipIds, playerActivity.Player.MembershipId)
+				weaponCharacterIds = append(weaponCharacterIds, character.CharacterId)
+				weaponHashes = append(weaponHashes, int64(weapon.WeaponHash))
+
+				_, err = tx.Exec(`INSERT INTO "instance_character_weapon" (
+						"instance_id", "membership_id", "character_id", "weapon_hash", "kills", "precision_kills"
+					)
+					VALUES ($1, $2, $3, $4, $5, $6)
+					ON CONFLICT ("instance_id", "membership_id", "character_id", "weapon_hash")
+					DO UPDATE SET "kills" = EXCLUDED."kills", "precision_kills" = EXCLUDED."precision_kills"`,
+					pgcr.InstanceId, playerActivity.Player.MembershipId,
+					character.CharacterId, weapon.WeaponHash, weapon.Kills, weapon.PrecisionKills)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Remove rows which are no longer produced, children first
+	_, err = tx.Exec(`DELETE FROM "instance_character_weapon"
+		WHERE "instance_id" = $1 AND ("membership_id", "character_id", "weapon_hash") NOT IN (
+			SELECT * FROM UNNEST($2::bigint[], $3::bigint[], $4::bigint[])
+		)`, pgcr.InstanceId, pq.Array(weaponMembershipIds), pq.Array(weaponCharacterIds), pq.Array(weaponHashes))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM "instance_character"
+		WHERE "instance_id" = $1 AND ("membership_id", "character_id") NOT IN (
+			SELECT * FROM UNNEST($2::bigint[], $3::bigint[])
+		)`, pgcr.InstanceId, pq.Array(membershipIds), pq.Array(characterIds))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM "instance_player"
+		WHERE "instance_id" = $1 AND "membership_id" <> ALL($2::bigint[])`, pgcr.InstanceId, pq.Array(membershipIds))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func processedRows(pgcr *pgcr_types.ProcessedActivity) map[string]string {
+	rows := map[string]string{
+		"instance.hash":           format(pgcr.Hash),
+		"instance.flawless":       format(pgcr.Flawless),
+		"instance.completed":      format(pgcr.Completed),
+		"instance.fresh":          format(pgcr.Fresh),
+		"instance.player_count":   format(pgcr.PlayerCount),
+		"instance.date_started":   format(pgcr.DateStarted),
+		"instance.date_completed": format(pgcr.DateCompleted),
+		"instance.platform_type":  format(pgcr.MembershipType),
+		"instance.duration":       format(pgcr.DurationSeconds),
+		"instance.score":          format(pgcr.Score),
+	}
+
+	for _, playerActivity := range pgcr.Players {
+		membershipId := playerActivity.Player.MembershipId
+		key := fmt.Sprintf("instance_player[%d]", membershipId)
+		rows[key+".completed"] = format(playerActivity.Finished)
+		rows[key+".time_played_seconds"] = format(playerActivity.TimePlayedSeconds)
+
+		for _, c := range playerActivity.Characters {
+			key := fmt.Sprintf("instance_character[%d/%d]", membershipId, c.CharacterId)
+			rows[key+".class_hash"] = format(c.ClassHash)
+			rows[key+".emblem_hash"] = format(c.EmblemHash)
+			rows[key+".completed"] = format(c.Completed)
+			rows[key+".score"] = format(c.Score)
+			rows[key+".kills"] = format(c.Kills)
+			rows[key+".assists"] = format(c.Assists)
+			rows[key+".deaths"] = format(c.Deaths)
+			rows[key+".precision_kills"] = format(c.PrecisionKills)
+			rows[key+".super_kills"] = format(c.SuperKills)
+			rows[key+".grenade_kills"] = format(c.GrenadeKills)
+			rows[key+".melee_kills"] = format(c.MeleeKills)
+			rows[key+".time_played_seconds"] = format(c.TimePlayedSeconds)
+			rows[key+".start_seconds"] = format(c.StartSeconds)
+
+			for _, w := range c.Weapons {
+				key := fmt.Sprintf("instance_character_weapon[%d/%d/%d]", membershipId, c.CharacterId, w.WeaponHash)
+				rows[key+".kills"] = format(w.Kills)
+				rows[key+".precision_kills"] = format(w.PrecisionKills)
+			}
+		}
+	}
+
+	return rows
+}
+
+func storedRows(instanceId int64, db *sql.DB) (map[string]string, error) {
+	rows := make(map[string]string)
+
+	var hash uint32
+	var flawless, fresh sql.NullBool
+	var completed bool
+	var playerCount, platformType, duration, score int
+	var dateStarted, dateCompleted time.Time
+	err := db.QueryRow(`SELECT "hash", "flawless", "completed", "fresh", "player_count", "date_started",
+			"date_completed", "platform_type", "duration", "score"
+		FROM "instance" WHERE "instance_id" = $1`, instanceId).
+		Scan(&hash, &flawless, &completed, &fresh, &playerCount, &dateStarted, &dateCompleted, &platformType, &duration, &score)
+	if err == sql.ErrNoRows {
+		return rows, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rows["instance.hash"] = format(hash)
+	rows["instance.flawless"] = formatNull(flawless)
+	rows["instance.completed"] = format(completed)
+	rows["instance.fresh"] = formatNull(fresh)
+	rows["instance.player_count"] = format(playerCount)
+	rows["instance.date_started"] = format(dateStarted)
+	rows["instance.date_completed"] = format(dateCompleted)
+	rows["instance.platform_type"] = format(platformType)
+	rows["instance.duration"] = format(duration)
+	rows["instance.score"] = format(score)
+
+	players, err := db.Query(`SELECT "membership_id", "completed", "time_played_seconds"
+		FROM "instance_player" WHERE "instance_id" = $1`, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	defer players.Close()
+	for players.Next() {
+		var membershipId int64
+		var completed bool
+		var timePlayedSeconds int
+		if err := players.Scan(&membershipId, &completed, &timePlayedSeconds); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("instance_player[%d]", membershipId)
+		rows[key+".completed"] = format(completed)
+		rows[key+".time_played_seconds"] = format(timePlayedSeconds)
+	}
+	if err := players.Err(); err != nil {
+		return nil, err
+	}
+
+	characters, err := db.Query(`SELECT "membership_id", "character_id", "class_hash", "emblem_hash", "completed",
+			"score", "kills", "assists", "deaths", "precision_kills", "super_kills", "grenade_kills", "melee_kills",
+			"time_played_seconds", "start_seconds"
+		FROM "instance_character" WHERE "instance_id" = $1`, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	defer characters.Close()
+	for characters.Next() {
+		var membershipId, characterId int64
+		var classHash, emblemHash sql.NullInt64
+		var completed bool
+		var score, kills, assists, deaths, precisionKills, superKills, grenadeKills, meleeKills, timePlayedSeconds, startSeconds int
+		if err := characters.Scan(&membershipId, &characterId, &classHash, &emblemHash, &completed,
+			&score, &kills, &assists, &deaths, &precisionKills, &superKills, &grenadeKills, &meleeKills,
+			&timePlayedSeconds, &startSeconds); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("instance_character[%d/%d]", membershipId, characterId)
+		rows[key+".class_hash"] = formatNull(classHash)
+		rows[key+".emblem_hash"] = formatNull(emblemHash)
+		rows[key+".completed"] = format(completed)
+		rows[key+".score"] = format(score)
+		rows[key+".kills"] = format(kills)
+		rows[key+".assists"] = format(assists)
+		rows[key+".deaths"] = format(deaths)
+		rows[key+".precision_kills"] = format(precisionKills)
+		rows[key+".super_kills"] = format(superKills)
+		rows[key+".grenade_kills"] = format(grenadeKills)
+		rows[key+".melee_kills"] = format(meleeKills)
+		rows[key+".time_played_seconds"] = format(timePlayedSeconds)
+		rows[key+".start_seconds"] = format(startSeconds)
+	}
+	if err := characters.Err(); err != nil {
+		return nil, err
+	}
+
+	weapons, err := db.Query(`SELECT "membership_id", "character_id", "weapon_hash", "kills", "precision_kills"
+		FROM "instance_character_weapon" WHERE "instance_id" = $1`, instanceId)
+	if err != nil {
+		return nil, err
+	}
+	defer weapons.Close()
+	for weapons.Next() {
+		var membershipId, characterId, weaponHash int64
+		var kills, precisionKills int
+		if err := weapons.Scan(&membershipId, &characterId, &weaponHash, &kills, &precisionKills); err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("instance_character_weapon[%d/%d/%d]", membershipId, characterId, weaponHash)
+		rows[key+".kills"] = format(kills)
+		rows[key+".precision_kills"] = format(precisionKills)
+	}
+
+	return rows, weapons.Err()
+}
+
+func format(v any) string {
+	switch v := v.(type) {
+	case *bool:
+		if v == nil {
+			return "null"
+		}
+		return fmt.Sprint(*v)
+	case *uint32:
+		if v == nil {
+			return "null"
+		}
+		return fmt.Sprint(*v)
+	case time.Time:
+		// Timestamps are stored with second precision
+		return v.UTC().Truncate(time.Second).Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func formatNull(v any) string {
+	switch v := v.(type) {
+	case sql.NullBool:
+		if !v.Valid {
+			return "null"
+		}
+		return fmt.Sprint(v.Bool)
+	case sql.NullInt64:
+		if !v.Valid {
+			return "null"
+		}
+		return fmt.Sprint(v.Int64)
+	}
+	return fmt.Sprint(v)
+}
@@ -1,23 +1,30 @@
 package pgcr
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"raidhub/packages/async/character_fill"
 	"raidhub/packages/async/pgcr_clickhouse"
 	"raidhub/packages/async/player_crawl"
 	"raidhub/packages/bungie"
+	"raidhub/packages/messages"
 	"raidhub/packages/pgcr_types"
 	"raidhub/packages/postgres"
-	"sync"
+	"sort"
 	"time"
 
 	"github.com/lib/pq"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 // Returns lag, is_new, err
-func StorePGCR(pgcr *pgcr_types.ProcessedActivity, raw *bungie.DestinyPostGameCarnageReport, db *sql.DB, channel *amqp.Channel) (*time.Duration, bool, error) {
+func StorePGCR(ctx context.Context, pgcr *pgcr_types.ProcessedActivity, raw *bungie.DestinyPostGameCarnageReport, db *sql.DB) (*time.Duration, bool, error) {
+	// The messages written for this PGCR share its trace, so it can be followed through every queue
+	if messages.CorrelationId(ctx) == "" {
+		ctx = messages.WithCorrelationId(ctx, fmt.Sprintf("pgcr-%d", pgcr.InstanceId))
+	}
+
 	// Identify the raid which this PGCR belongs to
 	var activityId int
 	var isRaid bool
@@ -40,13 +47,6 @@ func StorePGCR(pgcr *pgcr_types.ProcessedActivity, raw *bungie.DestinyPostGameCa
 		return nil, false, err
 	}
 
-	err = pgcr_clickhouse.SendToClickhouse(channel, pgcr)
-	if err != nil {
-		log.Println("Failed to send to clickhouse")
-		return nil, false, err
-
-	}
-
 	tx, err := db.Begin()
 	if err != nil {
 		log.Println("Failed to initiate transaction")
@@ -85,245 +85,185 @@ func StorePGCR(pgcr *pgcr_types.ProcessedActivity, raw *bungie.DestinyPostGameCa
 
 	var characterRequests = make([]character_fill.CharacterFillRequest, 0)
 
-	completedDictionary := map[int64]bool{}
-	fastestClearSoFar := map[int64]int{}
-	for _, playerActivity := range pgcr.Players {
-		var playerRaidClearCount int
-		var duration int
-		// the sum is a null hack, but it finds distinct rows anyways
-		err = tx.QueryRow(`
-			SELECT COALESCE(SUM(ps.clears), 0) AS count, COALESCE(SUM(a.duration), 100000000)
-			FROM player_stats ps
-			LEFT JOIN instance a ON ps.fastest_instance_id = a.instance_id
-			WHERE ps.membership_id = $1 AND ps.activity_id = $2`, playerActivity.Player.MembershipId, activityId).
-			Scan(&playerRaidClearCount, &duration)
-		fastestClearSoFar[playerActivity.Player.MembershipId] = duration
+	membershipIds := make([]int64, len(pgcr.Players))
+	for i, playerActivity := range pgcr.Players {
+		membershipIds[i] = playerActivity.Player.MembershipId
+	}
 
-		if err != nil {
-			log.Printf("Error querying clears in DB for instance_id, membership_id, activity_id: %d, %d, %d", pgcr.InstanceId, playerActivity.Player.MembershipId, activityId)
-			return nil, false, err
-		}
+	clears, fastestClearSoFar, err := getPlayerClears(tx, membershipIds, activityId)
+	if err != nil {
+		log.Printf("Error querying clears in DB for instance_id, activity_id: %d, %d", pgcr.InstanceId, activityId)
+		return nil, false, err
+	}
 
+	completedDictionary := map[int64]bool{}
+	for _, playerActivity := range pgcr.Players {
 		if playerActivity.Finished {
-			completedDictionary[playerActivity.Player.MembershipId] = playerRaidClearCount > 0
+			completedDictionary[playerActivity.Player.MembershipId] = clears[playerActivity.Player.MembershipId] > 0
 		}
+	}
 
-		if _, err := postgres.UpsertPlayer(tx, &playerActivity.Player); err != nil {
-			log.Printf("Error inserting player %d into DB for instanceId %d: %s",
-				playerActivity.Player.MembershipId, pgcr.InstanceId, err)
-			return nil, false, err
+	// determine if a sherpa took place
+	noobsCount := 0
+	anyPro := false
+	for _, hasClears := range completedDictionary {
+		if hasClears {
+			anyPro = true
+		} else {
+			noobsCount++
 		}
+	}
+	sherpasHappened := anyPro && noobsCount > 0
+	if sherpasHappened {
+		log.Printf("Found %d sherpas for instance %d", noobsCount, pgcr.InstanceId)
+	}
 
-		_, err = tx.Exec(`
-			INSERT INTO "instance_player" (
-				"instance_id",
-				"membership_id",
-				"completed",
-				"time_played_seconds"
-			) 
-			VALUES ($1, $2, $3, $4);`,
-			pgcr.InstanceId, playerActivity.Player.MembershipId,
-			playerActivity.Finished, playerActivity.TimePlayedSeconds)
-		if err != nil {
-			log.Printf("Error inserting instance_player into DB for instanceId, membershipId %d, %d: %s", pgcr.InstanceId,
-				playerActivity.Player.MembershipId, err)
-			return nil, false, err
-		}
+	// Lock players in a consistent order to avoid deadlocks between concurrent writers
+	players := make([]*pgcr_types.Player, len(pgcr.Players))
+	for i := range pgcr.Players {
+		players[i] = &pgcr.Players[i].Player
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].MembershipId < players[j].MembershipId
+	})
+	if _, err := postgres.UpsertPlayers(tx, players); err != nil {
+		log.Printf("Error inserting players into DB for instanceId %d: %s", pgcr.InstanceId, err)
+		return nil, false, err
+	}
 
-		// update the player_stats table
-		_, err = tx.Exec(`INSERT INTO player_stats ("membership_id", "activity_id")
-			VALUES ($1, $2)
-			ON CONFLICT (membership_id, activity_id) DO NOTHING`,
-			playerActivity.Player.MembershipId, activityId)
+	var playerRows, characterRows, weaponRows [][]any
+	var timePlayed []int64
+	for _, playerActivity := range pgcr.Players {
+		membershipId := playerActivity.Player.MembershipId
+		hasClears, finished := completedDictionary[membershipId]
 
-		if err != nil {
-			log.Printf("Error inserting player_stats into DB for membershipId, activity_id: %d, %d", playerActivity.Player.MembershipId, activityId)
-			return nil, false, err
+		sherpas := 0
+		if finished && hasClears && sherpasHappened {
+			sherpas = noobsCount
 		}
+		playerRows = append(playerRows, []any{
+			pgcr.InstanceId, membershipId, playerActivity.Finished, playerActivity.TimePlayedSeconds,
+			sherpas, finished && !hasClears,
+		})
+		timePlayed = append(timePlayed, int64(playerActivity.TimePlayedSeconds))
 
 		// Send a crawl request if needed
 		if playerActivity.Player.MembershipType == nil || *playerActivity.Player.MembershipType == 0 {
-			err = player_crawl.SendMessage(channel, playerActivity.Player.MembershipId)
-			if err != nil {
-				log.Fatalf("Failed to send player crawl request: %s", err)
+			if err := player_crawl.WriteOutbox(ctx, tx, membershipId); err != nil {
+				log.Printf("Failed to write player crawl request: %s", err)
+				return nil, false, err
 			}
 		}
+
 		for _, character := range playerActivity.Characters {
-			_, err = tx.Exec(`
-				INSERT INTO "instance_character" (
-					"instance_id",
-					"membership_id",
-					"character_id",
-					"class_hash",
-					"emblem_hash",
-					"completed",
-					"score",
-					"kills",
-					"assists",
-					"deaths",
-					"precision_kills",
-					"super_kills",
-					"grenade_kills",
-					"melee_kills",
-					"time_played_seconds",
-					"start_seconds"
-				) 
-				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16);`,
-				pgcr.InstanceId, playerActivity.Player.MembershipId,
+			characterRows = append(characterRows, []any{
+				pgcr.InstanceId, membershipId,
 				character.CharacterId, character.ClassHash, character.EmblemHash, character.Completed, character.Score,
 				character.Kills, character.Assists, character.Deaths, character.PrecisionKills, character.SuperKills,
-				character.GrenadeKills, character.MeleeKills, character.TimePlayedSeconds, character.StartSeconds)
-			if err != nil {
-				log.Printf("Error inserting instance_character into DB for instanceId, membershipId, characterId %d, %d, %d: %s",
-					pgcr.InstanceId, playerActivity.Player.MembershipId, character.CharacterId, err)
-				return nil, false, err
-			}
+				character.GrenadeKills, character.MeleeKills, character.TimePlayedSeconds, character.StartSeconds,
+			})
 
-			var wg sync.WaitGroup
-			errs := make(chan error, len(character.Weapons))
-			for _, w := range character.Weapons {
-				wg.Add(1)
-				go func(weapon pgcr_types.ProcessedCharacterActivityWeapon) {
-					defer wg.Done()
-					_, err = tx.Exec(`
-						INSERT INTO "instance_character_weapon" (
-							"instance_id",
-							"membership_id",
-							"character_id",
-							"weapon_hash",
-							"kills",
-							"precision_kills"
-						) 
-						VALUES ($1, $2, $3, $4, $5, $6);`,
-						pgcr.InstanceId, playerActivity.Player.MembershipId,
-						character.CharacterId, weapon.WeaponHash, weapon.Kills, weapon.PrecisionKills)
-					if err != nil {
-						errs <- err
-						log.Printf("Error inserting instance_character_weapon into DB for instanceId, character_id, weapon_hash %d, %d, %d: %s",
-							pgcr.InstanceId, character.CharacterId, weapon.WeaponHash, err)
-					}
-				}(w)
-			}
-			wg.Wait()
-			close(errs)
-			for err := range errs {
-				return nil, false, err
+			for _, weapon := range character.Weapons {
+				weaponRows = append(weaponRows, []any{
+					pgcr.InstanceId, membershipId,
+					character.CharacterId, weapon.WeaponHash, weapon.Kills, weapon.PrecisionKills,
+				})
 			}
 
 			if character.ClassHash == nil {
 				characterRequests = append(characterRequests, character_fill.CharacterFillRequest{
-					MembershipId: playerActivity.Player.MembershipId,
+					MembershipId: membershipId,
 					CharacterId:  character.CharacterId,
 					InstanceId:   pgcr.InstanceId,
 				})
 			}
 		}
-
 	}
 
-	// determine if a sherpa took place
-	noobsCount := 0
-	anyPro := false
-	for _, hasClears := range completedDictionary {
-		if hasClears {
-			anyPro = true
-		} else {
-			noobsCount++
-		}
+	err = copyRows(tx, "instance_player", []string{
+		"instance_id", "membership_id", "completed", "time_played_seconds", "sherpas", "is_first_clear",
+	}, playerRows)
+	if err != nil {
+		log.Printf("Error inserting instance_player into DB for instanceId %d: %s", pgcr.InstanceId, err)
+		return nil, false, err
 	}
 
-	// update total_time_played_seconds for all players
-	for _, playerActivity := range pgcr.Players {
-		_, err = tx.Exec(`UPDATE player_stats 
-			SET total_time_played_seconds = total_time_played_seconds + $1 
-			WHERE membership_id = $2 AND activity_id = $3`,
-			playerActivity.TimePlayedSeconds, playerActivity.Player.MembershipId, activityId)
-		if err != nil {
-			log.Printf("Error updating total_time_played_seconds for membershipId %d", playerActivity.Player.MembershipId)
-			return nil, false, err
-		}
+	err = copyRows(tx, "instance_character", []string{
+		"instance_id", "membership_id", "character_id", "class_hash", "emblem_hash", "completed", "score", "kills",
+		"assists", "deaths", "precision_kills", "super_kills", "grenade_kills", "melee_kills",
+		"time_played_seconds", "start_seconds",
+	}, characterRows)
+	if err != nil {
+		log.Printf("Error inserting instance_character into DB for instanceId %d: %s", pgcr.InstanceId, err)
+		return nil, false, err
+	}
 
-		_, err = tx.Exec(`UPDATE player 
-			SET total_time_played_seconds = total_time_played_seconds + $1
-			WHERE membership_id = $2`,
-			playerActivity.TimePlayedSeconds, playerActivity.Player.MembershipId)
-		if err != nil {
-			log.Printf("Error updating total_time_played_seconds for membershipId %d", playerActivity.Player.MembershipId)
-			return nil, false, err
-		}
+	err = copyRows(tx, "instance_character_weapon", []string{
+		"instance_id", "membership_id", "character_id", "weapon_hash", "kills", "precision_kills",
+	}, weaponRows)
+	if err != nil {
+		log.Printf("Error inserting instance_character_weapon into DB for instanceId %d: %s", pgcr.InstanceId, err)
+		return nil, false, err
+	}
 
+	// update the player_stats table and total_time_played_seconds for all players
+	_, err = tx.Exec(`INSERT INTO player_stats ("membership_id", "activity_id", "total_time_played_seconds")
+		SELECT membership_id, $1, time_played_seconds FROM UNNEST($2::bigint[], $3::int[]) AS u(membership_id, time_played_seconds)
+		ON CONFLICT (membership_id, activity_id)
+		DO UPDATE SET total_time_played_seconds = player_stats.total_time_played_seconds + EXCLUDED.total_time_played_seconds`,
+		activityId, pq.Array(membershipIds), pq.Array(timePlayed))
+	if err != nil {
+		log.Printf("Error updating player_stats into DB for instanceId, activity_id: %d, %d", pgcr.InstanceId, activityId)
+		return nil, false, err
 	}
 
-	sherpasHappened := anyPro && noobsCount > 0
-	if sherpasHappened {
-		log.Printf("Found %d sherpas for instance %d", noobsCount, pgcr.InstanceId)
+	_, err = tx.Exec(`UPDATE player 
+		SET total_time_played_seconds = player.total_time_played_seconds + u.time_played_seconds
+		FROM UNNEST($1::bigint[], $2::int[]) AS u(membership_id, time_played_seconds)
+		WHERE player.membership_id = u.membership_id`,
+		pq.Array(membershipIds), pq.Array(timePlayed))
+	if err != nil {
+		log.Printf("Error updating total_time_played_seconds for instanceId %d", pgcr.InstanceId)
+		return nil, false, err
 	}
 
-	for membershipId, hasClears := range completedDictionary {
-		var playerActivity *pgcr_types.ProcessedActivityPlayer
-		for _, pa := range pgcr.Players {
-			if pa.Player.MembershipId == membershipId {
-				playerActivity = &pa
-				break
+	if len(completedDictionary) > 0 {
+		var finishedIds, finishedSherpas, finishedFastest, sumOfBestIds []int64
+		for membershipId, hasClears := range completedDictionary {
+			sherpas := 0
+			if hasClears && sherpasHappened {
+				sherpas = noobsCount
 			}
-		}
-		if playerActivity == nil {
-			log.Fatalf("Player %d not found in pgcr.Players", membershipId)
-		}
-
-		if hasClears && sherpasHappened {
-			playerActivity.Sherpas = noobsCount
-			// set sherpas for p_activity
-			_, err = tx.Exec(`UPDATE 
-				instance_player
-			SET 
-				sherpas = $1
-			WHERE 
-				membership_id = $2 AND
-				instance_id = $3`, playerActivity.Sherpas, membershipId, pgcr.InstanceId)
+			finishedIds = append(finishedIds, membershipId)
+			finishedSherpas = append(finishedSherpas, int64(sherpas))
+			finishedFastest = append(finishedFastest, int64(fastestClearSoFar[membershipId]))
 
-			if err != nil {
-				log.Printf("Error updating sherpa count for instance_player with instanceId, membershipId %d, %d", pgcr.InstanceId, membershipId)
-				return nil, false, err
-			}
-
-		} else if !hasClears {
-			playerActivity.IsFirstClear = true
-			// first clear, update p_activity
-			_, err = tx.Exec(`UPDATE 
-				instance_player
-			SET 
-				is_first_clear = true
-			WHERE 
-				membership_id = $1 AND
-				instance_id = $2`, membershipId, pgcr.InstanceId)
-
-			if err != nil {
-				log.Printf("Error updating first clear for instanceId, membershipId %d, %d", pgcr.InstanceId, membershipId)
-				return nil, false, err
+			if pgcr.Fresh != nil && *pgcr.Fresh && pgcr.DurationSeconds < fastestClearSoFar[membershipId] {
+				sumOfBestIds = append(sumOfBestIds, membershipId)
 			}
 		}
 
 		// raid specific stats
 		_, err = tx.Exec(`UPDATE player_stats 
 			SET 
-				sherpas = player_stats.sherpas + $3,
+				sherpas = player_stats.sherpas + u.sherpas,
 				clears = player_stats.clears + 1,
 				fresh_clears = CASE
-						WHEN $4 = true THEN player_stats.fresh_clears + 1
+						WHEN $2 = true THEN player_stats.fresh_clears + 1
 						ELSE player_stats.fresh_clears
 					END,
 				fastest_instance_id = CASE
-						WHEN $4 = true AND $5::int < $6::int THEN $7::bigint
+						WHEN $2 = true AND $3::int < u.fastest_so_far THEN $4::bigint
 						ELSE player_stats.fastest_instance_id
 					END
+			FROM UNNEST($5::bigint[], $6::int[], $7::int[]) AS u(membership_id, sherpas, fastest_so_far)
 			WHERE
-				membership_id = $1 AND
-				activity_id = $2;
-			`, membershipId, activityId, playerActivity.Sherpas, pgcr.Fresh, pgcr.DurationSeconds, fastestClearSoFar[membershipId], pgcr.InstanceId)
-
+				player_stats.membership_id = u.membership_id AND
+				player_stats.activity_id = $1;
+			`, activityId, pgcr.Fresh, pgcr.DurationSeconds, pgcr.InstanceId,
+			pq.Array(finishedIds), pq.Array(finishedSherpas), pq.Array(finishedFastest))
 		if err != nil {
-			log.Printf("Error updating player_stats for membershipId %d", membershipId)
+			log.Printf("Error updating player_stats for instanceId %d", pgcr.InstanceId)
 			return nil, false, err
 		}
 
@@ -331,19 +271,19 @@ func StorePGCR(pgcr *pgcr_types.ProcessedActivity, raw *bungie.DestinyPostGameCa
 		_, err = tx.Exec(`UPDATE player 
 			SET 
 				clears = player.clears + 1,
-				sherpas = player.sherpas + $2,
+				sherpas = player.sherpas + u.sherpas,
 				fresh_clears = CASE 
-						WHEN $3 = true THEN player.fresh_clears + 1
+						WHEN $1 = true THEN player.fresh_clears + 1
 						ELSE player.fresh_clears
 					END
-			WHERE membership_id = $1`, membershipId, playerActivity.Sherpas, pgcr.Fresh)
-
+			FROM UNNEST($2::bigint[], $3::int[]) AS u(membership_id, sherpas)
+			WHERE player.membership_id = u.membership_id`, pgcr.Fresh, pq.Array(finishedIds), pq.Array(finishedSherpas))
 		if err != nil {
-			log.Printf("Error updating global stats for membershipId %d", membershipId)
+			log.Printf("Error updating global stats for instanceId %d", pgcr.InstanceId)
 			return nil, false, err
 		}
 
-		if pgcr.Fresh != nil && *pgcr.Fresh && pgcr.DurationSeconds < fastestClearSoFar[membershipId] {
+		if len(sumOfBestIds) > 0 {
 			_, err = tx.Exec(`WITH c AS (SELECT COUNT(*) as expected FROM activity_definition WHERE is_raid = true AND is_sunset = false)
 				UPDATE player p
 				SET sum_of_best = ptd.total_duration
@@ -355,22 +295,27 @@ func StorePGCR(pgcr *pgcr_types.ProcessedActivity, raw *bungie.DestinyPostGameCa
 					JOIN activity_definition r ON ps.activity_id = r.id
 					LEFT JOIN instance a ON ps.fastest_instance_id = a.instance_id
 					WHERE a.duration IS NOT NULL AND is_raid = true AND is_sunset = false 
-						AND ps.membership_id = $1
+						AND ps.membership_id = ANY($1)
 					GROUP BY ps.membership_id
 					HAVING COUNT(a.instance_id) = (SELECT expected FROM c)
 				) ptd
-				WHERE p.membership_id = ptd.membership_id;`, membershipId)
-
+				WHERE p.membership_id = ptd.membership_id;`, pq.Array(sumOfBestIds))
 			if err != nil {
-				log.Printf("Error updating sum of best for membershipId %d", membershipId)
+				log.Printf("Error updating sum of best for instanceId %d", pgcr.InstanceId)
 				return nil, false, err
 			}
 		}
+	}
 
+	for _, req := range characterRequests {
+		if err := character_fill.WriteOutbox(ctx, tx, &req); err != nil {
+			log.Printf("Failed to write character fill request: %s", err)
+			return nil, false, err
+		}
 	}
 
-	if err != nil {
-		log.Fatal(err)
+	if err := pgcr_clickhouse.WriteOutbox(ctx, tx, pgcr); err != nil {
+		log.Println("Failed to write clickhouse message")
 		return nil, false, err
 	}
 
@@ -380,9 +325,58 @@ func StorePGCR(pgcr *pgcr_types.ProcessedActivity, raw *bungie.DestinyPostGameCa
 		return nil, false, err
 	}
 
-	for _, req := range characterRequests {
-		character_fill.SendMessage(channel, &req)
+	return &lag, true, nil
+}
+
+// Returns the clears and the duration of the fastest clear of each player for an activity
+func getPlayerClears(tx *sql.Tx, membershipIds []int64, activityId int) (map[int64]int, map[int64]int, error) {
+	clears := make(map[int64]int, len(membershipIds))
+	fastest := make(map[int64]int, len(membershipIds))
+	for _, membershipId := range membershipIds {
+		fastest[membershipId] = 100000000
 	}
 
-	return &lag, true, nil
+	rows, err := tx.Query(`
+		SELECT ps.membership_id, ps.clears, COALESCE(a.duration, 100000000)
+		FROM player_stats ps
+		LEFT JOIN instance a ON ps.fastest_instance_id = a.instance_id
+		WHERE ps.membership_id = ANY($1) AND ps.activity_id = $2`, pq.Array(membershipIds), activityId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var membershipId int64
+		var count, duration int
+		if err := rows.Scan(&membershipId, &count, &duration); err != nil {
+			return nil, nil, err
+		}
+		clears[membershipId] = count
+		fastest[membershipId] = duration
+	}
+
+	return clears, fastest, rows.Err()
+}
+
+// Writes rows into a table with COPY
+func copyRows(tx *sql.Tx, table string, columns []string, rows [][]any) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	return err
 }
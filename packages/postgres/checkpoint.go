@@ -0,0 +1,29 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// Returns the low water mark and the offloaded instance ids of the last Atlas checkpoint,
+// or sql.ErrNoRows if Atlas has never checkpointed
+func GetAtlasCheckpoint(db *sql.DB) (int64, []int64, error) {
+	var lowWaterMark int64
+	var offloaded []int64
+	err := db.QueryRow(`SELECT low_water_mark, offloaded FROM atlas_checkpoint WHERE id = 1`).
+		Scan(&lowWaterMark, pq.Array(&offloaded))
+	if err != nil {
+		return 0, nil, err
+	}
+	return lowWaterMark, offloaded, nil
+}
+
+func SaveAtlasCheckpoint(db *sql.DB, lowWaterMark int64, offloaded []int64) error {
+	_, err := db.Exec(`INSERT INTO atlas_checkpoint (id, low_water_mark, offloaded, updated_at)
+		VALUES (1, $1, $2, NOW())
+		ON CONFLICT (id)
+		DO UPDATE SET low_water_mark = $1, offloaded = $2, updated_at = NOW()`,
+		lowWaterMark, pq.Array(offloaded))
+	return err
+}
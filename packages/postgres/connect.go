@@ -1,27 +1,66 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
-	"os"
+	"log"
+	"raidhub/packages/config"
+	"raidhub/packages/monitoring"
+	"time"
 
-	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
+// Opens a pool configured by config.Postgres and waits for the database to accept connections
 func Connect() (*sql.DB, error) {
-	if err := godotenv.Load(); err != nil {
+	cfg := config.Load().Postgres
+	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
 
-	POSTGRES_USER := os.Getenv("POSTGRES_USER")
-	POSTGRES_PASSWORD := os.Getenv("POSTGRES_PASSWORD")
+	db, err := sql.Open("postgres", cfg.DSN())
+	if err != nil {
+		return nil, err
+	}
 
-	connStr := "user=" + POSTGRES_USER + " dbname=raidhub password=" + POSTGRES_PASSWORD + " sslmode=disable"
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
 
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
+	if err := waitForPing(db, cfg.ConnectTimeout); err != nil {
+		db.Close()
 		return nil, err
 	}
 
+	monitoring.RegisterDBStats(db, cfg.Database)
 	return db, nil
 }
+
+// Checks that the database answers within a few seconds
+func Ping(ctx context.Context, db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+// Pings with backoff until the database answers or timeout has passed
+func waitForPing(db *sql.DB, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := time.Second
+	for {
+		err := Ping(context.Background(), db)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		log.Printf("Postgres is not ready, retrying in %s: %s", delay, err)
+		time.Sleep(delay)
+		if delay < 10*time.Second {
+			delay *= 2
+		}
+	}
+}
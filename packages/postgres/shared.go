@@ -3,6 +3,8 @@ package postgres
 import (
 	"database/sql"
 	"raidhub/packages/pgcr_types"
+
+	"github.com/lib/pq"
 )
 
 func UpsertPlayer(tx *sql.Tx, player *pgcr_types.Player) (sql.Result, error) {
@@ -46,3 +48,112 @@ func UpsertPlayer(tx *sql.Tx, player *pgcr_types.Player) (sql.Result, error) {
 		player.MembershipId, player.MembershipType, player.IconPath, player.DisplayName,
 		player.BungieGlobalDisplayName, player.BungieGlobalDisplayNameCode, player.LastSeen)
 }
+
+// Upserts many players in one statement with the same rules as UpsertPlayer. Players which appear more than
+// once are merged first, since one statement cannot update the same row twice.
+func UpsertPlayers(tx *sql.Tx, players []*pgcr_types.Player) (sql.Result, error) {
+	players = mergePlayers(players)
+	membershipIds := make([]int64, len(players))
+	membershipTypes := make([]sql.NullInt64, len(players))
+	iconPaths := make([]sql.NullString, len(players))
+	displayNames := make([]sql.NullString, len(players))
+	globalDisplayNames := make([]sql.NullString, len(players))
+	globalDisplayNameCodes := make([]sql.NullString, len(players))
+	// last_seen is a timestamp without time zone holding UTC, a timestamptz would be shifted by the session TimeZone
+	lastSeen := make([]string, len(players))
+	for i, player := range players {
+		membershipIds[i] = player.MembershipId
+		if player.MembershipType != nil {
+			membershipTypes[i] = sql.NullInt64{Int64: int64(*player.MembershipType), Valid: true}
+		}
+		iconPaths[i] = nullString(player.IconPath)
+		displayNames[i] = nullString(player.DisplayName)
+		globalDisplayNames[i] = nullString(player.BungieGlobalDisplayName)
+		globalDisplayNameCodes[i] = nullString(player.BungieGlobalDisplayNameCode)
+		lastSeen[i] = player.LastSeen.UTC().Format("2006-01-02 15:04:05.999999")
+	}
+
+	return tx.Exec(`
+			INSERT INTO player (
+				"membership_id",
+				"membership_type",
+				"icon_path",
+				"display_name",
+				"bungie_global_display_name",
+				"bungie_global_display_name_code",
+				"last_seen"
+			)
+			SELECT * FROM UNNEST(
+				$1::bigint[], $2::int[], $3::text[], $4::text[], $5::text[], $6::text[], $7::timestamp[]
+			)
+			ON CONFLICT (membership_id)
+			DO UPDATE SET
+				membership_type = COALESCE(player.membership_type, EXCLUDED.membership_type),
+				icon_path = CASE 
+					WHEN EXCLUDED.last_seen > player.last_seen THEN COALESCE(EXCLUDED.icon_path, player.icon_path)
+					ELSE player.icon_path
+				END,
+				display_name = CASE 
+					WHEN EXCLUDED.last_seen > player.last_seen THEN COALESCE(EXCLUDED.display_name, player.display_name)
+					ELSE player.display_name
+				END,
+				bungie_global_display_name = CASE 
+					WHEN EXCLUDED.last_seen > player.last_seen THEN COALESCE(EXCLUDED.bungie_global_display_name, player.bungie_global_display_name)
+					ELSE player.bungie_global_display_name
+				END,
+				bungie_global_display_name_code = CASE 
+					WHEN EXCLUDED.last_seen > player.last_seen THEN COALESCE(EXCLUDED.bungie_global_display_name_code, player.bungie_global_display_name_code)
+					ELSE player.bungie_global_display_name_code
+				END,
+				last_seen = CASE 
+					WHEN EXCLUDED.last_seen > player.last_seen THEN EXCLUDED.last_seen
+					ELSE player.last_seen
+				END;
+			`,
+		pq.Array(membershipIds), pq.Array(membershipTypes), pq.Array(iconPaths), pq.Array(displayNames),
+		pq.Array(globalDisplayNames), pq.Array(globalDisplayNameCodes), pq.Array(lastSeen))
+}
+
+// Combines players with the same membership id as if UpsertPlayer had been called for each in order,
+// keeping the order in which each id first appears
+func mergePlayers(players []*pgcr_types.Player) []*pgcr_types.Player {
+	merged := make([]*pgcr_types.Player, 0, len(players))
+	byId := make(map[int64]*pgcr_types.Player, len(players))
+	for _, player := range players {
+		existing, ok := byId[player.MembershipId]
+		if !ok {
+			copied := *player
+			byId[player.MembershipId] = &copied
+			merged = append(merged, &copied)
+			continue
+		}
+
+		if existing.MembershipType == nil {
+			existing.MembershipType = player.MembershipType
+		}
+		if player.LastSeen.After(existing.LastSeen) {
+			existing.IconPath = coalesce(player.IconPath, existing.IconPath)
+			existing.DisplayName = coalesce(player.DisplayName, existing.DisplayName)
+			existing.BungieGlobalDisplayName = coalesce(player.BungieGlobalDisplayName, existing.BungieGlobalDisplayName)
+			existing.BungieGlobalDisplayNameCode = coalesce(player.BungieGlobalDisplayNameCode, existing.BungieGlobalDisplayNameCode)
+			existing.LastSeen = player.LastSeen
+		}
+	}
+	return merged
+}
+
+func coalesce(values ...*string) *string {
+	for _, v := range values {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+func nullString(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
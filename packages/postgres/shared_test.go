@@ -0,0 +1,36 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+
+	"raidhub/packages/pgcr_types"
+)
+
+func TestMergePlayers(t *testing.T) {
+	str := func(s string) *string { return &s }
+	membershipType := 3
+	start := time.Date(2024, 3, 1, 18, 0, 0, 0, time.UTC)
+
+	players := []*pgcr_types.Player{
+		{MembershipId: 2, LastSeen: start, DisplayName: str("old"), IconPath: str("/old.jpg")},
+		{MembershipId: 1, LastSeen: start, DisplayName: str("one")},
+		{MembershipId: 2, LastSeen: start.Add(time.Hour), MembershipType: &membershipType, DisplayName: str("new")},
+		{MembershipId: 2, LastSeen: start.Add(time.Minute), DisplayName: str("older")},
+	}
+	merged := mergePlayers(players)
+
+	if len(merged) != 2 || merged[0].MembershipId != 2 || merged[1].MembershipId != 1 {
+		t.Fatalf("got %d players, want ids 2 and 1 in order", len(merged))
+	}
+	p := merged[0]
+	if *p.DisplayName != "new" || *p.IconPath != "/old.jpg" || !p.LastSeen.Equal(start.Add(time.Hour)) {
+		t.Errorf("got %s %s %s, want the newest name with the older icon", *p.DisplayName, *p.IconPath, p.LastSeen)
+	}
+	if p.MembershipType == nil || *p.MembershipType != 3 {
+		t.Errorf("membership type was not filled in")
+	}
+	if *players[0].DisplayName != "old" || players[0].MembershipType != nil {
+		t.Errorf("the input players were modified")
+	}
+}
@@ -0,0 +1,255 @@
+package rabbit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrClientClosed = errors.New("rabbit: client closed")
+
+// A Client holds a connection to the broker and redials it whenever it is lost.
+// Channels do not survive a reconnect, so callers should open them as they need them
+// or use Consume and a Publisher, which recover on their own.
+type Client struct {
+	cfg     Config
+	amqpCfg amqp.Config
+
+	mu    sync.RWMutex
+	conn  *amqp.Connection
+	ready chan struct{} // closed while connected
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func Dial(cfg Config) (*Client, error) {
+	amqpCfg, err := cfg.amqpConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := amqp.DialConfig(cfg.URI().String(), amqpCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		cfg:     cfg,
+		amqpCfg: amqpCfg,
+		conn:    conn,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	close(c.ready)
+	go c.watch(conn)
+
+	return c, nil
+}
+
+// Opens a channel on the current connection
+func (c *Client) Channel() (*amqp.Channel, error) {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+	return conn.Channel()
+}
+
+// Blocks until the client is connected
+func (c *Client) Wait(ctx context.Context) error {
+	c.mu.RLock()
+	ready := c.ready
+	c.mu.RUnlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.RLock()
+		err = c.conn.Close()
+		c.mu.RUnlock()
+	})
+	return err
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) watch(conn *amqp.Connection) {
+	for {
+		lost := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+		if lost == nil || c.closed() {
+			// Closed on purpose
+			return
+		}
+		log.Printf("Lost connection to rabbit: %s", lost)
+
+		c.mu.Lock()
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+
+		conn = c.redial()
+		if conn == nil {
+			return
+		}
+
+		c.mu.Lock()
+		c.conn = conn
+		close(c.ready)
+		c.mu.Unlock()
+		log.Println("Reconnected to rabbit")
+	}
+}
+
+// Dials with backoff until it succeeds or the client is closed
+func (c *Client) redial() *amqp.Connection {
+	delay := time.Second
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(delay):
+		}
+
+		conn, err := amqp.DialConfig(c.cfg.URI().String(), c.amqpCfg)
+		if err == nil {
+			return conn
+		}
+		log.Printf("Failed to reconnect to rabbit, retrying in %s: %s", delay, err)
+
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// Declares a durable queue and hands its messages to handler one at a time, on a channel of its own with at most
+// prefetch unacknowledged messages, until ctx is cancelled or the client is closed. The consumer is registered
+// again on a new channel whenever the channel or connection is lost.
+//
+// Cancelling ctx stops the consumer, waits for the handler to finish and requeues any messages which were delivered
+// but not yet handled. drain, if not nil, is called after that and before the channel closes, so that messages the
+// handler has kept hold of can still be acknowledged.
+func (c *Client) Consume(ctx context.Context, queue string, prefetch int, handler func(amqp.Delivery), drain func()) error {
+	for {
+		if err := c.Wait(ctx); err != nil {
+			return err
+		}
+
+		err := c.consume(ctx, queue, prefetch, handler, drain)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if c.closed() {
+			return ErrClientClosed
+		}
+		if err != nil {
+			log.Printf("Failed to consume from queue %s: %s", queue, err)
+		} else {
+			log.Printf("Lost consumer on queue %s, registering it again", queue)
+		}
+
+		select {
+		case <-c.done:
+			return ErrClientClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+var consumerSeq atomic.Int64
+
+// Consumes on one channel until it closes or ctx is cancelled
+func (c *Client) consume(ctx context.Context, queue string, prefetch int, handler func(amqp.Delivery), drain func()) error {
+	ch, err := c.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return err
+	}
+
+	q, err := ch.QueueDeclare(
+		queue,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	tag := fmt.Sprintf("%s-%d", queue, consumerSeq.Add(1))
+	msgs, err := ch.Consume(
+		q.Name,
+		tag,
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for msg := range msgs {
+			if ctx.Err() != nil {
+				// Shutting down, leave the rest for the next consumer
+				if err := msg.Nack(false, true); err != nil {
+					log.Printf("Failed to requeue message: %v", err)
+				}
+				continue
+			}
+			handler(msg)
+		}
+	}()
+
+	select {
+	case <-stopped:
+		// The channel or connection was lost
+		return nil
+	case <-ctx.Done():
+	}
+
+	if err := ch.Cancel(tag, false); err != nil {
+		log.Printf("Failed to cancel consumer %s: %s", tag, err)
+	}
+	<-stopped
+
+	if drain != nil {
+		drain()
+	}
+	return nil
+}
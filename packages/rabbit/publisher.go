@@ -0,0 +1,206 @@
+package rabbit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrNacked = errors.New("rabbit: the broker did not accept the message")
+
+// Returned for mandatory messages which could not be routed to a queue
+type ReturnedError struct {
+	Queue     string
+	ReplyCode uint16
+	ReplyText string
+}
+
+func (e *ReturnedError) Error() string {
+	return fmt.Sprintf("rabbit: message to %s was returned: %d %s", e.Queue, e.ReplyCode, e.ReplyText)
+}
+
+// The header used to match returned messages to their publish
+const publishIdHeader = "x-publish-id"
+
+// A Publisher sends messages on a confirm mode channel and waits for the broker to take responsibility for each one.
+// The channel is opened again after it or the connection is lost. It is safe for concurrent use.
+type Publisher struct {
+	client *Client
+	// How long to wait for a confirm
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	ch      *amqp.Channel
+	returns chan amqp.Return
+
+	seq        atomic.Uint64
+	returnedMu sync.Mutex
+	returned   map[string]amqp.Return
+}
+
+func NewPublisher(c *Client) *Publisher {
+	return &Publisher{
+		client:   c,
+		Timeout:  30 * time.Second,
+		returned: make(map[string]amqp.Return),
+	}
+}
+
+var (
+	publisher     *Publisher
+	publisherOnce sync.Once
+)
+
+// Publishes on the process wide publisher, see Publisher.Publish
+func Publish(ctx context.Context, queue string, mandatory bool, msg amqp.Publishing) error {
+	var err error = nil
+	publisherOnce.Do(func() {
+		var c *Client
+		if c, err = Init(); err == nil {
+			publisher = NewPublisher(c)
+		}
+	})
+	if publisher == nil {
+		return fmt.Errorf("rabbit: no publisher: %w", err)
+	}
+	return publisher.Publish(ctx, queue, mandatory, msg)
+}
+
+// Publishes msg to queue on the default exchange and returns once the broker confirms it.
+// A mandatory message which cannot be routed returns a *ReturnedError.
+// The publish is attempted once more on a new channel if the channel was closed underneath it.
+func (p *Publisher) Publish(ctx context.Context, queue string, mandatory bool, msg amqp.Publishing) error {
+	id := strconv.FormatUint(p.seq.Add(1), 10)
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[publishIdHeader] = id
+	msg.Headers = headers
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		err = p.publish(ctx, id, queue, mandatory, msg)
+		if !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+	}
+	return err
+}
+
+func (p *Publisher) publish(ctx context.Context, id string, queue string, mandatory bool, msg amqp.Publishing) error {
+	ch, returns, confirm, err := p.send(ctx, queue, mandatory, msg)
+	if err != nil {
+		return err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	ok, err := confirm.WaitContext(waitCtx)
+	if err != nil {
+		return err
+	}
+
+	// A return is always delivered before the confirm of the same message
+	ret, returned := p.takeReturn(returns, id)
+	if !ok {
+		if ch.IsClosed() {
+			p.reset(ch)
+			return amqp.ErrClosed
+		}
+		return ErrNacked
+	}
+	if returned {
+		return &ReturnedError{
+			Queue:     queue,
+			ReplyCode: ret.ReplyCode,
+			ReplyText: ret.ReplyText,
+		}
+	}
+	return nil
+}
+
+func (p *Publisher) send(ctx context.Context, queue string, mandatory bool, msg amqp.Publishing) (*amqp.Channel, chan amqp.Return, *amqp.DeferredConfirmation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ch == nil || p.ch.IsClosed() {
+		ch, err := p.client.Channel()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			return nil, nil, nil, err
+		}
+		// Buffered so returns never hold up the confirms behind them
+		p.returns = ch.NotifyReturn(make(chan amqp.Return, 256))
+		p.ch = ch
+	}
+
+	confirm, err := p.ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		"",        // exchange
+		queue,     // routing key (queue name)
+		mandatory, // mandatory
+		false,     // immediate
+		msg,
+	)
+	if err != nil {
+		ch := p.ch
+		p.ch = nil
+		ch.Close()
+		return nil, nil, nil, err
+	}
+	return p.ch, p.returns, confirm, nil
+}
+
+// Drains the pending returns and reports whether the message with this id was one of them
+func (p *Publisher) takeReturn(returns chan amqp.Return, id string) (amqp.Return, bool) {
+	p.returnedMu.Lock()
+	defer p.returnedMu.Unlock()
+
+	for drained := false; !drained; {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				drained = true
+				break
+			}
+			if retId, ok := ret.Headers[publishIdHeader].(string); ok {
+				p.returned[retId] = ret
+			}
+		default:
+			drained = true
+		}
+	}
+
+	ret, ok := p.returned[id]
+	delete(p.returned, id)
+	return ret, ok
+}
+
+func (p *Publisher) reset(ch *amqp.Channel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch == ch {
+		p.ch = nil
+	}
+}
+
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch == nil {
+		return nil
+	}
+	err := p.ch.Close()
+	p.ch = nil
+	return err
+}
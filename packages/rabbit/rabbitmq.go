@@ -1,50 +1,151 @@
 package rabbit
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
 	"os"
+	"raidhub/packages/config"
 	"sync"
+	"time"
 
-	"github.com/joho/godotenv"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 var (
-	conn *amqp.Connection
-	once sync.Once
+	client *Client
+	once   sync.Once
 )
 
-func Init() (*amqp.Connection, error) {
+// Connects to the broker configured by the environment, shared by the whole process
+func Init() (*Client, error) {
 	var err error = nil
 	once.Do(func() {
-		conn, err = initOnce()
+		var cfg Config
+		if cfg, err = ConfigFrom(config.Load().Rabbit); err != nil {
+			return
+		}
+		client, err = Dial(cfg)
 	})
-	return conn, err
+	return client, err
 }
 
-func initOnce() (*amqp.Connection, error) {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+func Cleanup() {
+	// Clean up the resources when the program exits
+	if publisher != nil {
+		publisher.Close()
+	}
+	if client != nil {
+		client.Close()
+	}
+}
+
+type Config struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	VHost    string
+	TLS      bool
+	// PEM files, the CA is only needed for a private CA and the cert and key for client authentication
+	CACertFile string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+}
+
+// Builds the connection settings from the shared configuration, parsing RABBITMQ_URL if it is set
+func ConfigFrom(c config.Rabbit) (Config, error) {
+	if err := c.Validate(); err != nil {
+		return Config{}, err
 	}
 
-	// Set up RabbitMQ connection
-	username := os.Getenv("RABBITMQ_USER")
-	password := os.Getenv("RABBITMQ_PASSWORD")
-	port := os.Getenv("RABBITMQ_PORT")
+	cfg := Config{
+		Host:       c.Host,
+		Port:       c.Port,
+		User:       c.User,
+		Password:   c.Password,
+		VHost:      c.VHost,
+		TLS:        c.TLS,
+		CACertFile: c.CACertFile,
+		CertFile:   c.CertFile,
+		KeyFile:    c.KeyFile,
+		ServerName: c.ServerName,
+	}
 
-	if username == "" || password == "" || port == "" {
-		log.Fatalf("Environment variables RABBITMQ_USER, RABBITMQ_PASSWORD, or RABBITMQ_PORT are not set")
+	if c.URL != "" {
+		uri, err := amqp.ParseURI(c.URL)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.Host = uri.Host
+		cfg.Port = uri.Port
+		cfg.User = uri.Username
+		cfg.Password = uri.Password
+		cfg.VHost = uri.Vhost
+		cfg.TLS = uri.Scheme == "amqps"
 	}
 
-	rabbitURL := fmt.Sprintf("amqp://%s:%s@localhost:%s/", username, password, port)
+	if cfg.Port == 0 {
+		if cfg.TLS {
+			cfg.Port = 5671
+		} else {
+			cfg.Port = 5672
+		}
+	}
 
-	return amqp.Dial(rabbitURL)
+	return cfg, nil
 }
 
-func Cleanup() {
-	// Clean up the resources when the program exits
-	if conn != nil {
-		conn.Close()
+func (cfg Config) URI() amqp.URI {
+	scheme := "amqp"
+	if cfg.TLS {
+		scheme = "amqps"
 	}
+	return amqp.URI{
+		Scheme:   scheme,
+		Host:     cfg.Host,
+		Port:     cfg.Port,
+		Username: cfg.User,
+		Password: cfg.Password,
+		Vhost:    cfg.VHost,
+	}
+}
+
+func (cfg Config) amqpConfig() (amqp.Config, error) {
+	c := amqp.Config{
+		Vhost:      cfg.VHost,
+		Heartbeat:  10 * time.Second,
+		Properties: amqp.NewConnectionProperties(),
+	}
+	c.Properties.SetClientConnectionName(os.Args[0])
+
+	if !cfg.TLS {
+		return c, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: cfg.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.CACertFile != "" {
+		pem, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return c, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return c, fmt.Errorf("no certificates found in %s", cfg.CACertFile)
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return c, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	c.TLSClientConfig = tlsConfig
+
+	return c, nil
 }
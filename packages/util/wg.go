@@ -1,15 +0,0 @@
-package util
-
-import "sync"
-
-type ReadOnlyWaitGroup struct {
-	wg *sync.WaitGroup
-}
-
-func NewReadOnlyWaitGroup(wg *sync.WaitGroup) ReadOnlyWaitGroup {
-	return ReadOnlyWaitGroup{wg: wg}
-}
-
-func (rw *ReadOnlyWaitGroup) Wait() {
-	rw.wg.Wait()
-}
@@ -0,0 +1,7 @@
+CREATE TABLE "atlas_checkpoint" (
+    "id" INTEGER NOT NULL PRIMARY KEY DEFAULT 1,
+    "low_water_mark" BIGINT NOT NULL,
+    "offloaded" BIGINT[] NOT NULL DEFAULT '{}',
+    "updated_at" TIMESTAMP(3) NOT NULL DEFAULT NOW(),
+    CONSTRAINT "atlas_checkpoint_single_row" CHECK ("id" = 1)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE "instance_non_raid" (
+    "instance_id" BIGINT NOT NULL PRIMARY KEY,
+    "mode" INTEGER NOT NULL,
+    "date_completed" TIMESTAMP(0) WITH TIME ZONE NOT NULL,
+    "date_crawled" TIMESTAMP DEFAULT NOW()
+);
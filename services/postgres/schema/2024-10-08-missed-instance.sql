@@ -0,0 +1,17 @@
+CREATE TABLE "missed_instance" (
+    "instance_id" BIGINT NOT NULL PRIMARY KEY,
+    "first_seen" TIMESTAMP(3) NOT NULL DEFAULT NOW(),
+    "last_result" INTEGER,
+    "attempts" INTEGER NOT NULL DEFAULT 0,
+    -- NULL once the instance has exhausted its retries
+    "next_retry" TIMESTAMP(3) DEFAULT NOW()
+);
+CREATE INDEX "missed_instance_next_retry_idx" ON "missed_instance"("next_retry") WHERE "next_retry" IS NOT NULL;
+
+CREATE TABLE "missed_instance_range" (
+    "id" SERIAL PRIMARY KEY,
+    "start_id" BIGINT NOT NULL,
+    "end_id" BIGINT NOT NULL,
+    "reason" TEXT NOT NULL,
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT NOW()
+);
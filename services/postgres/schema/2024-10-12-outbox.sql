@@ -0,0 +1,10 @@
+CREATE TABLE "outbox" (
+    "id" BIGSERIAL PRIMARY KEY,
+    "queue" TEXT NOT NULL,
+    "body" BYTEA NOT NULL,
+    "created_at" TIMESTAMP(3) NOT NULL DEFAULT NOW(),
+    "attempts" INTEGER NOT NULL DEFAULT 0,
+    "sent_at" TIMESTAMP(3)
+);
+CREATE INDEX "outbox_pending_idx" ON "outbox"("id") WHERE "sent_at" IS NULL;
+CREATE INDEX "outbox_sent_at_idx" ON "outbox"("sent_at") WHERE "sent_at" IS NOT NULL;
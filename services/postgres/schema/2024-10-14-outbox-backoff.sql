@@ -0,0 +1,6 @@
+-- Rows which fail to publish are retried with exponential backoff, and parked with a NULL
+-- next_attempt_at once they run out of attempts, so they can't hold up the rows behind them
+ALTER TABLE "outbox" ADD COLUMN "next_attempt_at" TIMESTAMP(3) DEFAULT NOW();
+DROP INDEX "outbox_pending_idx";
+CREATE INDEX "outbox_pending_idx" ON "outbox"("id") WHERE "sent_at" IS NULL AND "next_attempt_at" IS NOT NULL;
+CREATE INDEX "outbox_parked_idx" ON "outbox"("id") WHERE "sent_at" IS NULL AND "next_attempt_at" IS NULL;
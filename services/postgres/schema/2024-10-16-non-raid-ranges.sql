@@ -0,0 +1,18 @@
+-- Non-raids are most of the id space, so they are recorded as inclusive ranges of ids rather
+-- than a row per instance. Ranges may overlap when an id is crawled more than once.
+CREATE TABLE "instance_non_raid_range" (
+    "start_id" BIGINT NOT NULL,
+    "end_id" BIGINT NOT NULL,
+    "date_crawled" TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX "instance_non_raid_range_idx" ON "instance_non_raid_range" USING GIST (int8range("start_id", "end_id", '[]'));
+
+INSERT INTO "instance_non_raid_range" ("start_id", "end_id")
+SELECT MIN("instance_id"), MAX("instance_id")
+FROM (
+    SELECT "instance_id", "instance_id" - ROW_NUMBER() OVER (ORDER BY "instance_id") AS "run"
+    FROM "instance_non_raid"
+) AS "runs"
+GROUP BY "run";
+
+DROP TABLE "instance_non_raid";